@@ -0,0 +1,4422 @@
+// Copyright 2017 Google Inc.
+// 
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+// 
+//     http://www.apache.org/licenses/LICENSE-2.0
+// 
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package calblink shows upcoming calendar events on a blink(1) or a similar light.  The calblink command is a thin
+// wrapper around it: read the UserPrefs with ReadUserPrefs, and then run them with a Runner.
+package calblink
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	blink1 "github.com/hink/go-blink1"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// TODO - make color fade from green to yellow to red
+// TODO - add Clock type to manage time-of-day where we currently use Time and hacks to set it to the current day
+// Configuration file:
+// JSON file with the following structure, or the same in YAML if the file name ends in .yaml or .yml:
+// {
+//   excludes: [ "event", "names", "to", "ignore"],
+//   startTime: "hh:mm (24 hr format) to start blinking at every day",
+//   endTime: "hh:mm (24 hr format) to stop blinking at every day",
+//   endGraceMinutes: 0
+//   skipDays: [ "weekdays", "to", "skip"],
+//   skipDates: [ "2024-08-12", "2024-08-13" ],
+//   pollInterval: 30
+//   alignPolls: false
+//   pollJitter: 0
+//   calendar: "calendar"
+//   calendars: [ "calendar", { id: "another calendar", responseState: "accepted", color: "Blue" } ]
+//   calendarColors: { "calendar": "Red Flash" }
+//   calendarColorMode: "replace"
+//   overlapStrategy: "calendarOrder"
+//   responseState: "all"
+//   deviceFailureRetries: 10
+//   deviceMaxBackoff: 300
+//   connectRetries: 0
+//   connectRetryInterval: 10
+//   showDots: true
+//   dotChars: { "normal": ".", "error": "," }
+//   deviceAssignments: { "2001A7F3": "calendar" }
+//   deviceCalibration: { "2001A7F3": { "red": 1.0, "green": 0.85, "blue": 0.9, "gamma": 1.0 } }
+//   statusPort: 8080
+//   privacyMode: false
+//   workHours: { "Friday": { startTime: "hh:mm", endTime: "hh:mm" } }
+//   workPeriods: [ { startTime: "09:00", endTime: "12:00" }, { startTime: "13:00", endTime: "18:00" } ]
+//   backend: "google"
+//   caldavURL: "https://caldav.example.com/dav/calendars/user/me@example.com/"
+//   caldavUsername: "me@example.com"
+//   caldavPassword: "app password"
+//   outlookClientID: "application (client) ID"
+//   outlookClientSecret: ""
+//   outlookTenant: "common"
+//   colorRules: [ { minutes: 1, color: "Red Pulse" }, { minutes: 2, color: "Fast Red Flash" }, { minutes: 5, color: "Red" }, { color: "Green" } ]
+//   excludeRegex: "regular expression"
+//   includeRegex: "regular expression"
+//   useEventColors: false
+//   eventColorMap: { "11": "Red", "10": "Green" }
+//   controlSocket: "/path/to/socket"
+//   grpcPort: 50051
+//   grpcAddress: "localhost"
+//   brightness: 100
+//   nightBrightness: 20
+//   nightStartTime: "hh:mm"
+//   nightEndTime: "hh:mm"
+//   quietHours: { startTime: "22:00", endTime: "07:00" }
+//   logFile: "/path/to/calblink.log"
+//   logMaxSizeMB: 10
+//   logKeepFiles: 3
+//   logFormat: "text"
+//   simulate: false
+//   skipFreeEvents: false
+//   onlyMyEvents: false
+//   skipAllDayEvents: true
+//   metricsPort: 9090
+//   failureColor: "MagentaFlash"
+//   failureThreshold: 3
+//   authErrorColor: "Magenta"
+//   maxBackoff: 600
+//   deviceType: "blink1"
+//   devicePatterns: false
+//   fadeMillis: 0
+//   flashIntervalMillis: 0
+//   flashOnMillis: 0
+//   flashOffMillis: 0
+//   statusFile: "/path/to/status.json"
+//   notify: false
+//   soundOnImminent: false
+//   soundFile: "/path/to/sound.wav"
+//   keywordPatterns: { "focus time": "Blue", "1:1|one on one": "Yellow" }
+//   tokenFile: "/path/to/token.json"
+//   dndCalendar: "calendar ID"
+//   outOfOffice: false
+//   outOfOfficePattern: "regular expression"
+//   videoCallColor: "Yellow"
+//   tentativeColor: "Yellow"
+//   declinedColor: "Blue"
+//   justStartedColor: "Fast Red Flash"
+//   justStartedMinutes: 2
+//   videoCallRegex: "regular expression"
+//   customColors: { "Orange Pulse": { rgb: [255, 100, 0], pattern: "pulse" } }
+//   timezone: "America/New_York"
+//   holidays: [ "2024-11-29", "12-25", "en.usa#holiday@group.v.calendar.google.com" ]
+//   slackToken: "xoxp-..."
+//   webhookURL: "http://localhost:8123/api/webhook/calblink"
+//   deciderCommand: "/path/to/decider --flag"
+//   mqttBroker: "mqtt://homeassistant.local:1883"
+//   mqttUsername: "calblink"
+//   mqttPassword: "password"
+//   mqttTopic: "calblink"
+//   idleColor: "Black"
+//   exitColor: "Green"
+//   breakEndingColor: "Green"
+//   breakEndingMinutes: 120
+//   busyWindow: 60
+//   busyColors: { "3": "Red Flash", "4": "Fast Red Flash" }
+//   eventTypes: { "outOfOffice": "Black", "focusTime": "Blue", "workingLocation": "ignore" }
+//   minEventMinutes: 0
+//   leadTimeMinutes: 0
+//   useEventReminders: false
+//   thresholdHysteresis: 0
+//   pauseWhenLocked: false
+//   showMeetingEndCountdown: false
+//   meetingEndColors: [ { minutes: 2, color: "Red Flash" }, { minutes: 5, color: "Yellow" }, { color: "Blue" } ]
+//   travelPattern: "travel|commute"
+//   rampColors: { startColor: "Green", endColor: "Red", minutes: 30 }
+//   travelColors: [ { minutes: 0, color: "Blue" }, { minutes: 10, color: "Red Flash" }, { minutes: 30, color: "Red" }, { minutes: 60, color: "Yellow" }, { minutes: 120, color: "Green" } ]
+//   profiles: { "home": { calendar: "me@example.com", startTime: "18:00", endTime: "22:00" } }
+//}
+// Notes on items:
+// Calendar is the calendar ID - the email address of the calendar.  For a person's calendar, that's their email.
+// For a secondary calendar, it's the base64 string @group.calendar.google.com on the calendar details page.
+// Calendars lists several calendars to watch at once, instead of Calendar.  The soonest event on any of them is shown; if
+// two events start at the same time, the one from the calendar listed first wins.  An entry can be the calendar ID, or
+// an object with an id, a responseState that replaces ResponseState for that calendar, and a color that its events are
+// shown in, as in CalendarColors.
+// A calendar that can't be found is warned about once and skipped; it's only a failure if none of them can be found.
+// CalendarColors shows events from particular calendars in a fixed color whenever they would light the blink(1).  A color
+// in the calendar's entry in Calendars takes precedence over one here.
+// CalendarColorMode is how a calendar's color is used: "replace" (the default) shows it instead of the usual colors, and
+// "blend" mixes it half and half into them, keeping their flashing, so that both the time until the event and the
+// calendar it's from can be seen.
+// OverlapStrategy decides which event is shown when several start at the same time, on one calendar or on several.
+// "calendarOrder" (the default) shows the one from the calendar listed first in Calendars, or on a single calendar the
+// one the calendar lists first; "earliestEnd" shows the one that ends first; "longest" shows the longest one; and
+// "mostUrgent" shows the one whose color looks most urgent: flashing before steady, faster flashing before slower, and
+// anything before off.  Whatever the strategy, events that are still tied go by calendarOrder.
+// AlignPolls starts each poll on a multiple of PollInterval by the clock, such as on the minute and half minute for 30,
+// rather than PollInterval after the last one, so that colors change soon after each minute ticks over.  Default is
+// false.
+// PollJitter moves each poll a random amount of up to that many seconds earlier or later than it would otherwise be, so
+// that copies of calblink polling a shared calendar don't all hit it at once.  Each poll is moved from its usual time,
+// rather than from the last poll, so the polls don't drift.  It must be less than half of PollInterval.  Default is 0.
+// SkipDays may be localized.
+// SkipDates are particular dates (YYYY-MM-DD) to skip just like SkipDays, such as days of leave.
+// Excludes is exact string matches only.
+// ResponseState can be one of: "all" (all events whatever their response status), "accepted" (only accepted events),
+// "notRejected" (any events that are not rejected).  Default is notRejected.
+// DeviceFailureRetries is the number of consecutive failures to initialize the device before the program quits. Default is 10.
+// Attempts to reopen a device that has stopped working, such as one that was unplugged, are at least 5 seconds apart.
+// If DeviceFailureRetries is -1, the device is retried forever, and each failed attempt is logged.  The wait between
+// attempts doubles after each one, from 10 seconds up to DeviceMaxBackoff seconds.  Default is 300.
+// ConnectRetries is how many times to retry reaching the calendar server at startup before the program quits, or -1 to
+// retry forever, such as when calblink starts before the network is up.  Only OnlyMyEvents needs the server at startup;
+// otherwise fetches that fail are retried by the main loop anyway.  ConnectRetryInterval is the wait between attempts,
+// in seconds.  Defaults are 0 and 10.
+// ShowDots indicates whether to show dots and similar marks to indicate that the program has completed an update cycle.
+// DotChars replaces those marks with strings of your own, such as emoji.  It maps any of "normal", "error", "skipDay",
+// "beforeStart", "afterEnd", "snoozed", "override", "locked", "dnd", "away" and "deviceFailure" to the string to show; see
+// defaultDots for the built-in ones.
+// DeviceAssignments maps a device's USB serial number to the calendar ID it should show, so that each calendar stays on
+// the same device however the devices are plugged in.  calblink prints the serial number of each device it opens.
+// Devices without an assignment show Calendar.  If an assigned device isn't found, its calendar is shown on the first
+// device found instead (unless that device has its own assignment).  Devices are numbered from 0 in the order they are
+// found, in messages and elsewhere.
+// DeviceCalibration maps a device's serial number, as in DeviceAssignments, to corrections for that device's colors, so
+// that devices that show the same color differently can be made to match.  Red, Green and Blue scale their channels, from 0
+// to 1, and Gamma, which must be more than 0, is applied to each channel first.  Anything left out, and any device
+// without an entry, is left as it is: 1 for each.  Use --calibrate to compare the devices.  A reload of the config file
+// doesn't change the calibration of the devices already open.
+// StatusPort is the port to serve a JSON status document on.  Default is 0, which disables the status server.
+// PrivacyMode limits the status document to the color names, leaving out event details.
+// WorkHours overrides StartTime and EndTime for particular days of the week.  Days without an entry, and times left out of
+// an entry, use the global StartTime and EndTime.
+// WorkPeriods replaces StartTime and EndTime with several periods a day, such as a morning and an afternoon with a
+// lunch break between them.  Each period needs both times, and the periods must be in order without overlapping.  The
+// blink(1) is off outside them.  Days in WorkHours still use their own hours, and SkipDays still applies.
+// EndGraceMinutes keeps the blink(1) going for up to that many minutes after the end of a work period while a timed event
+// on one of the calendars is still going on, so that a meeting that runs over is shown until it ends.  Default is 0.
+// Backend is where events come from: "google" (Google Calendar), "caldav" (a CalDAV server), "outlook" (Outlook /
+// Office 365, through Microsoft Graph) or "ics" (iCalendar feeds).  Default is google.
+// With ics, calendar IDs are the URLs of the feeds, which are only downloaded again once they have changed.  Feeds don't
+// say who is reading them, so ResponseState and OnlyMyEvents have nothing to go on.
+// CaldavURL, CaldavUsername and CaldavPassword are the server URL and credentials for the caldav backend.  With CalDAV,
+// calendar IDs are calendar collection paths relative to CaldavURL, and "primary" means CaldavURL itself.
+// OutlookClientID and OutlookClientSecret identify the app registered in Azure for the outlook backend; the secret can
+// be left out for a public client.  OutlookTenant is the Azure tenant to sign in to.  Default is "common", which works
+// for any account.  With Outlook, calendar IDs are Graph calendar IDs, and "primary" means your default calendar.  The
+// token is cached in ~/.credentials/calendar-blink1-outlook.json.
+// ColorRules replaces the built-in colors for the next event.  Rules are checked in order, and the first one whose
+// minutes is more than the number of minutes until the event starts (negative once it has started) wins.  A rule
+// without minutes always matches.  If no rule matches, the blink(1) is turned off.  Colors are the names of entries in
+// namedStates or CustomColors, such as "Red Flash", ignoring case.
+// A rule can also have an led, 1 or 2, to apply to just that LED of a blink(1) mk2; rules without one apply to both.
+// Each LED uses the first rule that matches and applies to it, so the two can show different colors at once.
+// ExcludeRegex ignores events whose titles match it.  IncludeRegex, if set, ignores events whose titles don't match it.
+// Both are applied after Excludes and ResponseState.
+// UseEventColors shows the next event in the color that EventColorMap gives for its Google Calendar color ID, instead of
+// the usual color for the time until it starts.  The event still only lights the blink(1) when it otherwise would; events
+// without a color ID, or whose color ID isn't in the map, use the usual colors.
+// ControlSocket is the path of a Unix domain socket to listen for commands on; see control.go.  Default is no socket.
+// GRPCPort is the port to serve the gRPC control interface in control.proto on, which can do what the control socket
+// does.  Default is 0, which disables it.  GRPCAddress is the address to listen on.  Default is "localhost"; the
+// interface has no authentication, so anyone who can reach it can control the devices.
+// Brightness scales all colors, from 0 to 100 percent.  Default is 100.
+// NightBrightness, if set, is used instead of Brightness between NightStartTime and NightEndTime, which may wrap past
+// midnight.
+// QuietHours is a startTime and endTime, which may wrap past midnight, during which the blink(1) is kept off.  Unlike
+// outside EndTime, calblink keeps polling as usual, so the status server, status file and metrics still show the colors
+// it would have shown, and it is ready in the morning without a cold start.  Notifications aren't shown while it's quiet.
+// Default is none.
+// LogFile is a file to write all log, status, debug and progress output to instead of stdout and stderr.  It is rotated
+// when it reaches LogMaxSizeMB megabytes (default 10), keeping LogKeepFiles old files (default 3).  Changes to these
+// take effect on restart.
+// LogFormat is "text" (the default) or "json".  In JSON format every line of output is a JSON object with time, level
+// and msg fields, and poll results, state changes and failures have fields of their own, such as the event, minutes
+// until it starts and color.  Progress dots are not shown.  Takes effect on restart.
+// Simulate prints each color change instead of using a blink(1), for testing without hardware.
+// SkipFreeEvents ignores events that are marked as free (transparent) instead of busy.  Default is false.
+// OnlyMyEvents ignores events that you aren't the organizer or creator of.  Your email address is looked up from the
+// account calblink signs in as, once at startup.  It applies as well as ResponseState.  Default is false.
+// SkipAllDayEvents ignores all-day events: those with a start date rather than a start time, however many days they last.
+// Timed events are never all-day events, even if they run past midnight.  Default is true.  If it's false, all-day events
+// start at midnight local time.
+// MinEventMinutes ignores timed events shorter than that many minutes, such as placeholders.  Events with no length at
+// all, such as reminders, are always shorter.  All-day events aren't affected; SkipAllDayEvents decides those.  Default
+// is 0, which keeps every event.
+// LeadTimeMinutes makes the colors for the time until an event starts, from ColorRules, RampColors, TravelColors or the
+// built-in ones, come on that many minutes early, as though every event started that much sooner.  A negative value
+// makes them come on later.  It must be from -60 to 60.  The times of JustStartedColor and VideoCallColor, and when an
+// event is notified, still go by when the event really starts.  Default is 0.
+// UseEventReminders makes the colors for an event with its own popup reminder, rather than the calendar's default
+// reminders, start at that reminder: the colors from the time the light first comes on until the event starts are
+// stretched or squeezed to fit between the reminder and the start, in place of LeadTimeMinutes.  If an event has several
+// popup reminders, the earliest is used.  Only Google Calendar events have reminders.  Default is false.
+// ThresholdHysteresis keeps a color from flickering when an event sits near the time it changes, such as when it is
+// moved back a minute: once a color is shown for an event, it is kept for as long as it would be the event's color
+// ThresholdHysteresis minutes later, so moving the event back by less than that doesn't change it.  Colors still change
+// on time as the event gets closer.  Default is 0, which changes the color as soon as the time says.
+// MetricsPort is the port to serve Prometheus metrics on, at /metrics.  Default is 0, which disables the metrics server.
+// FailureColor is shown when fetching the calendar has failed more than FailureThreshold polls in a row.  Defaults are
+// MagentaFlash and 3.
+// AuthErrorColor is shown instead, straight away, when the OAuth token is refused even after reconnecting once, which
+// means signing in again.  Default is Magenta.
+// MaxBackoff is the longest time, in seconds, to wait between polls while fetching the calendar is failing.  After each
+// poll with a failure the wait doubles, up to MaxBackoff, and it goes back to PollInterval after a poll that succeeds.
+// Default is 600.  Setting it no higher than PollInterval turns backoff off.  When the calendar server says calblink is
+// making too many requests, the wait is at least as long as the server asks for, or a minute if it doesn't say, even
+// past MaxBackoff, and the failure doesn't count towards FailureColor, since it goes away by itself.
+// DeviceType is the kind of light to drive: "blink1" or "luxafor" (a Luxafor flag).  Default is blink1.  See device.go.
+// DevicePatterns stores flashing colors on a blink(1) mk2 or mk3 and lets it flash them by itself, so that it keeps
+// flashing even if calblink stalls.  Both LEDs flash together, rather than in turn.  Colors split between the LEDs, and
+// pulsing colors, are still driven by calblink, and so is any flash the device won't take.  It doesn't work with the
+// mk1.  Default is false.
+// FadeMillis is how long, in milliseconds, changes to a steady color take to fade in, including turning off when the
+// program exits.  Flashing colors are unaffected.  Default is 0, which changes colors instantly.
+// FlashIntervalMillis, if set, is how long, in milliseconds, every flashing color shows each of its two colors for,
+// from 100 to 5000.  That includes FailureColor and colors used in ColorRules, but not pulsing colors.  Default is 0,
+// which keeps each color's own rate.
+// FlashOnMillis and FlashOffMillis, if set, replace FlashIntervalMillis for just the first or second color of a flash,
+// such as a short blink with a long dark gap, from 100 to 5000 each.  Each change of color then fades over the shorter
+// of the two, and both LEDs flash together, rather than in turn.  Defaults are 0, which leave each color's time to
+// FlashIntervalMillis or the color's own rate.
+// StatusFile is a file to write the status document to after every poll, replacing it atomically.  It has the same
+// contents as the status server's document, and PrivacyMode applies to it too.  Default is no file.
+// Notify shows a desktop notification with the title and start time of an event when its color first comes on within
+// five minutes of its start.  Default is false.
+// SoundOnImminent plays SoundFile at the same point that Notify would notify an event, once per event.  It uses afplay
+// on macOS, paplay, aplay or ffplay on Linux, and PowerShell on Windows; where none of them is available, it is ignored,
+// with a warning.  Defaults are false and no file.
+// KeywordPatterns maps regular expressions to colors.  If the next event's title matches one, ignoring case, it is shown
+// in that color whenever it would light the blink(1).  A plain word or phrase matches anywhere in the title.  If several
+// match, the longest expression wins.  The colors for the time until the event starts are chosen first (from ColorRules
+// or RampColors if set, or TravelColors for travel), then replaced by BusyColors, then by CalendarColors, then by
+// EventColorMap, then by EventTypes, then by KeywordPatterns, then by VideoCallColor, then by TentativeColor, then by
+// DeclinedColor: a later match wins.
+// TokenFile is the file to cache the OAuth token in, for the google and outlook backends.  Default is
+// calendar-blink1.json (or calendar-blink1-outlook.json) in ~/.credentials.  It can also be set with --token_file.
+// DNDCalendar is a do not disturb calendar: while any event on it is going on, every device is off, whatever the other
+// calendars say.  Events on it that you have declined don't count.  Default is none.
+// OutOfOffice turns every device off while an out of office event is going on on any of the calendars the devices show,
+// all-day events included.  Events are out of office if their event type is outOfOffice, or if OutOfOfficePattern is
+// set and their title matches it, ignoring case.  Events you have declined don't count.  Defaults are false and none.
+// VideoCallColor, if set, is shown instead of the usual colors before a video call starts, whenever they would light the
+// blink(1).  An event is a video call if it has Google Calendar conference data, or its location or description matches
+// VideoCallRegex.  The default VideoCallRegex matches Zoom, Google Meet, Microsoft Teams and Webex links.
+// TentativeColor, if set, is shown instead of the usual colors before an event that you have only tentatively accepted
+// starts, whenever they would light the blink(1), so that you remember to answer.  It doesn't change which events are
+// shown; that is up to ResponseState.  Default is none.
+// DeclinedColor, if set, is shown before an event that you have declined starts, whenever the usual colors would light
+// the blink(1), in case you change your mind.  It only applies when ResponseState would leave declined events out: such
+// events are then shown until they start, in this color, though they still don't count for BusyColors or the meeting
+// end countdown, and don't set the Slack status.  An event you haven't declined that starts at the same time is shown
+// instead.  Default is none.
+// JustStartedColor, if set, is shown for the first JustStartedMinutes minutes after an event starts, whenever the usual
+// colors would light the blink(1), so that you know it has begun without you.  It takes precedence over the other
+// colors, including ShowMeetingEndCountdown.  Defaults are none and 2 minutes.
+// CustomColors defines more colors, which can be used anywhere a color name can.  Each has an rgb value, from 0 to 255
+// for each of red, green and blue, and a pattern: "solid" (the default), "flash" (on and off at the speed of Red Flash)
+// or "pulse" (fading smoothly on and off, like Red Pulse but more slowly).  Custom colors can't have the same name as a
+// built-in one.
+// Timezone is the IANA name of the time zone that StartTime, EndTime, WorkHours, WorkPeriods, SkipDays, the night
+// brightness times and all-day events are in, and that event times are shown in.  Default is the system's time zone.
+// Holidays are days to skip as well as SkipDays.  Each entry is a date (YYYY-MM-DD), a date that repeats every year
+// (MM-DD), or the ID of a calendar of holidays; a day with an all-day event on one of those calendars is a holiday.
+// SlackToken is a Slack user token with the users.profile:write scope.  If set, your Slack status is set to "In N min" at
+// the same point that Notify would notify an event, and cleared when the blink(1) goes off and when calblink exits.
+// Default is none.
+// WebhookURL is a URL to POST to whenever a device changes color; see webhook.go for the body.  This takes effect on
+// restart.  Default is none.
+// DeciderCommand is a program, with any arguments, that chooses the color for each device instead of calblink; see
+// decider.go.  It is split into words at spaces, not run by a shell.  Its choice still gives way to quiet hours.
+// Default is none.
+// MQTTBroker is an MQTT broker to publish each device's color and next event to, as host:port or a URL: mqtt:// or, for
+// TLS, mqtts://.  Home Assistant discovery config is published too, so that they show up there as sensors.  The topics
+// are under MQTTTopic (default "calblink"), and MQTTUsername and MQTTPassword log in if the broker needs it; see
+// mqtt.go.  PrivacyMode leaves out the next event.  This takes effect on restart.  Default is none.
+// IdleColor is shown when there is no next event, or the colors for it would turn the blink(1) off - an hour or more
+// before it, with the built-in colors.  Default is "Black", which turns it off.  Outside work hours, on skip days and
+// while snoozed the blink(1) is still turned off.
+// ExitColor, if set, is left showing on every device when calblink is stopped, instead of turning them off.  It must be a
+// steady color, not one that flashes or pulses, since nothing is left running to flash it.  Default is none.
+// BreakEndingColor, if set, is shown instead of IdleColor during a break: when no timed event is going on and the next
+// event starts within BreakEndingMinutes, but the usual colors for it haven't come on yet.  Defaults are none and 120.
+// BusyColors maps a number of meetings to a color.  If at least that many events start in the next BusyWindow minutes,
+// counting every calendar the device shows, the color replaces the colors for the time until the next event whenever
+// they would light the blink(1).  The entry for the most meetings that applies wins.  CalendarColors and the options
+// after it still take precedence.  BusyWindow defaults to 60; BusyColors defaults to none.
+// EventTypes maps Google Calendar event types - "default", "outOfOffice", "focusTime", "workingLocation" and so on - to a
+// color, or to "ignore" to skip events of that type.  The color replaces the usual ones whenever the event would light
+// the blink(1), including while it is going on; KeywordPatterns and VideoCallColor still take precedence.  Event types that
+// aren't listed are treated as ordinary events.  Outlook events marked as out of office have the type "outOfOffice".
+// Default is none.
+// PauseWhenLocked turns every device off while the screen is locked, on Linux (through systemd-logind) and Windows.  On
+// other platforms it is ignored, with a warning.  It takes effect on restart.  Default is false.
+// ShowMeetingEndCountdown colors the blink(1) by the time until the meeting going on now ends, instead of by the time
+// since it started.  If several meetings overlap, the one that ends first counts.  Only timed events count, not all-day
+// ones.  The countdown takes precedence over the other colors, except for ones that turn the blink(1) off.
+// MeetingEndColors are the colors for the countdown, as rules like ColorRules whose minutes are the minutes until the
+// meeting ends.  Default is Red Flash under 2 minutes, Yellow under 5 minutes and Blue otherwise.  Default for
+// ShowMeetingEndCountdown is false.
+// RampColors, if set, replaces the colors for the time until an event starts with a smooth shift from StartColor to
+// EndColor over the last Minutes minutes before it.  Before then the blink(1) shows IdleColor; once the event has
+// started, the usual colors for an event that is going on are used.  Only the steady color of a flashing or pulsing color
+// is used.  The other options that replace colors still take precedence.  Default is none.
+// TravelPattern is a regular expression for the titles of travel blocks, such as the time to get to an off-site meeting,
+// ignoring case.  Travel blocks use TravelColors instead of the usual colors for the time until they start, so that
+// they can warn earlier and for longer.  The event that a travel block leads to, starting no more than 10 minutes after
+// it ends, isn't warned about again: until it starts it is shown as though it were going on.  TravelColors are rules
+// like ColorRules.  The built-in ones are the usual colors with every time doubled: Green from two hours before, Yellow
+// from one hour, and so on.  Defaults are none.
+// Profiles are named sets of options that replace the ones in the rest of the file while the profile is in use, such as
+// different calendars and hours for work and home.  Options that are maps, such as customColors, are merged instead, a
+// profile's entries replacing any with the same key.  The --profile flag picks the profile to start with, and the
+// profile control command switches to another; see control.go.  Without one, the options outside Profiles are used
+// on their own.  Default is none.
+
+// responseState is an enumerated list of event response states, used to control which events will activate the blink(1).
+type responseState string
+
+const (
+	responseStateAll         = responseState("all")
+	responseStateAccepted    = responseState("accepted")
+	responseStateNotRejected = responseState("notRejected")
+)
+
+// checkStatus returns true if the given event status is one that should activate the blink(1) in the given responseState.
+func (state responseState) checkStatus(status string) bool {
+	switch state {
+	case responseStateAll:
+		return true
+
+	case responseStateAccepted:
+		return (status == "accepted")
+
+	case responseStateNotRejected:
+		return (status != "declined")
+	}
+	return false
+}
+
+func (state responseState) isValidState() bool {
+	switch state {
+	case responseStateAll:
+		return true
+	case responseStateAccepted:
+		return true
+	case responseStateNotRejected:
+		return true
+	}
+	return false
+}
+
+// backendType is an enumerated list of the places calendar events can come from.
+type backendType string
+
+const (
+	backendGoogle  = backendType("google")
+	backendCaldav  = backendType("caldav")
+	backendOutlook = backendType("outlook")
+	backendICS     = backendType("ics")
+)
+
+func (backend backendType) isValidBackend() bool {
+	switch backend {
+	case backendGoogle:
+		return true
+	case backendCaldav:
+		return true
+	case backendOutlook:
+		return true
+	case backendICS:
+		return true
+	}
+	return false
+}
+
+// UserPrefs is a struct that manages the user preferences as set by the config file and command line.
+
+type UserPrefs struct {
+	excludes                map[string]bool
+	startTime               *time.Time
+	endTime                 *time.Time
+	endGraceMinutes         int
+	skipDays                [7]bool
+	skipDates               map[string]bool // "2006-01-02"
+	pollInterval            int
+	alignPolls              bool
+	pollJitter              int
+	calendars               []string
+	calendarColors          map[string]calendarState
+	calendarColorMode       calendarColorMode
+	overlapStrategy         overlapStrategy
+	responseState           responseState
+	calendarResponseStates  map[string]responseState
+	deviceFailureRetries    int
+	deviceMaxBackoff        int
+	connectRetries          int
+	connectRetryInterval    int
+	showDots                bool
+	dots                    map[dotKind]string
+	deviceAssignments       map[string]string
+	deviceCalibration       map[string]calibration
+	statusPort              int
+	privacyMode             bool
+	workHours               map[time.Weekday]workHours
+	workPeriods             []workHours
+	backend                 backendType
+	caldavURL               string
+	caldavUsername          string
+	caldavPassword          string
+	outlookClientID         string
+	outlookClientSecret     string
+	outlookTenant           string
+	colorRules              []colorRule
+	excludeRegex            *regexp.Regexp
+	includeRegex            *regexp.Regexp
+	useEventColors          bool
+	eventColorMap           map[string]calendarState
+	controlSocket           string
+	grpcPort                int
+	grpcAddress             string
+	profile                 string
+	options                 Options
+	brightness              int
+	nightBrightness         *int
+	nightStartTime          *time.Time
+	nightEndTime            *time.Time
+	quietHours              *workHours
+	logFile                 string
+	logMaxSizeMB            int
+	logKeepFiles            int
+	logFormat               logFormat
+	simulate                bool
+	skipFreeEvents          bool
+	onlyMyEvents            bool
+	skipAllDayEvents        bool
+	minEventMinutes         int
+	leadTimeMinutes         int
+	useEventReminders       bool
+	thresholdHysteresis     int
+	metricsPort             int
+	failureState            calendarState
+	authErrorState          calendarState
+	failureThreshold        int
+	maxBackoff              int
+	deviceType              deviceType
+	devicePatterns          bool
+	fadeMillis              int
+	flashIntervalMillis     int
+	flashOnMillis           int
+	flashOffMillis          int
+	statusFile              string
+	notify                  bool
+	soundOnImminent         bool
+	soundFile               string
+	dryRun                  bool
+	keywordPatterns         []keywordPattern
+	tokenFile               string
+	dndCalendar             string
+	outOfOffice             bool
+	outOfOfficeRegex        *regexp.Regexp
+	videoCallState          *calendarState
+	tentativeState          *calendarState
+	declinedState           *calendarState
+	videoCallRegex          *regexp.Regexp
+	customStates            []calendarState
+	timezone                *time.Location
+	holidays                holidays
+	slackToken              string
+	webhookURL              string
+	deciderCommand          []string
+	mqttBroker              string
+	mqttUsername            string
+	mqttPassword            string
+	mqttTopic               string
+	clientSecretFile        string
+	idleState               calendarState
+	exitState               *calendarState
+	breakEndingState        *calendarState
+	breakEndingMinutes      int
+	busyWindow              int
+	busyRules               []busyRule
+	eventTypes              map[string]eventTypeRule
+	pauseWhenLocked         bool
+	showMeetingEndCountdown bool
+	meetingEndRules         []colorRule
+	justStartedState        *calendarState
+	justStartedMinutes      int
+	ramp                    *colorRamp
+	travelRegex             *regexp.Regexp
+	travelRules             []colorRule
+	// accountEmail is the email address of the account the calendars are read as.  It is only looked up for
+	// OnlyMyEvents, and is set by main rather than read from the config file.
+	accountEmail string
+}
+
+// calendarColorMode is an enumerated list of the ways CalendarColors can be used.
+type calendarColorMode string
+
+const (
+	calendarColorReplace = calendarColorMode("replace")
+	calendarColorBlend   = calendarColorMode("blend")
+)
+
+func (mode calendarColorMode) isValidCalendarColorMode() bool {
+	switch mode {
+	case calendarColorReplace:
+		return true
+	case calendarColorBlend:
+		return true
+	}
+	return false
+}
+
+// overlapStrategy is an enumerated list of the ways to choose between events that start at the same time.
+type overlapStrategy string
+
+const (
+	overlapCalendarOrder = overlapStrategy("calendarOrder")
+	overlapEarliestEnd   = overlapStrategy("earliestEnd")
+	overlapLongest       = overlapStrategy("longest")
+	overlapMostUrgent    = overlapStrategy("mostUrgent")
+)
+
+func (strategy overlapStrategy) isValidOverlapStrategy() bool {
+	switch strategy {
+	case overlapCalendarOrder:
+		return true
+	case overlapEarliestEnd:
+		return true
+	case overlapLongest:
+		return true
+	case overlapMostUrgent:
+		return true
+	}
+	return false
+}
+
+// eventTypeRule is what to do with events of one type in EventTypes: skip them, or show them in a color.
+type eventTypeRule struct {
+	ignore bool
+	state  calendarState
+}
+
+// busyRule is a single entry in BusyColors.
+type busyRule struct {
+	meetings int
+	state    calendarState
+}
+
+// keywordPattern is a single entry in KeywordPatterns.
+type keywordPattern struct {
+	regexp *regexp.Regexp
+	state  calendarState
+}
+
+// colorRamp is RampColors: the color shifts from start to end over the last minutes minutes before an event.
+type colorRamp struct {
+	start   calendarState
+	end     calendarState
+	minutes int
+}
+
+// colorRule is a single entry in ColorRules.  If minutes is nil the rule always matches.  It applies to the given LED,
+// or to both if led is LEDAll.
+type colorRule struct {
+	minutes *int64
+	state   calendarState
+	led     blink1.LED
+}
+
+// brightnessAt returns the brightness to use at the given time.
+func (userPrefs *UserPrefs) brightnessAt(now time.Time) int {
+	if userPrefs.nightBrightness == nil {
+		return userPrefs.brightness
+	}
+	if inDailyWindow(now, *userPrefs.nightStartTime, *userPrefs.nightEndTime) {
+		return *userPrefs.nightBrightness
+	}
+	return userPrefs.brightness
+}
+
+// inQuietHours reports whether the blink(1) should be kept off at the given time because of QuietHours.
+func (userPrefs *UserPrefs) inQuietHours(now time.Time) bool {
+	return userPrefs.quietHours != nil &&
+		inDailyWindow(now, *userPrefs.quietHours.startTime, *userPrefs.quietHours.endTime)
+}
+
+// inDailyWindow reports whether now is between the start and end times of day.  The window wraps past midnight if the
+// end is not after the start.
+func inDailyWindow(now time.Time, startTime time.Time, endTime time.Time) bool {
+	start := setHourMinuteFromTime(now, startTime)
+	end := setHourMinuteFromTime(now, endTime)
+	if start.Before(end) {
+		return !now.Before(start) && now.Before(end)
+	}
+	// The window wraps past midnight.
+	return !now.Before(start) || now.Before(end)
+}
+
+// workHours is a start and end time: the hours for a single day of the week, or one of the work periods.  Either may be
+// nil.
+type workHours struct {
+	startTime *time.Time
+	endTime   *time.Time
+}
+
+// periodsFor returns the periods of the given day in which the blink(1) is on, in order, along with the name of the
+// schedule they came from for debug output.  A day in WorkHours has a single period; otherwise the day has the
+// WorkPeriods, or failing that the single period from StartTime to EndTime.
+func (userPrefs *UserPrefs) periodsFor(weekday time.Weekday) (periods []workHours, schedule string) {
+	if hours, ok := userPrefs.workHours[weekday]; ok {
+		period := workHours{startTime: userPrefs.startTime, endTime: userPrefs.endTime}
+		if hours.startTime != nil {
+			period.startTime = hours.startTime
+		}
+		if hours.endTime != nil {
+			period.endTime = hours.endTime
+		}
+		return []workHours{period}, weekday.String()
+	}
+	if len(userPrefs.workPeriods) > 0 {
+		return userPrefs.workPeriods, "work periods"
+	}
+	return []workHours{{startTime: userPrefs.startTime, endTime: userPrefs.endTime}}, "global"
+}
+
+// untilWorkPeriod returns how long it is from now until the blink(1) should next be on, given today's periods, or 0 if
+// now is inside one of them.  Dot is the progress mark for the wait: dotBeforeStart if a period starts later today, and
+// dotAfterEnd if the wait is until tomorrow.
+func untilWorkPeriod(now time.Time, periods []workHours) (wait time.Duration, dot dotKind) {
+	for _, period := range periods {
+		if period.startTime != nil {
+			start := setHourMinuteFromTime(now, *period.startTime)
+			if diff := start.Sub(now); diff > 0 {
+				fmt.Fprintf(output.debug, "Next start time: %v\n", start)
+				return diff, dotBeforeStart
+			}
+		}
+		if period.endTime == nil || !now.After(setHourMinuteFromTime(now, *period.endTime)) {
+			return 0, ""
+		}
+	}
+	fmt.Fprintf(output.debug, "Past the last end time today\n")
+	return tomorrow(now).Sub(now), dotAfterEnd
+}
+
+// inEndGrace reports whether now is less than grace after the end of one of the periods.
+func inEndGrace(now time.Time, periods []workHours, grace time.Duration) bool {
+	for _, period := range periods {
+		if period.endTime == nil {
+			continue
+		}
+		end := setHourMinuteFromTime(now, *period.endTime)
+		if now.After(end) && now.Before(end.Add(grace)) {
+			return true
+		}
+	}
+	return false
+}
+
+// holidays is the user's list of days off, other than skip days.
+type holidays struct {
+	dates     map[string]bool // "2006-01-02"
+	annual    map[string]bool // "01-02", every year
+	calendars []string        // Calendars of holidays, checked for an all-day event today.
+}
+
+// isHoliday reports whether now falls on one of the listed dates.  Holiday calendars are checked separately, since
+// that needs a fetch.
+func (holidays *holidays) isHoliday(now time.Time) bool {
+	return holidays.dates[now.Format("2006-01-02")] || holidays.annual[now.Format("01-02")]
+}
+
+// parseHolidays sorts the entries in Holidays into dates, annual dates and calendars.  Anything made of digits and
+// dashes is taken as a date, so a mistyped date is an error rather than a calendar.
+func parseHolidays(entries []string) (holidays, error) {
+	result := holidays{dates: make(map[string]bool), annual: make(map[string]bool)}
+	for _, entry := range entries {
+		if strings.Trim(entry, "0123456789-") != "" {
+			result.calendars = append(result.calendars, entry)
+			continue
+		}
+		if t, err := time.Parse("2006-01-02", entry); err == nil {
+			result.dates[t.Format("2006-01-02")] = true
+		} else if t, err := time.Parse("01-02", entry); err == nil {
+			result.annual[t.Format("01-02")] = true
+		} else {
+			return result, fmt.Errorf("Invalid date in holidays: %v", entry)
+		}
+	}
+	return result, nil
+}
+
+// Struct used for decoding the JSON
+type prefLayout struct {
+	Excludes                []string
+	StartTime               string
+	EndTime                 string
+	EndGraceMinutes         int64
+	SkipDays                []string
+	SkipDates               []string
+	PollInterval            int64
+	AlignPolls              bool
+	PollJitter              int64
+	Calendar                string
+	Calendars               []calendarLayout
+	CalendarColors          map[string]string
+	CalendarColorMode       string
+	OverlapStrategy         string
+	ResponseState           string
+	DeviceFailureRetries    int64
+	DeviceMaxBackoff        int64
+	ConnectRetries          int64
+	ConnectRetryInterval    int64
+	ShowDots                string
+	DotChars                map[string]string
+	DeviceAssignments       map[string]string
+	DeviceCalibration       map[string]calibrationLayout
+	StatusPort              int64
+	PrivacyMode             bool
+	WorkHours               map[string]workHoursLayout
+	WorkPeriods             []workHoursLayout
+	Backend                 string
+	CaldavURL               string
+	CaldavUsername          string
+	CaldavPassword          string
+	OutlookClientID         string
+	OutlookClientSecret     string
+	OutlookTenant           string
+	ColorRules              []colorRuleLayout
+	ExcludeRegex            string
+	IncludeRegex            string
+	UseEventColors          bool
+	EventColorMap           map[string]string
+	ControlSocket           string
+	GRPCPort                int64
+	GRPCAddress             string
+	Profiles                map[string]json.RawMessage
+	Brightness              *int64
+	NightBrightness         *int64
+	NightStartTime          string
+	NightEndTime            string
+	QuietHours              *workHoursLayout
+	LogFile                 string
+	LogMaxSizeMB            int64
+	LogKeepFiles            *int64
+	LogFormat               string
+	Simulate                bool
+	SkipFreeEvents          bool
+	OnlyMyEvents            bool
+	SkipAllDayEvents        *bool
+	MinEventMinutes         int64
+	LeadTimeMinutes         int64
+	UseEventReminders       bool
+	ThresholdHysteresis     int64
+	MetricsPort             int64
+	FailureColor            string
+	AuthErrorColor          string
+	FailureThreshold        *int64
+	MaxBackoff              int64
+	DeviceType              string
+	DevicePatterns          bool
+	FadeMillis              int64
+	FlashIntervalMillis     int64
+	FlashOnMillis           int64
+	FlashOffMillis          int64
+	StatusFile              string
+	Notify                  bool
+	SoundOnImminent         bool
+	SoundFile               string
+	KeywordPatterns         map[string]string
+	TokenFile               string
+	DNDCalendar             string
+	OutOfOffice             bool
+	OutOfOfficePattern      string
+	VideoCallColor          string
+	TentativeColor          string
+	DeclinedColor           string
+	VideoCallRegex          string
+	CustomColors            map[string]customColorLayout
+	Timezone                string
+	Holidays                []string
+	SlackToken              string
+	WebhookURL              string
+	DeciderCommand          string
+	MQTTBroker              string
+	MQTTUsername            string
+	MQTTPassword            string
+	MQTTTopic               string
+	IdleColor               string
+	ExitColor               string
+	BreakEndingColor        string
+	BreakEndingMinutes      int64
+	BusyWindow              *int64
+	BusyColors              map[string]string
+	EventTypes              map[string]string
+	PauseWhenLocked         bool
+	ShowMeetingEndCountdown bool
+	MeetingEndColors        []colorRuleLayout
+	JustStartedColor        string
+	JustStartedMinutes      *int64
+	RampColors              *rampLayout
+	TravelPattern           string
+	TravelColors            []colorRuleLayout
+}
+
+// Struct used for decoding an entry in Calendars, which is either a calendar ID or an object.
+type calendarLayout struct {
+	ID            string
+	ResponseState string
+	Color         string
+}
+
+func (layout *calendarLayout) UnmarshalJSON(data []byte) error {
+	var id string
+	if err := json.Unmarshal(data, &id); err == nil {
+		*layout = calendarLayout{ID: id}
+		return nil
+	}
+	// A type of its own, so that decoding the object doesn't come back here.
+	type calendarObject calendarLayout
+	return json.Unmarshal(data, (*calendarObject)(layout))
+}
+
+// Struct used for decoding an entry in CustomColors
+type customColorLayout struct {
+	RGB     []int64
+	Pattern string
+}
+
+// Struct used for decoding an entry in ColorRules
+type colorRuleLayout struct {
+	Minutes *int64
+	Color   string
+	LED     int64
+}
+
+// Struct used for decoding an entry in DeviceCalibration
+type calibrationLayout struct {
+	Red   *float64
+	Green *float64
+	Blue  *float64
+	Gamma *float64
+}
+
+// Struct used for decoding RampColors
+type rampLayout struct {
+	StartColor string
+	EndColor   string
+	Minutes    int64
+}
+
+// Struct used for decoding a day's entry in WorkHours, or an entry in WorkPeriods
+type workHoursLayout struct {
+	StartTime string
+	EndTime   string
+}
+
+// ledPattern is what a LED shows: a steady color, or a flash between two colors.  A pulsing pattern fades smoothly
+// between its two colors instead of flashing, taking flashDuration for each half.
+type ledPattern struct {
+	blinkState    blink1.State
+	flashState    blink1.State
+	flashDuration time.Duration
+	pulse         bool
+}
+
+// calendarState is a display state for the calendar event.  It encapsulates both the colors to display and the flash
+// duration.  Usually both LEDs show the same pattern; a split state shows its own pattern on LED 1 and led2 on LED 2.
+type calendarState struct {
+	name string
+	ledPattern
+	split bool
+	led2  ledPattern
+}
+
+// splitState combines two states that aren't split into one that shows led1 on LED 1 and led2 on LED 2.  If they are
+// the same, that state is shown on both.
+func splitState(led1, led2 calendarState) calendarState {
+	if led1 == led2 {
+		return led1
+	}
+	return calendarState{name: led1.name + " / " + led2.name, ledPattern: led1.ledPattern, split: true, led2: led2.ledPattern}
+}
+
+func (state calendarState) execute(blinker *blinkerState) {
+	blinker.newState <- state
+}
+
+// show sets the state of the display's device, remembering the event that it is for.  During quiet hours the state is
+// remembered, but the device is kept off.
+func (display *deviceDisplay) show(state calendarState, next *upcomingEvent) {
+	if state != display.state {
+		logEvent(levelInfo, "Changing color", "device", display.number, "from", display.state.name, "color", state.name)
+	}
+	display.state = state
+	display.next = next
+	if display.quiet {
+		black.execute(display.blinker)
+		return
+	}
+	state.execute(display.blinker)
+}
+
+// executeAll sets the given state on every device.
+func executeAll(state calendarState, displays []*deviceDisplay) {
+	for _, display := range displays {
+		display.show(state, nil)
+	}
+}
+
+var (
+	black        = calendarState{name: "Black", ledPattern: ledPattern{blinkState: blink1.OffState}}
+	green        = calendarState{name: "Green", ledPattern: ledPattern{blinkState: blink1.State{Green: 255}}}
+	yellow       = calendarState{name: "Yellow", ledPattern: ledPattern{blinkState: blink1.State{Red: 255, Green: 160}}}
+	red          = calendarState{name: "Red", ledPattern: ledPattern{blinkState: blink1.State{Red: 255}}}
+	redFlash     = calendarState{name: "Red Flash", ledPattern: ledPattern{blinkState: blink1.State{Red: 255}, flashState: blink1.OffState, flashDuration: time.Duration(500) * time.Millisecond}}
+	fastRedFlash = calendarState{name: "Fast Red Flash", ledPattern: ledPattern{blinkState: blink1.State{Red: 255}, flashState: blink1.OffState, flashDuration: time.Duration(125) * time.Millisecond}}
+	blueFlash    = calendarState{name: "Red/Blue Flash", ledPattern: ledPattern{blinkState: blink1.State{Blue: 255}, flashState: blink1.State{Red: 255}, flashDuration: time.Duration(500) * time.Millisecond}}
+	blue         = calendarState{name: "Blue", ledPattern: ledPattern{blinkState: blink1.State{Blue: 255}}}
+	magentaFlash = calendarState{name: "MagentaFlash", ledPattern: ledPattern{blinkState: blink1.State{Red: 255, Blue: 255}, flashState: blink1.OffState, flashDuration: time.Duration(125) * time.Millisecond}}
+	magenta      = calendarState{name: "Magenta", ledPattern: ledPattern{blinkState: blink1.State{Red: 255, Blue: 255}}}
+	redPulse     = calendarState{name: "Red Pulse", ledPattern: ledPattern{blinkState: blink1.State{Red: 255}, flashState: blink1.OffState, flashDuration: time.Duration(1000) * time.Millisecond, pulse: true}}
+)
+
+// namedStates is every state that can be referred to by name in the config file.
+var namedStates = []calendarState{black, green, yellow, red, redFlash, fastRedFlash, blueFlash, blue, magentaFlash, magenta, redPulse}
+
+// stateByName looks up a state by name, ignoring case.  The user's custom colors are checked as well as namedStates.
+func (userPrefs *UserPrefs) stateByName(name string) (calendarState, bool) {
+	for _, state := range userPrefs.customStates {
+		if strings.EqualFold(state.name, name) {
+			return state, true
+		}
+	}
+	return builtinStateByName(name)
+}
+
+// builtinStateByName looks up one of namedStates by name, ignoring case.
+func builtinStateByName(name string) (calendarState, bool) {
+	for _, state := range namedStates {
+		if strings.EqualFold(state.name, name) {
+			return state, true
+		}
+	}
+	return calendarState{}, false
+}
+
+// customPatterns are the patterns a custom color can have, and how long each half of a flash or pulse lasts.  Solid
+// colors don't flash.
+var customPatterns = map[string]time.Duration{
+	"solid": 0,
+	"flash": time.Duration(500) * time.Millisecond,
+	"pulse": time.Duration(1500) * time.Millisecond,
+}
+
+// customState makes a state from an entry in CustomColors.
+func customState(name string, layout customColorLayout) (calendarState, error) {
+	if _, ok := builtinStateByName(name); ok {
+		return calendarState{}, fmt.Errorf("Invalid custom color %v: there is already a color with that name", name)
+	}
+	if len(layout.RGB) != 3 {
+		return calendarState{}, fmt.Errorf("Invalid custom color %v: rgb needs three numbers", name)
+	}
+	for _, value := range layout.RGB {
+		if value < 0 || value > 255 {
+			return calendarState{}, fmt.Errorf("Invalid custom color %v: %v is not from 0 to 255", name, value)
+		}
+	}
+	pattern := strings.ToLower(layout.Pattern)
+	if pattern == "" {
+		pattern = "solid"
+	}
+	flashDuration, ok := customPatterns[pattern]
+	if !ok {
+		return calendarState{}, fmt.Errorf("Invalid pattern for custom color %v: %v", name, layout.Pattern)
+	}
+	state := calendarState{name: name, ledPattern: ledPattern{
+		blinkState:    blink1.State{Red: uint8(layout.RGB[0]), Green: uint8(layout.RGB[1]), Blue: uint8(layout.RGB[2])},
+		flashDuration: flashDuration,
+		pulse:         pattern == "pulse",
+	}}
+	if flashDuration > 0 {
+		state.flashState = blink1.OffState
+	}
+	return state, nil
+}
+
+// Version is the version of calblink, which the MQTT discovery messages include.  The calblink command sets it from
+// its build information.
+var Version = "dev"
+
+// outputs is where calblink's messages go, other than the logs from the log package.
+type outputs struct {
+	// status takes informational messages: stdout, or the log file if there is one.
+	status io.Writer
+	// debug takes debug messages, which are discarded unless debugging is on.
+	debug io.Writer
+	// dot takes the progress marks, which are discarded unless ShowDots is on and the log is in text.
+	dot io.Writer
+}
+
+// output is where this run of calblink sends its messages.  The Runner sets it up from its fields and the config.
+var output = outputs{status: os.Stdout, debug: ioutil.Discard, dot: ioutil.Discard}
+
+// dotKind is what a progress mark written to output.dot means.
+type dotKind string
+
+const (
+	dotNormal        = dotKind("normal")
+	dotError         = dotKind("error")
+	dotSkipDay       = dotKind("skipDay")
+	dotBeforeStart   = dotKind("beforeStart")
+	dotAfterEnd      = dotKind("afterEnd")
+	dotSnoozed       = dotKind("snoozed")
+	dotLocked        = dotKind("locked")
+	dotDND           = dotKind("dnd")
+	dotAway          = dotKind("away")
+	dotDeviceFailure = dotKind("deviceFailure")
+	dotOverride      = dotKind("override")
+)
+
+// defaultDots are the marks shown unless DotChars says otherwise.
+var defaultDots = map[dotKind]string{
+	dotNormal:        ".",
+	dotError:         ",",
+	dotSkipDay:       "~",
+	dotBeforeStart:   ">",
+	dotAfterEnd:      "<",
+	dotSnoozed:       "z",
+	dotLocked:        "l",
+	dotDND:           "d",
+	dotAway:          "a",
+	dotDeviceFailure: "X",
+	dotOverride:      "o",
+}
+
+// dots are the marks in use, set from the user's prefs.
+var dots = defaultDots
+
+// printDot writes the progress mark for kind to output.dot.
+func printDot(kind dotKind) {
+	fmt.Fprint(output.dot, dots[kind])
+}
+
+// blinkerState encapsulates the current device state of the light.
+type blinkerState struct {
+	device      Device
+	open        func(serial string) (Device, error)
+	newState    chan calendarState
+	failures    int
+	maxFailures int
+	lastAttempt time.Time
+	// retryWait is the shortest time from the last attempt to open the device to the next one.  It only grows if
+	// maxFailures is -1, up to maxBackoff.
+	retryWait  time.Duration
+	maxBackoff time.Duration
+	// releases takes requests to close the device for a while; see release.
+	releases chan time.Duration
+
+	// brightness, fadeTime and the flash times are set by the main loop and read by patternRunner, so they are guarded
+	// by mu.  So is releaseEnd, which patternRunner sets while the device is released, so that others know not to use it,
+	// and serial, the serial number of the device, once one has been opened, which is the one reopened from then on.
+	mu            sync.Mutex
+	brightness    int
+	fadeTime      time.Duration
+	flashInterval time.Duration
+	flashOn       time.Duration
+	flashOff      time.Duration
+	releaseEnd    time.Time
+	serial        string
+}
+
+// newBlinkerState opens the next device using open, which is retried whenever the device fails.  Once a device with a
+// serial number has been opened, only that device is reopened.  After maxFailures failed attempts in a row the program
+// quits; if maxFailures is -1 it never does, and instead the wait between attempts doubles each time, up to maxBackoff.
+func newBlinkerState(maxFailures int, maxBackoff time.Duration, open func(serial string) (Device, error)) *blinkerState {
+	blinker := &blinkerState{
+		open:        open,
+		newState:    make(chan calendarState, 1),
+		releases:    make(chan time.Duration, 1),
+		maxFailures: maxFailures,
+		retryWait:   deviceRetryInterval,
+		maxBackoff:  maxBackoff,
+		brightness:  100,
+	}
+	blinker.reinitialize()
+	return blinker
+}
+
+// deviceRetryInterval is the shortest time between attempts to reopen a device that has failed, such as one that has
+// been unplugged.  Each attempt counts towards maxFailures.
+const deviceRetryInterval = 5 * time.Second
+
+// retryForever is the value of maxFailures that keeps retrying the device instead of quitting.
+const retryForever = -1
+
+func (blinker *blinkerState) reinitialize() error {
+	if blinker.device != nil {
+		blinker.device.Close()
+		blinker.device = nil
+	}
+	if blinker.maxFailures == retryForever {
+		fmt.Fprintf(output.debug, "Opening device, attempt %v\n", blinker.failures+1)
+	} else {
+		fmt.Fprintf(output.debug, "Opening device, attempt %v of %v\n", blinker.failures+1, blinker.maxFailures+1)
+	}
+	blinker.lastAttempt = time.Now()
+	device, err := blinker.open(blinker.deviceSerial())
+	if err != nil {
+		blinker.failures++
+		if blinker.maxFailures == retryForever {
+			blinker.retryWait = nextBackoff(blinker.retryWait, deviceRetryInterval, blinker.maxBackoff)
+			log.Printf("Unable to initialize device, attempt %v; trying again in %v: %v", blinker.failures,
+				blinker.retryWait, err)
+		} else if blinker.failures > blinker.maxFailures {
+			log.Fatalf("Unable to initialize device: %v", err)
+		}
+		logEvent(levelWarn, "Unable to open device", "error", err, "failures", blinker.failures)
+		printDot(dotDeviceFailure)
+		blinker.device = nil
+		return err
+	}
+	blinker.failures = 0
+	blinker.retryWait = deviceRetryInterval
+	blinker.device = device
+	blinker.mu.Lock()
+	defer blinker.mu.Unlock()
+	if blinker.serial == "" {
+		blinker.serial = device.Serial()
+	}
+	return nil
+}
+
+// deviceSerial returns the serial number of the device, or "" if it has no serial number or none has been opened yet.
+func (blinker *blinkerState) deviceSerial() string {
+	blinker.mu.Lock()
+	defer blinker.mu.Unlock()
+	return blinker.serial
+}
+
+// setBrightness sets the percentage that colors are scaled by.  It takes effect the next time a state is executed.
+func (blinker *blinkerState) setBrightness(percent int) {
+	blinker.mu.Lock()
+	defer blinker.mu.Unlock()
+	blinker.brightness = percent
+}
+
+func (blinker *blinkerState) currentBrightness() int {
+	blinker.mu.Lock()
+	defer blinker.mu.Unlock()
+	return blinker.brightness
+}
+
+// setFadeTime sets how long changes to a steady color take to fade in.  It takes effect the next time a state is
+// executed.
+func (blinker *blinkerState) setFadeTime(fadeTime time.Duration) {
+	blinker.mu.Lock()
+	defer blinker.mu.Unlock()
+	blinker.fadeTime = fadeTime
+}
+
+func (blinker *blinkerState) currentFadeTime() time.Duration {
+	blinker.mu.Lock()
+	defer blinker.mu.Unlock()
+	return blinker.fadeTime
+}
+
+// setFlashTiming sets how long flashing states show their colors for: interval for each of them, and on and off for just
+// the first and the second.  Any of them may be 0 to leave it to the state's own duration.  It takes effect on the next
+// flash.
+func (blinker *blinkerState) setFlashTiming(interval, on, off time.Duration) {
+	blinker.mu.Lock()
+	defer blinker.mu.Unlock()
+	blinker.flashInterval = interval
+	blinker.flashOn = on
+	blinker.flashOff = off
+}
+
+// flashTimes returns how long the pattern shows its first and second colors for.  For a pattern that flashes rather
+// than pulses, the flash times that are set replace the pattern's own duration.
+func (blinker *blinkerState) flashTimes(pattern ledPattern) (on, off time.Duration) {
+	blinker.mu.Lock()
+	defer blinker.mu.Unlock()
+	if pattern.flashDuration == 0 || pattern.pulse {
+		return pattern.flashDuration, pattern.flashDuration
+	}
+	on, off = pattern.flashDuration, pattern.flashDuration
+	if blinker.flashInterval > 0 {
+		on, off = blinker.flashInterval, blinker.flashInterval
+	}
+	if blinker.flashOn > 0 {
+		on = blinker.flashOn
+	}
+	if blinker.flashOff > 0 {
+		off = blinker.flashOff
+	}
+	return on, off
+}
+
+// flashFade returns how long each change of color in a flash fades over: the shorter of the two times, so that a short
+// flash with a long gap is a blink rather than a slow fade.
+func flashFade(on, off time.Duration) time.Duration {
+	if off < on {
+		return off
+	}
+	return on
+}
+
+// release closes the device for d, so that another program can use it, and then reopens it as though it had failed.
+// The states sent meanwhile are remembered, and the latest is shown once the device is back.  A d of 0 ends a release
+// early.  It needs patternRunner to be running.
+func (blinker *blinkerState) release(d time.Duration) {
+	blinker.releases <- d
+}
+
+// releasedUntil returns when the device is due to be reopened, or zero if it isn't released.
+func (blinker *blinkerState) releasedUntil() time.Time {
+	blinker.mu.Lock()
+	defer blinker.mu.Unlock()
+	return blinker.releaseEnd
+}
+
+func (blinker *blinkerState) setReleasedUntil(until time.Time) {
+	blinker.mu.Lock()
+	defer blinker.mu.Unlock()
+	blinker.releaseEnd = until
+}
+
+// scaleState scales the color of the state to the given brightness percentage.  Off stays off.
+func scaleState(state blink1.State, percent int) blink1.State {
+	state.Red = uint8(int(state.Red) * percent / 100)
+	state.Green = uint8(int(state.Green) * percent / 100)
+	state.Blue = uint8(int(state.Blue) * percent / 100)
+	return state
+}
+
+// pulseStep is how often a pulsing state's color is updated.  Each step fades into the next, so the device's own fading
+// smooths out the steps.
+const pulseStep = time.Duration(100) * time.Millisecond
+
+// pulseLevel is how far a pulse has gone from its first color towards its second, from 0 to 1, elapsed into a pulse
+// whose halves take halfPeriod each.  It follows a cosine, so it slows down at either end, like breathing.
+func pulseLevel(elapsed, halfPeriod time.Duration) float64 {
+	phase := float64(elapsed%(2*halfPeriod)) / float64(2*halfPeriod)
+	return (1 - math.Cos(2*math.Pi*phase)) / 2
+}
+
+// blendState returns the color level of the way from state1 to state2.
+func blendState(state1, state2 blink1.State, level float64) blink1.State {
+	blend := func(from, to uint8) uint8 {
+		return uint8(math.Round(float64(from) + (float64(to)-float64(from))*level))
+	}
+	return blink1.State{Red: blend(state1.Red, state2.Red), Green: blend(state1.Green, state2.Green), Blue: blend(state1.Blue, state2.Blue)}
+}
+
+func (blinker *blinkerState) setState(state blink1.State) error {
+	state = scaleState(state, blinker.currentBrightness())
+	if blinker.failures > 0 {
+		// A flashing color sets the device several times a second, which mustn't use up all the retries at once.
+		if wait := blinker.retryWait - time.Since(blinker.lastAttempt); wait > 0 {
+			return fmt.Errorf("device unavailable, next attempt to reopen it in %v", wait)
+		}
+		err := blinker.reinitialize()
+		if err != nil {
+			fmt.Fprintf(output.debug, "Reinitialize failed, error %v\n", err)
+			return err
+		}
+	}
+	err := blinker.device.SetColor(state)
+	if err != nil {
+		fmt.Fprintf(output.debug, "Re-initializing because of error %v\n", err)
+		err = blinker.reinitialize()
+		if err != nil {
+			fmt.Fprintf(output.debug, "Reinitialize failed, error %v\n", err)
+			return err
+		}
+		// Try one more time before giving up for this pass.
+		err = blinker.device.SetColor(state)
+		if err != nil {
+			fmt.Fprintf(output.debug, "Setting blinker state failed, error %v\n", err)
+		}
+	} else if blinker.failures != 0 {
+		// Only written when it changes, since shutDown reads it from whichever goroutine is stopping the Runner.
+		blinker.failures = 0
+	}
+	return err
+}
+
+// canPlayPatterns reports whether the device can store and play patterns by itself.
+func (blinker *blinkerState) canPlayPatterns() bool {
+	_, ok := blinker.device.(patternDevice)
+	return ok
+}
+
+// writePatternLine stores the state, scaled to the current brightness, at position pos of the device's pattern.
+func (blinker *blinkerState) writePatternLine(pos int, state blink1.State) error {
+	device, ok := blinker.device.(patternDevice)
+	if !ok {
+		return fmt.Errorf("device can't play patterns")
+	}
+	return device.WritePatternLine(pos, scaleState(state, blinker.currentBrightness()))
+}
+
+// playPattern starts the device playing the lines of its pattern from start to end, over and over, until it is next
+// given a color.
+func (blinker *blinkerState) playPattern(start, end int) error {
+	device, ok := blinker.device.(patternDevice)
+	if !ok {
+		return fmt.Errorf("device can't play patterns")
+	}
+	return device.PlayPattern(start, end)
+}
+
+// ledRunner shows a pattern on one LED, or on both.
+type ledRunner struct {
+	ledPattern
+	led blink1.LED
+	// ticker fires when a flashing or pulsing pattern is due its next step.
+	ticker  <-chan time.Time
+	flip    bool
+	start   time.Time
+	failing bool
+	// fromHere is set once the device has failed to take a flash as a pattern, so that it is flashed from here instead.
+	fromHere bool
+}
+
+// playOnDevice stores the runner's flash on the device as a pattern and starts it playing.
+func (runner *ledRunner) playOnDevice(blinker *blinkerState) error {
+	on, off := blinker.flashTimes(runner.ledPattern)
+	fade := flashFade(on, off)
+	// Each line fades to its color and then goes on to the next, so a color that shows for longer than the fade is held
+	// by a second line that fades to it again.
+	var lines []blink1.State
+	for _, step := range []struct {
+		state blink1.State
+		time  time.Duration
+	}{{runner.blinkState, on}, {runner.flashState, off}} {
+		line := step.state
+		line.FadeTime = fade
+		lines = append(lines, line)
+		if step.time > fade {
+			line.FadeTime = step.time - fade
+			lines = append(lines, line)
+		}
+	}
+	for pos, line := range lines {
+		if err := blinker.writePatternLine(pos, line); err != nil {
+			return err
+		}
+	}
+	return blinker.playPattern(0, len(lines)-1)
+}
+
+// newLEDRunners returns the runners that show a state: one for both LEDs, or one for each LED of a split state.
+func newLEDRunners(state calendarState) []*ledRunner {
+	runners := []*ledRunner{{ledPattern: state.ledPattern, led: blink1.LEDAll}}
+	if state.split {
+		runners[0].led = blink1.LED1
+		runners = append(runners, &ledRunner{ledPattern: state.led2, led: blink1.LED2})
+	}
+	for _, runner := range runners {
+		if runner.flashDuration > 0 {
+			runner.start = time.Now()
+			runner.ticker = time.After(time.Millisecond)
+		}
+	}
+	return runners
+}
+
+// show sets the runner's LED to its steady color, or to the next step of its flash or pulse.
+func (runner *ledRunner) show(blinker *blinkerState) {
+	switch {
+	case runner.flashDuration == 0:
+		// The blink(1) fades from whatever color it is showing, so a new state that arrives mid-fade simply starts a
+		// new fade from there.
+		state := runner.blinkState
+		state.LED = runner.led
+		state.FadeTime = blinker.currentFadeTime()
+		runner.failing = (blinker.setState(state) != nil)
+	case runner.pulse:
+		// Each step fades into the next.
+		state := blendState(runner.blinkState, runner.flashState, pulseLevel(time.Since(runner.start), runner.flashDuration))
+		state.LED = runner.led
+		state.FadeTime = pulseStep
+		runner.failing = (blinker.setState(state) != nil)
+		runner.ticker = time.After(pulseStep)
+	case runner.led == blink1.LEDAll && !runner.fromHere && blinker.canPlayPatterns():
+		// Once the device is playing the flash there is nothing more to do until the state changes.
+		if err := runner.playOnDevice(blinker); err != nil {
+			fmt.Fprintf(output.debug, "Unable to play flash on the device, flashing it from here instead: %v\n", err)
+			runner.fromHere = true
+			runner.ticker = time.After(time.Millisecond)
+			return
+		}
+		fmt.Fprintf(output.debug, "Playing %v and %v on the device\n", runner.blinkState, runner.flashState)
+		runner.failing = false
+		runner.ticker = nil
+	default:
+		fmt.Fprintf(output.debug, "Timer fired\n")
+		state1 := runner.blinkState
+		state2 := runner.flashState
+		if runner.flip {
+			state1, state2 = state2, state1
+		}
+		on, off := blinker.flashTimes(runner.ledPattern)
+		state1.Duration = on
+		if runner.flip {
+			state1.Duration = off
+		}
+		state1.FadeTime = flashFade(on, off)
+		state2.Duration, state2.FadeTime = state1.Duration, state1.FadeTime
+		if on != off {
+			// An uneven flash would light one LED for far longer than the other, so they flash together.
+			state2.Red, state2.Green, state2.Blue = state1.Red, state1.Green, state1.Blue
+		}
+		var err1, err2 error
+		if runner.led == blink1.LEDAll {
+			// We set state1 on LED 1 and state2 on LED 2.  On an original (mk1) blink(1) state2 will be ignored.
+			state1.LED = blink1.LED1
+			state2.LED = blink1.LED2
+			fmt.Fprintf(output.debug, "Setting state (%v and %v)\n", state1, state2)
+			err1 = blinker.setState(state1)
+			err2 = blinker.setState(state2)
+		} else {
+			state1.LED = runner.led
+			fmt.Fprintf(output.debug, "Setting state %v\n", state1)
+			err1 = blinker.setState(state1)
+		}
+		runner.failing = (err1 != nil) || (err2 != nil)
+		runner.flip = !runner.flip
+		runner.ticker = time.After(state1.Duration)
+	}
+}
+
+// patternRunner shows the states sent on newState, flashing them if need be.  If the device fails, the state it should be
+// showing is kept, and it is shown again once the device can be reopened.
+func (blinker *blinkerState) patternRunner() {
+	currentState := black
+	runners := newLEDRunners(currentState)
+	failing := false
+	updateFailing := func() {
+		failing = false
+		for _, runner := range runners {
+			failing = failing || runner.failing
+		}
+	}
+	// retry fires while a steady color couldn't be set, to try again.  Flashing colors try again on every flash.
+	var retry <-chan time.Time
+	setSteady := func() {
+		wasFailing := failing
+		retry = nil
+		for _, runner := range runners {
+			if runner.flashDuration == 0 {
+				runner.show(blinker)
+				if runner.failing {
+					retry = time.After(blinker.retryWait)
+				}
+			}
+		}
+		updateFailing()
+		if wasFailing && !failing {
+			fmt.Fprintf(output.debug, "Device is back, restored state %v\n", currentState)
+		}
+	}
+	setSteady()
+	// ticker returns when the i'th runner is due its next step; a runner that doesn't exist never is.
+	ticker := func(i int) <-chan time.Time {
+		if i < len(runners) {
+			return runners[i].ticker
+		}
+		return nil
+	}
+
+	// released fires when a release of the device is over; it is nil when the device isn't released.
+	var released <-chan time.Time
+
+	brightness := blinker.currentBrightness()
+	for {
+		select {
+		case d := <-blinker.releases:
+			if released == nil && d <= 0 {
+				continue
+			}
+			until := time.Now().Add(d)
+			blinker.setReleasedUntil(until)
+			if released == nil {
+				fmt.Fprintf(output.debug, "Releasing device until %v\n", until.Format("15:04:05"))
+				if blinker.device != nil {
+					blinker.device.Off()
+					blinker.device.Close()
+					blinker.device = nil
+				}
+				// Without runners nothing is shown, and there is nothing to retry.
+				runners = nil
+				retry = nil
+			}
+			released = time.After(d)
+
+		case <-released:
+			released = nil
+			fmt.Fprintf(output.debug, "Release over, reopening device for state %v\n", currentState)
+			// A device that can't be reopened yet is retried like one that has failed.
+			blinker.reinitialize()
+			blinker.setReleasedUntil(time.Time{})
+			runners = newLEDRunners(currentState)
+			setSteady()
+
+		case newState := <-blinker.newState:
+			if released != nil {
+				currentState = newState
+				continue
+			}
+			if newState != currentState || failing || brightness != blinker.currentBrightness() {
+				brightness = blinker.currentBrightness()
+				fmt.Fprintf(output.debug, "Changing from state %v to %v\n", currentState, newState)
+				currentState = newState
+				runners = newLEDRunners(newState)
+				setSteady()
+			} else {
+				fmt.Fprintf(output.debug, "Retaining state %v unchanged\n", newState)
+			}
+
+		case <-retry:
+			fmt.Fprintf(output.debug, "Retrying device for state %v\n", currentState)
+			setSteady()
+
+		case <-ticker(0):
+			runners[0].show(blinker)
+			updateFailing()
+
+		case <-ticker(1):
+			runners[1].show(blinker)
+			updateFailing()
+		}
+	}
+}
+
+// deviceDisplay ties a blink(1) device to the calendars that drive it.  Each display tracks its own calendar failures.
+type deviceDisplay struct {
+	calendars []string
+	blinker   *blinkerState
+	// number is the device's position in the list of displays, as shown in messages.
+	number   int
+	failures int
+	state    calendarState
+	next     *upcomingEvent
+	// quiet keeps the device off during QuietHours, whatever state it is given.
+	quiet bool
+	// notified is the eventKey of the last event a notification was shown or a sound played for.
+	notified string
+}
+
+// openDisplays opens the devices needed for the user's device assignments and works out which calendar each one shows.
+// The first device is always opened, using the usual retry logic.  With assignments, up to one more device than there
+// are assignments is opened, so that there is one left over for the unassigned calendars; any that can't be found at
+// startup are dropped.
+func openDisplays(userPrefs *UserPrefs) []*deviceDisplay {
+	numDevices := 1
+	if len(userPrefs.deviceAssignments) > 0 {
+		numDevices = len(userPrefs.deviceAssignments) + 1
+	}
+	displays := []*deviceDisplay{{
+		blinker: newBlinkerState(userPrefs.deviceFailureRetries, time.Duration(userPrefs.deviceMaxBackoff)*time.Second,
+			deviceOpener(userPrefs)),
+	}}
+	for i := 1; i < numDevices; i++ {
+		blinker := newBlinkerState(userPrefs.deviceFailureRetries, time.Duration(userPrefs.deviceMaxBackoff)*time.Second,
+			deviceOpener(userPrefs))
+		if blinker.failures > 0 {
+			fmt.Fprintf(output.debug, "Only found %v devices\n", i)
+			break
+		}
+		displays = append(displays, &deviceDisplay{blinker: blinker, number: i})
+	}
+	for _, display := range displays {
+		if serial := display.blinker.deviceSerial(); serial != "" {
+			fmt.Fprintf(output.status, "Device %v has serial number %v\n", display.number, serial)
+		}
+	}
+	assignCalendars(displays, userPrefs)
+	return displays
+}
+
+// assignCalendars sets the calendars each display shows from the user's device assignments, which go by the devices'
+// serial numbers.  Displays without an assignment show all of the user's calendars.  Calendars assigned to devices that
+// weren't found move to the first device.  It returns true if any display's calendars changed.
+func assignCalendars(displays []*deviceDisplay, userPrefs *UserPrefs) bool {
+	calendars := make([][]string, len(displays))
+	assigned := make([]bool, len(displays))
+	bySerial := make(map[string]int)
+	for i, display := range displays {
+		calendars[i] = userPrefs.calendars
+		if serial := display.blinker.deviceSerial(); serial != "" {
+			bySerial[serial] = i
+		}
+		if calendarID, ok := userPrefs.deviceAssignments[display.blinker.deviceSerial()]; ok {
+			calendars[i] = []string{calendarID}
+			assigned[i] = true
+		}
+	}
+	// Walk the assignments in serial number order so that the fallback to the first device is deterministic.
+	serials := make([]string, 0, len(userPrefs.deviceAssignments))
+	for serial := range userPrefs.deviceAssignments {
+		serials = append(serials, serial)
+	}
+	sort.Strings(serials)
+	for _, serial := range serials {
+		calendarID := userPrefs.deviceAssignments[serial]
+		if _, ok := bySerial[serial]; ok {
+			continue
+		}
+		if assigned[0] {
+			fmt.Fprintf(output.status, "Device %v not found; calendar %v will not be shown\n", serial, calendarID)
+			continue
+		}
+		fmt.Fprintf(output.status, "Device %v not found; showing calendar %v on device 0\n", serial, calendarID)
+		calendars[0] = []string{calendarID}
+		assigned[0] = true
+	}
+	changed := false
+	for i, display := range displays {
+		if !sameCalendars(display.calendars, calendars[i]) {
+			display.calendars = calendars[i]
+			changed = true
+		}
+	}
+	return changed
+}
+
+// sameCalendars returns true if the two lists of calendars are the same, in the same order.
+func sameCalendars(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// exitFuncs are run, in order, when the Runner is stopped, or at the end of a pass in once mode.  Run registers them with
+// atExit as it starts, which may be while another goroutine is stopping it, so they are guarded by exitFuncsMu.
+var (
+	exitFuncsMu sync.Mutex
+	exitFuncs   []func()
+)
+
+func atExit(f func()) {
+	exitFuncsMu.Lock()
+	defer exitFuncsMu.Unlock()
+	exitFuncs = append(exitFuncs, f)
+}
+
+func runExitFuncs() {
+	exitFuncsMu.Lock()
+	defer exitFuncsMu.Unlock()
+	for _, f := range exitFuncs {
+		f()
+	}
+}
+
+// exitState is the color to leave the devices showing when calblink is stopped, from ExitColor, or nil to turn them off.
+// Stop reads it from another goroutine, so it is set through setExitState whenever a config takes effect.
+var (
+	exitStateMu sync.Mutex
+	exitState   *calendarState
+)
+
+func setExitState(state *calendarState) {
+	exitStateMu.Lock()
+	defer exitStateMu.Unlock()
+	exitState = state
+}
+
+// shutDown leaves every device that is currently working showing ExitColor, or turns it off if there is none.
+func shutDown(displays []*deviceDisplay) {
+	exitStateMu.Lock()
+	state := exitState
+	exitStateMu.Unlock()
+	if state == nil {
+		turnOff(displays)
+		return
+	}
+	for _, display := range displays {
+		blinker := display.blinker
+		if blinker.failures != 0 || !blinker.releasedUntil().IsZero() {
+			continue
+		}
+		// Hand the pattern runner the same color, so that it can't replace it with what it was showing.
+		select {
+		case blinker.newState <- *state:
+		default:
+		}
+		for _, runner := range newLEDRunners(*state) {
+			color := runner.blinkState
+			color.LED = runner.led
+			color.FadeTime = blinker.currentFadeTime()
+			blinker.setState(color)
+		}
+	}
+}
+
+// turnOff turns off every device that is currently working.
+func turnOff(displays []*deviceDisplay) {
+	for _, display := range displays {
+		blinker := display.blinker
+		// A released device has been closed, and may be in use by another program.
+		if blinker.failures == 0 && blinker.releasedUntil().IsZero() {
+			// There is no pattern runner to take the state in once mode, so don't wait for one.
+			select {
+			case blinker.newState <- black:
+			default:
+			}
+			if fadeTime := blinker.currentFadeTime(); fadeTime > 0 {
+				off := blink1.OffState
+				off.FadeTime = fadeTime
+				blinker.device.SetColor(off)
+			} else {
+				blinker.device.Off()
+			}
+		}
+	}
+}
+
+// BEGIN GOOGLE CALENDAR API SAMPLE CODE
+
+// getClient uses a Context and Config to retrieve a Token
+// then generate a Client. It returns the generated Client.
+// The token is cached in cacheFile.
+func getClient(ctx context.Context, config *oauth2.Config, cacheFile string) *http.Client {
+	tok, err := tokenFromFile(cacheFile)
+	if err != nil {
+		tok = getTokenFromWeb(config)
+		saveToken(cacheFile, tok)
+	}
+	return config.Client(ctx, tok)
+}
+
+// getTokenFromWeb uses Config to request a Token.
+// It returns the retrieved Token.
+func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
+	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+	fmt.Printf("Go to the following link in your browser then type the "+
+		"authorization code: \n%v\n", authURL)
+
+	var code string
+	if _, err := fmt.Scan(&code); err != nil {
+		log.Fatalf("Unable to read authorization code %v", err)
+	}
+
+	tok, err := config.Exchange(oauth2.NoContext, code)
+	if err != nil {
+		log.Fatalf("Unable to retrieve token from web %v", err)
+	}
+	return tok
+}
+
+// tokenCacheFile generates credential file path/filename.
+// It returns the generated credential path/filename.
+func tokenCacheFile(cacheName string) (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	tokenCacheDir := filepath.Join(usr.HomeDir, ".credentials")
+	os.MkdirAll(tokenCacheDir, 0700)
+	return filepath.Join(tokenCacheDir,
+		url.QueryEscape(cacheName)), err
+}
+
+// googleTokenName is the file in the credentials directory that the OAuth token is cached in, unless TokenFile is set.
+const googleTokenName = "calendar-blink1.json"
+
+// tokenPath returns the file to cache the OAuth token in: the user's TokenFile if set, or defaultName in the
+// credentials directory.
+func tokenPath(userPrefs *UserPrefs, defaultName string) string {
+	if userPrefs.tokenFile != "" {
+		return userPrefs.tokenFile
+	}
+	cacheFile, err := tokenCacheFile(defaultName)
+	if err != nil {
+		log.Fatalf("Unable to get path to cached credential file. %v", err)
+	}
+	return cacheFile
+}
+
+// tokenFromFile retrieves a Token from a given file path.
+// It returns the retrieved Token and any read error encountered.
+func tokenFromFile(file string) (*oauth2.Token, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := &oauth2.Token{}
+	err = json.NewDecoder(f).Decode(t)
+	return t, err
+}
+
+// saveToken uses a file path to create a file and store the
+// token in it.
+func saveToken(file string, token *oauth2.Token) {
+	fmt.Fprintf(output.status, "Saving credential file to: %s\n", file)
+	f, err := os.Create(file)
+	if err != nil {
+		log.Fatalf("Unable to cache oauth token: %v", err)
+	}
+	defer f.Close()
+	json.NewEncoder(f).Encode(token)
+}
+
+// END GOOGLE CALENDAR API SAMPLE CODE
+
+// Event viewing methods
+// selfResponseStatus returns your response to the event, such as "accepted" or "tentative", or "" if you aren't one of
+// its attendees.
+func selfResponseStatus(item *calendar.Event) string {
+	for _, attendee := range item.Attendees {
+		if attendee.Self {
+			return attendee.ResponseStatus
+		}
+	}
+	return ""
+}
+
+func eventHasAcceptableResponse(item *calendar.Event, responseState responseState) bool {
+	for _, attendee := range item.Attendees {
+		if attendee.Self {
+			return responseState.checkStatus(attendee.ResponseStatus)
+		}
+	}
+	fmt.Fprintf(output.debug, "No self attendee found for %v\n", item)
+	fmt.Fprintf(output.debug, "Attendees: %v\n", item.Attendees)
+	return true
+}
+
+// isMyEvent reports whether the user organized or created the event.  Google Calendar marks the user's own entries as
+// self; other backends only give the email address, which is compared with the account's.
+func isMyEvent(item *calendar.Event, accountEmail string) bool {
+	isMe := func(self bool, email string) bool {
+		return self || (accountEmail != "" && strings.EqualFold(email, accountEmail))
+	}
+	if item.Organizer != nil && isMe(item.Organizer.Self, item.Organizer.Email) {
+		return true
+	}
+	return item.Creator != nil && isMe(item.Creator.Self, item.Creator.Email)
+}
+
+// eventMatchesRegexps checks the event's title against the user's include and exclude patterns.
+func eventMatchesRegexps(item *calendar.Event, userPrefs *UserPrefs) bool {
+	if userPrefs.excludeRegex != nil && userPrefs.excludeRegex.MatchString(item.Summary) {
+		fmt.Fprintf(output.debug, "Event %v matches excludeRegex\n", item.Summary)
+		return false
+	}
+	if userPrefs.includeRegex != nil && !userPrefs.includeRegex.MatchString(item.Summary) {
+		fmt.Fprintf(output.debug, "Event %v doesn't match includeRegex\n", item.Summary)
+		return false
+	}
+	return true
+}
+
+// isAllDayEvent returns true if the event has a start date rather than a start time.
+func isAllDayEvent(item *calendar.Event) bool {
+	return item.Start.DateTime == ""
+}
+
+// eventLength describes how long an event lasts.
+type eventLength int
+
+const (
+	lengthTimed   = eventLength(iota) // Has a start and end time; see eventDuration.
+	lengthAllDay                      // Has dates instead of times.
+	lengthPoint                       // Ends when it starts, like a reminder.
+	lengthUnknown                     // Its end time is missing or can't be read.
+)
+
+// eventDuration classifies how long the event lasts, and returns the duration of a timed event.
+func eventDuration(item *calendar.Event) (eventLength, time.Duration) {
+	if isAllDayEvent(item) {
+		return lengthAllDay, 0
+	}
+	if item.End == nil {
+		return lengthUnknown, 0
+	}
+	start, err := time.Parse(time.RFC3339, item.Start.DateTime)
+	if err != nil {
+		return lengthUnknown, 0
+	}
+	end, err := time.Parse(time.RFC3339, item.End.DateTime)
+	if err != nil {
+		return lengthUnknown, 0
+	}
+	if !end.After(start) {
+		return lengthPoint, 0
+	}
+	return lengthTimed, end.Sub(start)
+}
+
+// isTooShort reports whether the event is shorter than MinEventMinutes.  Only timed events and ones with no length can
+// be; an event whose length can't be worked out is kept.
+func isTooShort(item *calendar.Event, userPrefs *UserPrefs) bool {
+	if userPrefs.minEventMinutes == 0 {
+		return false
+	}
+	length, duration := eventDuration(item)
+	switch length {
+	case lengthPoint:
+		return true
+	case lengthTimed:
+		return duration < time.Duration(userPrefs.minEventMinutes)*time.Minute
+	}
+	return false
+}
+
+// eventStartTime returns the time the event starts, in the given location.  All-day events start at midnight there.
+func eventStartTime(item *calendar.Event, location *time.Location) (time.Time, error) {
+	if isAllDayEvent(item) {
+		return time.ParseInLocation("2006-01-02", item.Start.Date, location)
+	}
+	t, err := time.Parse(time.RFC3339, item.Start.DateTime)
+	return t.In(location), err
+}
+
+// checkEventTimes makes sure that the event's start and end can be read, so that the rest of calblink can rely on them.
+// An event may have no end, but an end that it has must be of the same kind as its start, and not before it.
+func checkEventTimes(item *calendar.Event, location *time.Location) error {
+	if item.Start == nil || (item.Start.DateTime == "" && item.Start.Date == "") {
+		return fmt.Errorf("no start time")
+	}
+	start, err := eventStartTime(item, location)
+	if err != nil {
+		return fmt.Errorf("invalid start time: %v", err)
+	}
+	if start.IsZero() {
+		return fmt.Errorf("zero start time")
+	}
+	if item.End == nil || (item.End.DateTime == "" && item.End.Date == "") {
+		return nil
+	}
+	var end time.Time
+	if isAllDayEvent(item) {
+		if item.End.Date == "" {
+			return fmt.Errorf("all-day event with an end time instead of a date")
+		}
+		end, err = time.ParseInLocation("2006-01-02", item.End.Date, location)
+	} else {
+		if item.End.DateTime == "" {
+			return fmt.Errorf("timed event with an end date instead of a time")
+		}
+		end, err = time.Parse(time.RFC3339, item.End.DateTime)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid end time: %v", err)
+	}
+	if end.Before(start) {
+		return fmt.Errorf("ends at %v, before it starts at %v", end, start)
+	}
+	return nil
+}
+
+// usableEvents returns the events whose times checkEventTimes can make sense of.  The others are skipped, with a debug
+// message, rather than failing the whole calendar.
+func usableEvents(items []*calendar.Event, calendarID string, location *time.Location) []*calendar.Event {
+	usable := make([]*calendar.Event, 0, len(items))
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		if err := checkEventTimes(item, location); err != nil {
+			fmt.Fprintf(output.debug, "Skipping event %q from %v: %v\n", item.Summary, calendarID, err)
+			continue
+		}
+		usable = append(usable, item)
+	}
+	return usable
+}
+
+// nextEvents returns the first of the events from the calendar that is shown, along with any others that are shown and
+// start at the same time, in the order they were given.  The events must be in order of start time.  Declined events
+// shown by DeclinedColor count until they start, unless an event you haven't declined starts at the same time.  Events
+// whose eventKey is in dismissed are skipped.
+func nextEvents(now time.Time, items []*calendar.Event, calendarID string, userPrefs *UserPrefs,
+	dismissed map[string]time.Time) []*calendar.Event {
+	var next, declined []*calendar.Event
+	var start time.Time
+	for _, i := range items {
+		shown := isShownEvent(i, calendarID, userPrefs)
+		if !shown && !isDeclinedReminder(now, i, calendarID, userPrefs) {
+			continue
+		}
+		startTime, _ := eventStartTime(i, userPrefs.timezone)
+		if _, ok := dismissed[occurrenceKey(calendarID, i.Id, startTime)]; ok {
+			fmt.Fprintf(output.debug, "Skipping dismissed event %v\n", i.Summary)
+			continue
+		}
+		if len(next)+len(declined) > 0 && !startTime.Equal(start) {
+			break
+		}
+		if shown {
+			next = append(next, i)
+		} else {
+			declined = append(declined, i)
+		}
+		start = startTime
+	}
+	if len(next) == 0 {
+		return declined
+	}
+	return next
+}
+
+// isShownEvent reports whether the event, from the given calendar, can light the blink(1), rather than being skipped
+// because of the user's prefs.
+func isShownEvent(i *calendar.Event, calendarID string, userPrefs *UserPrefs) bool {
+	return eventHasAcceptableResponse(i, userPrefs.responseStateFor(calendarID)) && passesFilters(i, userPrefs)
+}
+
+// isDeclinedReminder reports whether the event is one that DeclinedColor shows: you have declined it, ResponseState
+// leaves it out, it hasn't started yet, and none of the other filters skips it.
+func isDeclinedReminder(now time.Time, i *calendar.Event, calendarID string, userPrefs *UserPrefs) bool {
+	if userPrefs.declinedState == nil || selfResponseStatus(i) != "declined" ||
+		eventHasAcceptableResponse(i, userPrefs.responseStateFor(calendarID)) {
+		return false
+	}
+	startTime, err := eventStartTime(i, userPrefs.timezone)
+	return err == nil && startTime.After(now) && passesFilters(i, userPrefs)
+}
+
+// passesFilters reports whether the event gets past all of the user's filters other than ResponseState.
+func passesFilters(i *calendar.Event, userPrefs *UserPrefs) bool {
+	return !(userPrefs.skipAllDayEvents && isAllDayEvent(i)) &&
+		!userPrefs.excludes[i.Summary] &&
+		!(userPrefs.skipFreeEvents && i.Transparency == "transparent") &&
+		!(userPrefs.onlyMyEvents && !isMyEvent(i, userPrefs.accountEmail)) &&
+		!userPrefs.eventTypes[strings.ToLower(i.EventType)].ignore &&
+		!isTooShort(i, userPrefs) &&
+		eventMatchesRegexps(i, userPrefs)
+}
+
+// responseStateFor returns the response state that decides which events on the calendar are shown.
+func (userPrefs *UserPrefs) responseStateFor(calendarID string) responseState {
+	if state, ok := userPrefs.calendarResponseStates[calendarID]; ok {
+		return state
+	}
+	return userPrefs.responseState
+}
+
+// busyCount counts the events on the calendar that would be shown and start in the next BusyWindow minutes.
+func busyCount(now time.Time, items []*calendar.Event, calendarID string, userPrefs *UserPrefs) int {
+	end := now.Add(time.Duration(userPrefs.busyWindow) * time.Minute)
+	count := 0
+	for _, item := range items {
+		if !isShownEvent(item, calendarID, userPrefs) {
+			continue
+		}
+		startTime, err := eventStartTime(item, userPrefs.timezone)
+		if err == nil && !startTime.Before(now) && startTime.Before(end) {
+			count++
+		}
+	}
+	return count
+}
+
+// meetingEnd returns when the first of the calendar's shown timed events that are going on now ends, or zero if there
+// are none.
+func meetingEnd(now time.Time, items []*calendar.Event, calendarID string, userPrefs *UserPrefs) time.Time {
+	var end time.Time
+	for _, item := range items {
+		if !isShownEvent(item, calendarID, userPrefs) {
+			continue
+		}
+		if length, _ := eventDuration(item); length != lengthTimed {
+			continue
+		}
+		startTime, err := time.Parse(time.RFC3339, item.Start.DateTime)
+		if err != nil || startTime.After(now) {
+			continue
+		}
+		endTime, err := time.Parse(time.RFC3339, item.End.DateTime)
+		if err == nil && endTime.After(now) && (end.IsZero() || endTime.Before(end)) {
+			end = endTime
+		}
+	}
+	return end
+}
+
+// currentEvent returns an event on the given calendar that is going on now, or nil if there isn't one.  Declined
+// events don't count.
+func currentEvent(now time.Time, backend calendarBackend, calendarID string, userPrefs *UserPrefs) (*calendar.Event, error) {
+	events, err := backend.fetchEvents(now, calendarID, userPrefs)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range usableEvents(events, calendarID, userPrefs.timezone) {
+		startTime, err := eventStartTime(item, userPrefs.timezone)
+		if err != nil {
+			fmt.Fprintf(output.debug, "Invalid start time for event %v: %v\n", item.Summary, err)
+			continue
+		}
+		// The backend only returns events that haven't ended yet, so one that has started is going on now.
+		if !startTime.After(now) && eventHasAcceptableResponse(item, responseStateNotRejected) {
+			return item, nil
+		}
+	}
+	return nil, nil
+}
+
+// outOfOfficeEvent returns an out of office event on the given calendar that is going on now, or nil if there isn't
+// one.  Declined events don't count.
+func outOfOfficeEvent(now time.Time, backend calendarBackend, calendarID string, userPrefs *UserPrefs) (*calendar.Event, error) {
+	events, err := backend.fetchEvents(now, calendarID, userPrefs)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range usableEvents(events, calendarID, userPrefs.timezone) {
+		if item.EventType != "outOfOffice" && (userPrefs.outOfOfficeRegex == nil || !userPrefs.outOfOfficeRegex.MatchString(item.Summary)) {
+			continue
+		}
+		startTime, err := eventStartTime(item, userPrefs.timezone)
+		if err != nil || startTime.After(now) || hasEnded(now, item, userPrefs.timezone) {
+			continue
+		}
+		if eventHasAcceptableResponse(item, responseStateNotRejected) {
+			return item, nil
+		}
+	}
+	return nil, nil
+}
+
+// upcomingEvent is the next event on a calendar, along with which calendar it is from.
+type upcomingEvent struct {
+	*calendar.Event
+	calendarID string
+	startTime  time.Time
+	videoCall  bool
+	// busyCount is the number of events that start in the next BusyWindow minutes, including this one.
+	busyCount int
+	// meetingEnd is when the first of the timed events going on now ends, or zero if there are none.
+	meetingEnd time.Time
+	// afterTravel is set if a travel block leads to this event, so that the travel block has already warned about it.
+	afterTravel bool
+	// tentative is set if you have only tentatively accepted the event.
+	tentative bool
+	// declined is set if you have declined the event, and it is only shown because of DeclinedColor.
+	declined bool
+	// reminderMinutes is how long before the event its earliest popup reminder is, with UseEventReminders, or 0 if it
+	// has none of its own.
+	reminderMinutes int64
+}
+
+// defaultVideoCallRegex matches links to the common video call services.
+const defaultVideoCallRegex = `(?i)zoom\.us/|meet\.google\.com/|teams\.microsoft\.com/|webex\.com/`
+
+// isVideoCall reports whether the event is a video call: it has Google Calendar conference data, or a link matching
+// videoCallRegex in its location or description.
+func isVideoCall(item *calendar.Event, videoCallRegex *regexp.Regexp) bool {
+	if item.ConferenceData != nil || item.HangoutLink != "" {
+		return true
+	}
+	return videoCallRegex.MatchString(item.Location) || videoCallRegex.MatchString(item.Description)
+}
+
+// soonestEvent picks the event that starts first.  Events should be in order of calendar priority, since ties are
+// settled by pickOverlapping.  Nil events are skipped.  The busyCount of the result is the total for all the events,
+// and its meetingEnd is the earliest of theirs.
+func soonestEvent(now time.Time, events []*upcomingEvent, userPrefs *UserPrefs) *upcomingEvent {
+	var soonest []*upcomingEvent
+	busy := 0
+	var meetingEnd time.Time
+	for _, event := range events {
+		if event == nil {
+			continue
+		}
+		switch {
+		case len(soonest) == 0 || event.startTime.Before(soonest[0].startTime):
+			soonest = []*upcomingEvent{event}
+		case event.startTime.Equal(soonest[0].startTime):
+			soonest = append(soonest, event)
+		}
+		busy += event.busyCount
+		if !event.meetingEnd.IsZero() && (meetingEnd.IsZero() || event.meetingEnd.Before(meetingEnd)) {
+			meetingEnd = event.meetingEnd
+		}
+	}
+	if len(soonest) == 0 {
+		return nil
+	}
+	// The events may be shared with other devices, so the totals go on copies.
+	tied := make([]*upcomingEvent, len(soonest))
+	for i, event := range soonest {
+		result := *event
+		result.busyCount = busy
+		result.meetingEnd = meetingEnd
+		tied[i] = &result
+	}
+	return pickOverlapping(now, tied, userPrefs)
+}
+
+// pickOverlapping chooses between events that start at the same time, by OverlapStrategy.  The events must be in order
+// of calendar priority, since the earlier of any that are still tied wins.  It returns nil if there are none.
+func pickOverlapping(now time.Time, events []*upcomingEvent, userPrefs *UserPrefs) *upcomingEvent {
+	if len(events) == 0 {
+		return nil
+	}
+	// better reports whether a should be shown rather than b.
+	var better func(a, b *upcomingEvent) bool
+	switch userPrefs.overlapStrategy {
+	case overlapEarliestEnd:
+		better = func(a, b *upcomingEvent) bool {
+			aEnd, aErr := eventEndTime(a.Event, userPrefs.timezone)
+			bEnd, bErr := eventEndTime(b.Event, userPrefs.timezone)
+			// An event with no end lasts longer than any other.
+			return aErr == nil && (bErr != nil || aEnd.Before(bEnd))
+		}
+	case overlapLongest:
+		better = func(a, b *upcomingEvent) bool {
+			_, aLength := eventDuration(a.Event)
+			_, bLength := eventDuration(b.Event)
+			return aLength > bLength
+		}
+	case overlapMostUrgent:
+		better = func(a, b *upcomingEvent) bool {
+			return moreUrgent(blinkStateForEvent(now, a, userPrefs), blinkStateForEvent(now, b, userPrefs))
+		}
+	default:
+		return events[0]
+	}
+	best := events[0]
+	for _, event := range events[1:] {
+		if better(event, best) {
+			best = event
+		}
+	}
+	if len(events) > 1 {
+		fmt.Fprintf(output.debug, "Chose %v from %v events at the same time, by %v\n", best.Summary, len(events),
+			userPrefs.overlapStrategy)
+	}
+	return best
+}
+
+// moreUrgent reports whether state a looks more urgent than state b: anything is more urgent than off, flashing or
+// pulsing more urgent than steady, and faster more urgent than slower.
+func moreUrgent(a, b calendarState) bool {
+	if (a == black) != (b == black) {
+		return b == black
+	}
+	aFlashes, bFlashes := a.flashDuration > 0, b.flashDuration > 0
+	if aFlashes != bFlashes {
+		return aFlashes
+	}
+	return aFlashes && a.flashDuration < b.flashDuration
+}
+
+// calendarBackend is a source of calendar events.
+type calendarBackend interface {
+	// fetchEvents returns the events on the given calendar that haven't ended by now, in order of start time.
+	fetchEvents(now time.Time, calendarID string, userPrefs *UserPrefs) ([]*calendar.Event, error)
+	// accountEmail returns the email address of the account the calendars are read as.
+	accountEmail() (string, error)
+	// listCalendars returns the calendars the account can read, for --list_calendars.
+	listCalendars() ([]calendarInfo, error)
+}
+
+// calendarInfo describes one of the calendars a backend can read.  The ID is what goes in Calendars.
+type calendarInfo struct {
+	id      string
+	name    string
+	primary bool
+}
+
+// calendarNotFoundError is the error a backend returns when the calendar doesn't exist, or the account can't see it.
+// Unlike other fetch failures, it won't go away by itself.
+type calendarNotFoundError struct {
+	calendarID string
+}
+
+func (err calendarNotFoundError) Error() string {
+	return fmt.Sprintf("calendar %v not found", err.calendarID)
+}
+
+// rateLimitError is the error a backend returns when the calendar server says it is getting too many requests, or that
+// a quota has run out.  RetryAfter is how long the server asked us to wait, or 0 if it didn't say.
+type rateLimitError struct {
+	calendarID string
+	retryAfter time.Duration
+}
+
+func (err rateLimitError) Error() string {
+	if err.retryAfter > 0 {
+		return fmt.Sprintf("rate limited reading calendar %v, retry after %v", err.calendarID, err.retryAfter)
+	}
+	return fmt.Sprintf("rate limited reading calendar %v", err.calendarID)
+}
+
+// rateLimitWait is how long to wait after being rate limited, if the server doesn't say.
+const rateLimitWait = time.Minute
+
+// retryAfter reads a Retry-After header, which is a number of seconds or an HTTP date, and returns 0 if there isn't one.
+func retryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil && time.Until(when) > 0 {
+		return time.Until(when)
+	}
+	return 0
+}
+
+// isGoogleRateLimit reports whether a Google API error is for too many requests.  Google Calendar uses 403 as well as
+// 429 for its rate limits and quotas, telling them apart from other 403s by the reason.
+func isGoogleRateLimit(apiErr *googleapi.Error) bool {
+	if apiErr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	if apiErr.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range apiErr.Errors {
+		switch item.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded":
+			return true
+		}
+	}
+	return false
+}
+
+// googleBackend reads events from Google Calendar.
+type googleBackend struct {
+	srv *calendar.Service
+}
+
+func (backend *googleBackend) fetchEvents(now time.Time, calendarID string, userPrefs *UserPrefs) ([]*calendar.Event, error) {
+	t := now.Format(time.RFC3339)
+	events, err := backend.srv.Events.List(calendarID).ShowDeleted(false).
+		SingleEvents(true).TimeMin(t).MaxResults(10).OrderBy("startTime").Do()
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+		return nil, calendarNotFoundError{calendarID}
+	} else if ok && isGoogleRateLimit(apiErr) {
+		return nil, rateLimitError{calendarID, retryAfter(apiErr.Header)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return events.Items, nil
+}
+
+// accountEmail returns the ID of the primary calendar, which is the account's email address.
+func (backend *googleBackend) accountEmail() (string, error) {
+	primary, err := backend.srv.CalendarList.Get("primary").Do()
+	if err != nil {
+		return "", err
+	}
+	return primary.Id, nil
+}
+
+func (backend *googleBackend) listCalendars() ([]calendarInfo, error) {
+	var calendars []calendarInfo
+	pageToken := ""
+	for {
+		list, err := backend.srv.CalendarList.List().PageToken(pageToken).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range list.Items {
+			calendars = append(calendars, calendarInfo{id: entry.Id, name: entry.Summary, primary: entry.Primary})
+		}
+		if list.NextPageToken == "" {
+			return calendars, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+// fetchEvents retrieves the upcoming events on the given calendar and returns the next one that should drive the blink(1),
+// or nil if there isn't one.  Dismissed events are left out of the choice, as in nextEvents.
+func fetchEvents(now time.Time, backend calendarBackend, calendarID string, userPrefs *UserPrefs,
+	dismissed map[string]time.Time) (*upcomingEvent, error) {
+	from := now
+	if userPrefs.travelRegex != nil {
+		// Look back far enough to see a travel block that has just ended.
+		from = now.Add(-travelFollowMinutes * time.Minute)
+	}
+	fetched, err := backend.fetchEvents(from, calendarID, userPrefs)
+	if err != nil {
+		return nil, err
+	}
+	fetched = usableEvents(fetched, calendarID, userPrefs.timezone)
+	var events []*calendar.Event
+	for _, item := range fetched {
+		if !hasEnded(now, item, userPrefs.timezone) {
+			events = append(events, item)
+		}
+	}
+	busy := busyCount(now, events, calendarID, userPrefs)
+	end := meetingEnd(now, events, calendarID, userPrefs)
+	var upcoming []*upcomingEvent
+	for _, next := range nextEvents(now, events, calendarID, userPrefs, dismissed) {
+		startTime, err := eventStartTime(next, userPrefs.timezone)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid start time for event %v: %v", next.Summary, err)
+		}
+		upcoming = append(upcoming, &upcomingEvent{Event: next, calendarID: calendarID, startTime: startTime,
+			videoCall: isVideoCall(next, userPrefs.videoCallRegex), busyCount: busy, meetingEnd: end,
+			afterTravel: followsTravel(next, startTime, fetched, calendarID, userPrefs),
+			tentative:   selfResponseStatus(next) == "tentative",
+			declined:    !isShownEvent(next, calendarID, userPrefs)})
+		if userPrefs.useEventReminders {
+			upcoming[len(upcoming)-1].reminderMinutes = eventReminderMinutes(next)
+		}
+	}
+	return pickOverlapping(now, upcoming, userPrefs), nil
+}
+
+// travelFollowMinutes is how soon after a travel block ends the event it leads to must start.
+const travelFollowMinutes = 10
+
+// hasEnded reports whether the event ended by now.  An event whose end time is missing or can't be read hasn't.
+func hasEnded(now time.Time, item *calendar.Event, location *time.Location) bool {
+	end, err := eventEndTime(item, location)
+	return err == nil && !end.After(now)
+}
+
+// eventEndTime returns the time the event ends, in the given location.  All-day events end at midnight there.
+func eventEndTime(item *calendar.Event, location *time.Location) (time.Time, error) {
+	if item.End == nil {
+		return time.Time{}, fmt.Errorf("no end time")
+	}
+	if isAllDayEvent(item) {
+		return time.ParseInLocation("2006-01-02", item.End.Date, location)
+	}
+	t, err := time.Parse(time.RFC3339, item.End.DateTime)
+	return t.In(location), err
+}
+
+// isTravel reports whether the event is a travel block, by TravelPattern.
+func isTravel(item *calendar.Event, userPrefs *UserPrefs) bool {
+	return userPrefs.travelRegex != nil && userPrefs.travelRegex.MatchString(item.Summary)
+}
+
+// followsTravel reports whether a travel block on the calendar, other than the event itself, leads to the event, which
+// starts at startTime: the travel block starts before it, and ends no more than travelFollowMinutes before it starts.
+func followsTravel(item *calendar.Event, startTime time.Time, items []*calendar.Event, calendarID string, userPrefs *UserPrefs) bool {
+	if isTravel(item, userPrefs) {
+		return false
+	}
+	for _, travel := range items {
+		if travel == item || !isTravel(travel, userPrefs) || !isShownEvent(travel, calendarID, userPrefs) {
+			continue
+		}
+		if length, _ := eventDuration(travel); length != lengthTimed {
+			continue
+		}
+		travelStart, err := time.Parse(time.RFC3339, travel.Start.DateTime)
+		if err != nil || !travelStart.Before(startTime) {
+			continue
+		}
+		travelEnd, err := time.Parse(time.RFC3339, travel.End.DateTime)
+		if err == nil && !travelEnd.Before(startTime.Add(-travelFollowMinutes*time.Minute)) {
+			return true
+		}
+	}
+	return false
+}
+
+// blinkStateForEvent returns the display state at the time now for the given next event, which may be nil.  The user's
+// color rules are used if there are any, and the built-in colors otherwise.  It depends only on its arguments, apart
+// from debug output; fetching the event is left to the caller.
+func blinkStateForEvent(now time.Time, next *upcomingEvent, userPrefs *UserPrefs) calendarState {
+	if next == nil {
+		return userPrefs.idleState
+	}
+	delta := next.startTime.Sub(now).Minutes()
+	// The colors for the time until the event starts come on LeadTimeMinutes early, or with the event's own reminder.
+	leadDelta := delta - float64(userPrefs.leadTimeMinutes)
+	if next.reminderMinutes > 0 && delta >= 0 {
+		leadDelta = delta * warningMinutes(userPrefs) / float64(next.reminderMinutes)
+	}
+	var blinkState calendarState
+	switch {
+	case next.afterTravel && delta > afterTravelDelta:
+		// The travel block has already warned about it.
+		fmt.Fprintf(output.debug, "Showing %v as going on, since travel leads to it\n", next.Summary)
+		blinkState = timeState(afterTravelDelta, userPrefs.colorRules)
+	case isTravel(next.Event, userPrefs):
+		blinkState = travelState(leadDelta, userPrefs.travelRules)
+		fmt.Fprintf(output.debug, "Using %v for travel\n", blinkState.name)
+	case userPrefs.ramp != nil && leadDelta >= 0:
+		blinkState = userPrefs.ramp.state(leadDelta)
+	default:
+		blinkState = timeState(leadDelta, userPrefs.colorRules)
+	}
+	// Only an event too far off to light the blink(1) gets the idle color, not one that another option turns off.
+	idle := blinkState == black
+	if blinkState != black {
+		for _, rule := range userPrefs.busyRules {
+			if next.busyCount >= rule.meetings {
+				fmt.Fprintf(output.debug, "Using %v for %v meetings\n", rule.state.name, next.busyCount)
+				blinkState = rule.state
+				break
+			}
+		}
+	}
+	if blinkState != black {
+		if state, ok := userPrefs.calendarColors[next.calendarID]; ok {
+			if userPrefs.calendarColorMode == calendarColorBlend {
+				state = tintState(blinkState, state)
+			}
+			fmt.Fprintf(output.debug, "Using %v for calendar %v\n", state.name, next.calendarID)
+			blinkState = state
+		}
+	}
+	if userPrefs.useEventColors && blinkState != black {
+		if state, ok := userPrefs.eventColorMap[next.ColorId]; ok {
+			fmt.Fprintf(output.debug, "Using %v for event color %v\n", state.name, next.ColorId)
+			blinkState = state
+		}
+	}
+	if rule, ok := userPrefs.eventTypes[strings.ToLower(next.EventType)]; ok && blinkState != black {
+		fmt.Fprintf(output.debug, "Using %v for event type %v\n", rule.state.name, next.EventType)
+		blinkState = rule.state
+	}
+	if blinkState != black {
+		for _, pattern := range userPrefs.keywordPatterns {
+			if pattern.regexp.MatchString(next.Summary) {
+				fmt.Fprintf(output.debug, "Using %v for keyword %v\n", pattern.state.name, pattern.regexp)
+				blinkState = pattern.state
+				break
+			}
+		}
+	}
+	if userPrefs.videoCallState != nil && blinkState != black && delta >= 0 && next.videoCall && !next.afterTravel {
+		fmt.Fprintf(output.debug, "Using %v for video call\n", userPrefs.videoCallState.name)
+		blinkState = *userPrefs.videoCallState
+	}
+	if userPrefs.tentativeState != nil && blinkState != black && delta >= 0 && next.tentative {
+		fmt.Fprintf(output.debug, "Using %v for a tentative event\n", userPrefs.tentativeState.name)
+		blinkState = *userPrefs.tentativeState
+	}
+	if blinkState != black && next.declined {
+		fmt.Fprintf(output.debug, "Using %v for a declined event\n", userPrefs.declinedState.name)
+		blinkState = *userPrefs.declinedState
+	}
+	if userPrefs.showMeetingEndCountdown && blinkState != black && !next.meetingEnd.IsZero() {
+		remaining := next.meetingEnd.Sub(now).Minutes()
+		blinkState = meetingEndState(remaining, userPrefs.meetingEndRules)
+		fmt.Fprintf(output.debug, "Using %v for a meeting that ends in %v minutes\n", blinkState.name, remaining)
+	}
+	if userPrefs.justStartedState != nil && blinkState != black && delta < 0 && delta >= -float64(userPrefs.justStartedMinutes) &&
+		!next.afterTravel {
+		fmt.Fprintf(output.debug, "Using %v for an event that has just started\n", userPrefs.justStartedState.name)
+		blinkState = *userPrefs.justStartedState
+	}
+	if idle && userPrefs.breakEndingState != nil && next.meetingEnd.IsZero() && delta < float64(userPrefs.breakEndingMinutes) {
+		fmt.Fprintf(output.debug, "Using %v for a break that ends in %v minutes\n", userPrefs.breakEndingState.name, delta)
+		blinkState = *userPrefs.breakEndingState
+	} else if idle {
+		blinkState = userPrefs.idleState
+	}
+	fmt.Fprintf(output.debug, "Event %v from %v, time %v, delta %v, state %v\n", next.Summary, next.calendarID, next.startTime, delta, blinkState.name)
+	return blinkState
+}
+
+// heldState applies ThresholdHysteresis to state, the color for next at now.  If next is the same event that previous
+// was shown for, and previous would still be its color ThresholdHysteresis minutes from now, previous is kept.  This only
+// holds back a change that the event's own start time would undo, so colors still move on as the event approaches.
+func heldState(now time.Time, next *upcomingEvent, state calendarState, previousNext *upcomingEvent, previous calendarState,
+	userPrefs *UserPrefs) calendarState {
+	if next == nil || previousNext == nil || state == previous || next.calendarID != previousNext.calendarID ||
+		next.Id != previousNext.Id {
+		return state
+	}
+	margin := time.Duration(userPrefs.thresholdHysteresis) * time.Minute
+	if blinkStateForEvent(now.Add(margin), next, userPrefs) != previous {
+		return state
+	}
+	fmt.Fprintf(output.debug, "Keeping %v instead of %v for %v\n", previous.name, state.name, next.Summary)
+	return previous
+}
+
+// timeState returns the state for an event that starts in delta minutes (negative once it has started), using the
+// color rules if there are any and the built-in colors otherwise.
+func timeState(delta float64, colorRules []colorRule) calendarState {
+	if len(colorRules) > 0 {
+		return splitState(ruleState(delta, colorRules, blink1.LED1), ruleState(delta, colorRules, blink1.LED2))
+	}
+	switch {
+	case delta < -1:
+		return blue
+	case delta < 0:
+		return blueFlash
+	case delta < 2:
+		return fastRedFlash
+	case delta < 5:
+		return redFlash
+	case delta < 10:
+		return red
+	case delta < 30:
+		return yellow
+	case delta < 60:
+		return green
+	}
+	return black
+}
+
+// state returns the state for an event that starts in delta minutes, which hasn't started yet: the color in between
+// start and end, or black if the event is further off than the ramp.
+func (ramp *colorRamp) state(delta float64) calendarState {
+	if delta >= float64(ramp.minutes) {
+		return black
+	}
+	// progress goes from 0 at the start of the ramp to 1 when the event starts.
+	progress := 1 - delta/float64(ramp.minutes)
+	return calendarState{
+		name:       fmt.Sprintf("%v to %v %v%%", ramp.start.name, ramp.end.name, int(progress*100)),
+		ledPattern: ledPattern{blinkState: blendState(ramp.start.blinkState, ramp.end.blinkState, progress)},
+	}
+}
+
+// tintState mixes the color of tint half and half into each of the colors of state that isn't off, for the blend
+// CalendarColorMode.  The result flashes or pulses as state does.
+func tintState(state, tint calendarState) calendarState {
+	blend := func(pattern ledPattern) ledPattern {
+		if pattern.blinkState != blink1.OffState {
+			pattern.blinkState = blendState(pattern.blinkState, tint.blinkState, 0.5)
+		}
+		if pattern.flashState != blink1.OffState {
+			pattern.flashState = blendState(pattern.flashState, tint.blinkState, 0.5)
+		}
+		return pattern
+	}
+	blended := state
+	blended.name = state.name + " + " + tint.name
+	blended.ledPattern = blend(state.ledPattern)
+	if state.split {
+		blended.led2 = blend(state.led2)
+	}
+	return blended
+}
+
+// maxLeadTimeMinutes is the furthest LeadTimeMinutes can move the colors, either way.
+const maxLeadTimeMinutes = 60
+
+// builtInWarningMinutes is how long before an event the built-in colors first light the blink(1).
+const builtInWarningMinutes = 60
+
+// warningMinutes returns how long before an event the colors for the time until it starts first light the blink(1):
+// the length of RampColors, the longest time in ColorRules, or the built-in time.
+func warningMinutes(userPrefs *UserPrefs) float64 {
+	if userPrefs.ramp != nil {
+		return float64(userPrefs.ramp.minutes)
+	}
+	longest := int64(0)
+	for _, rule := range userPrefs.colorRules {
+		if rule.minutes != nil && *rule.minutes > longest {
+			longest = *rule.minutes
+		}
+	}
+	if longest > 0 {
+		return float64(longest)
+	}
+	return builtInWarningMinutes
+}
+
+// eventReminderMinutes returns how long before the event its earliest popup reminder is, or 0 if it only has the
+// calendar's default reminders.  Email reminders don't count, since they aren't a warning that the event is starting.
+func eventReminderMinutes(item *calendar.Event) int64 {
+	if item.Reminders == nil || item.Reminders.UseDefault {
+		return 0
+	}
+	earliest := int64(0)
+	for _, reminder := range item.Reminders.Overrides {
+		if reminder.Method == "popup" && reminder.Minutes > earliest {
+			earliest = reminder.Minutes
+		}
+	}
+	return earliest
+}
+
+// afterTravelDelta is the time, in minutes, that an event a travel block leads to is shown as though it were at until
+// it starts: long enough after the start that the built-in colors have stopped flashing.
+const afterTravelDelta = -2
+
+// travelState returns the state for a travel block that starts in delta minutes, using the TravelColors rules if there
+// are any and the built-in colors, with every time doubled, otherwise.
+func travelState(delta float64, rules []colorRule) calendarState {
+	if len(rules) > 0 {
+		return splitState(ruleState(delta, rules, blink1.LED1), ruleState(delta, rules, blink1.LED2))
+	}
+	return timeState(delta/2, nil)
+}
+
+// meetingEndState returns the state for a meeting that ends in remaining minutes, using the MeetingEndColors rules if
+// there are any and the built-in colors otherwise.
+func meetingEndState(remaining float64, rules []colorRule) calendarState {
+	if len(rules) > 0 {
+		return splitState(ruleState(remaining, rules, blink1.LED1), ruleState(remaining, rules, blink1.LED2))
+	}
+	switch {
+	case remaining < 2:
+		return redFlash
+	case remaining < 5:
+		return yellow
+	}
+	return blue
+}
+
+// ruleState returns the state that the color rules give the LED for an event that starts in delta minutes.  Each LED
+// uses the first rule that matches and applies to it.
+func ruleState(delta float64, colorRules []colorRule, led blink1.LED) calendarState {
+	for _, rule := range colorRules {
+		if rule.led != blink1.LEDAll && rule.led != led {
+			continue
+		}
+		if rule.minutes == nil || delta < float64(*rule.minutes) {
+			return rule.state
+		}
+	}
+	return black
+}
+
+// activeProfile is the profile in the config file that is in use, or "" for none.  It starts as the profile the
+// Runner's prefs were read with, and the profile control command changes it, so that a reload keeps the same profile.
+var (
+	activeProfileMu sync.Mutex
+	activeProfile   string
+)
+
+func currentProfile() string {
+	activeProfileMu.Lock()
+	defer activeProfileMu.Unlock()
+	return activeProfile
+}
+
+func setProfile(name string) {
+	activeProfileMu.Lock()
+	defer activeProfileMu.Unlock()
+	activeProfile = name
+}
+
+// Options are the settings from outside the config file: where it is, the defaults for the options that the command
+// line can set, and the flags that were set explicitly, which override it.
+type Options struct {
+	ConfigFile           string
+	ClientSecretFile     string
+	Calendar             string
+	PollInterval         int
+	ResponseState        string
+	DeviceFailureRetries int
+	ShowDots             bool
+	Simulate             bool
+	DryRun               bool
+	// Overrides maps the name of each flag set on the command line to its value.  They are applied after the config
+	// file and the environment, so they always win.
+	Overrides map[string]string
+	// Debug takes the debug messages from reading the config file, or nil to discard them.
+	Debug io.Writer
+}
+
+// DefaultOptions returns the options calblink uses when none are given: conf.json and client_secret.json in the working
+// directory, the primary calendar, and 30 second polls.
+func DefaultOptions() Options {
+	return Options{
+		ConfigFile:           "conf.json",
+		ClientSecretFile:     "client_secret.json",
+		Calendar:             "primary",
+		PollInterval:         30,
+		ResponseState:        string(responseStateNotRejected),
+		DeviceFailureRetries: 10,
+		ShowDots:             true,
+	}
+}
+
+// ReadUserPrefs reads the config file named in options, with the options of the named profile in it unless profile is
+// "", and applies any overrides from the environment and options.  If there is no config file, the defaults are used.
+func ReadUserPrefs(options Options, profile string) (*UserPrefs, error) {
+	return readUserPrefs(options, false, profile)
+}
+
+// readUserPrefs is ReadUserPrefs, except that a missing config file is an error if requireFile is set.
+func readUserPrefs(options Options, requireFile bool, profile string) (*UserPrefs, error) {
+	debug := options.Debug
+	if debug == nil {
+		debug = ioutil.Discard
+	}
+	userPrefs := &UserPrefs{}
+	userPrefs.profile = profile
+	userPrefs.options = options
+	// Set defaults from the options
+	userPrefs.pollInterval = options.PollInterval
+	userPrefs.calendars = []string{options.Calendar}
+	userPrefs.clientSecretFile = options.ClientSecretFile
+	userPrefs.responseState = responseState(options.ResponseState)
+	userPrefs.calendarResponseStates = make(map[string]responseState)
+	userPrefs.calendarColorMode = calendarColorReplace
+	userPrefs.overlapStrategy = overlapCalendarOrder
+	userPrefs.mqttTopic = "calblink"
+	userPrefs.deviceFailureRetries = options.DeviceFailureRetries
+	userPrefs.showDots = options.ShowDots
+	userPrefs.dots = defaultDots
+	userPrefs.simulate = options.Simulate
+	userPrefs.dryRun = options.DryRun
+	userPrefs.backend = backendGoogle
+	userPrefs.brightness = 100
+	userPrefs.logMaxSizeMB = 10
+	userPrefs.logKeepFiles = 3
+	userPrefs.skipAllDayEvents = true
+	userPrefs.timezone = time.Local
+	userPrefs.videoCallRegex = regexp.MustCompile(defaultVideoCallRegex)
+	userPrefs.failureState = magentaFlash
+	userPrefs.authErrorState = magenta
+	userPrefs.idleState = black
+	userPrefs.breakEndingMinutes = 120
+	userPrefs.busyWindow = 60
+	userPrefs.justStartedMinutes = 2
+	userPrefs.failureThreshold = 3
+	userPrefs.maxBackoff = 600
+	userPrefs.deviceMaxBackoff = 300
+	userPrefs.connectRetryInterval = 10
+	userPrefs.deviceType = deviceBlink1
+	userPrefs.logFormat = logFormatText
+	data, err := ioutil.ReadFile(options.ConfigFile)
+	if err != nil {
+		if requireFile {
+			return nil, err
+		}
+		// Lack of a config file is not a fatal error, unless a profile in it was asked for.
+		if profile != "" {
+			return nil, fmt.Errorf("Unable to use profile %v: %v", profile, err)
+		}
+		fmt.Fprintf(debug, "Unable to read config file %v : %v\n", options.ConfigFile, err)
+		if err := applyOverrides(userPrefs); err != nil {
+			return nil, err
+		}
+		if problems := userPrefs.validate(); len(problems) > 0 {
+			return nil, problems
+		}
+		return userPrefs, nil
+	}
+	// YAML is converted to JSON, so that both are decoded, and checked, in exactly the same way.
+	switch strings.ToLower(filepath.Ext(options.ConfigFile)) {
+	case ".yaml", ".yml":
+		data, err = yaml.YAMLToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse config file %v", err)
+		}
+	}
+	prefs := prefLayout{}
+	err = json.Unmarshal(data, &prefs)
+	fmt.Fprintf(debug, "Decoded prefs: %v\n", prefs)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse config file %v", err)
+	}
+	// Decoding the profile into the same layout replaces just the options it sets.
+	if profile != "" {
+		overlay, ok := prefs.Profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("Invalid profile %v: there is no such profile in %v", profile, options.ConfigFile)
+		}
+		if err := json.Unmarshal(overlay, &prefs); err != nil {
+			return nil, fmt.Errorf("Unable to parse profile %v: %v", profile, err)
+		}
+		fmt.Fprintf(debug, "Decoded prefs with profile %v: %v\n", profile, prefs)
+	}
+	// Carry on past any problems, so that they can all be reported at once.
+	var problems configProblems
+	if prefs.Timezone != "" {
+		location, err := time.LoadLocation(prefs.Timezone)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("Invalid timezone %v : %v", prefs.Timezone, err))
+		} else {
+			userPrefs.timezone = location
+		}
+	}
+	// Custom colors come first, so that the other options can use them.
+	for name, layout := range prefs.CustomColors {
+		state, err := customState(name, layout)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		userPrefs.customStates = append(userPrefs.customStates, state)
+	}
+	userPrefs.startTime, err = parseTimeOfDay(prefs.StartTime, "start")
+	if err != nil {
+		problems = append(problems, err)
+	}
+	userPrefs.endTime, err = parseTimeOfDay(prefs.EndTime, "end")
+	if err != nil {
+		problems = append(problems, err)
+	}
+	userPrefs.excludes = make(map[string]bool)
+	for _, item := range prefs.Excludes {
+		fmt.Fprintf(debug, "Excluding item %v\n", item)
+		userPrefs.excludes[item] = true
+	}
+	weekdays := make(map[string]int)
+	for i := 0; i < 7; i++ {
+		weekdays[time.Weekday(i).String()] = i
+	}
+	for _, day := range prefs.SkipDays {
+		i, ok := weekdays[day]
+		if ok {
+			userPrefs.skipDays[i] = true
+		} else {
+			problems = append(problems, fmt.Errorf("Invalid day in skipDays: %v", day))
+		}
+	}
+	userPrefs.skipDates = make(map[string]bool)
+	for _, date := range prefs.SkipDates {
+		if t, err := time.Parse("2006-01-02", date); err == nil {
+			userPrefs.skipDates[t.Format("2006-01-02")] = true
+		} else {
+			problems = append(problems, fmt.Errorf("Invalid date in skipDates: %v", date))
+		}
+	}
+	userPrefs.holidays, err = parseHolidays(prefs.Holidays)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	userPrefs.workHours = make(map[time.Weekday]workHours)
+	for day, layout := range prefs.WorkHours {
+		i, ok := weekdays[day]
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid day in workHours: %v", day))
+			continue
+		}
+		hours := workHours{}
+		hours.startTime, err = parseTimeOfDay(layout.StartTime, day+" start")
+		if err != nil {
+			problems = append(problems, err)
+		}
+		hours.endTime, err = parseTimeOfDay(layout.EndTime, day+" end")
+		if err != nil {
+			problems = append(problems, err)
+		}
+		userPrefs.workHours[time.Weekday(i)] = hours
+	}
+	for i, layout := range prefs.WorkPeriods {
+		which := fmt.Sprintf("work period %v", i+1)
+		period := workHours{}
+		var startErr, endErr error
+		period.startTime, startErr = parseTimeOfDay(layout.StartTime, which+" start")
+		period.endTime, endErr = parseTimeOfDay(layout.EndTime, which+" end")
+		if startErr != nil || endErr != nil {
+			for _, err := range []error{startErr, endErr} {
+				if err != nil {
+					problems = append(problems, err)
+				}
+			}
+			continue
+		}
+		if period.startTime == nil || period.endTime == nil || !period.startTime.Before(*period.endTime) {
+			problems = append(problems, fmt.Errorf("Invalid %v: needs a startTime before its endTime", which))
+			continue
+		}
+		if n := len(userPrefs.workPeriods); n > 0 && period.startTime.Before(*userPrefs.workPeriods[n-1].endTime) {
+			problems = append(problems, fmt.Errorf("Invalid %v: work periods must be in order and not overlap", which))
+			continue
+		}
+		userPrefs.workPeriods = append(userPrefs.workPeriods, period)
+	}
+	if prefs.Calendar != "" {
+		userPrefs.calendars = []string{prefs.Calendar}
+	}
+	if len(prefs.Calendars) > 0 {
+		userPrefs.calendars = nil
+		for _, layout := range prefs.Calendars {
+			userPrefs.calendars = append(userPrefs.calendars, layout.ID)
+			if layout.ResponseState == "" {
+				continue
+			}
+			state := responseState(layout.ResponseState)
+			if !state.isValidState() {
+				problems = append(problems, fmt.Errorf("Invalid response state %v for calendar %v", layout.ResponseState, layout.ID))
+				continue
+			}
+			userPrefs.calendarResponseStates[layout.ID] = state
+		}
+	}
+	userPrefs.calendarColors = make(map[string]calendarState)
+	for calendarID, color := range prefs.CalendarColors {
+		state, ok := userPrefs.stateByName(color)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid color in calendarColors: %v", color))
+			continue
+		}
+		userPrefs.calendarColors[calendarID] = state
+	}
+	// Colors in the calendars' own entries come second, so that they win.
+	for _, layout := range prefs.Calendars {
+		if layout.Color == "" {
+			continue
+		}
+		state, ok := userPrefs.stateByName(layout.Color)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid color %v for calendar %v", layout.Color, layout.ID))
+			continue
+		}
+		userPrefs.calendarColors[layout.ID] = state
+	}
+	if prefs.OverlapStrategy != "" {
+		userPrefs.overlapStrategy = overlapStrategy(prefs.OverlapStrategy)
+		if !userPrefs.overlapStrategy.isValidOverlapStrategy() {
+			problems = append(problems, fmt.Errorf("Invalid overlapStrategy %v", prefs.OverlapStrategy))
+		}
+	}
+	if prefs.CalendarColorMode != "" {
+		userPrefs.calendarColorMode = calendarColorMode(strings.ToLower(prefs.CalendarColorMode))
+		if !userPrefs.calendarColorMode.isValidCalendarColorMode() {
+			problems = append(problems, fmt.Errorf("Invalid calendarColorMode %v", prefs.CalendarColorMode))
+		}
+	}
+	if prefs.PollInterval != 0 {
+		userPrefs.pollInterval = int(prefs.PollInterval)
+	}
+	userPrefs.alignPolls = prefs.AlignPolls
+	userPrefs.pollJitter = int(prefs.PollJitter)
+	if prefs.ResponseState != "" {
+		userPrefs.responseState = responseState(prefs.ResponseState)
+		if !userPrefs.responseState.isValidState() {
+			problems = append(problems, fmt.Errorf("Invalid response state %v", prefs.ResponseState))
+		}
+	}
+	if prefs.DeviceFailureRetries != 0 {
+		userPrefs.deviceFailureRetries = int(prefs.DeviceFailureRetries)
+	}
+	if prefs.DeviceMaxBackoff != 0 {
+		userPrefs.deviceMaxBackoff = int(prefs.DeviceMaxBackoff)
+	}
+	userPrefs.connectRetries = int(prefs.ConnectRetries)
+	if prefs.ConnectRetryInterval != 0 {
+		userPrefs.connectRetryInterval = int(prefs.ConnectRetryInterval)
+	}
+	if len(prefs.DotChars) > 0 {
+		userPrefs.dots = make(map[dotKind]string)
+		for kind, mark := range defaultDots {
+			userPrefs.dots[kind] = mark
+		}
+		for name, mark := range prefs.DotChars {
+			kind, ok := dotKind(""), false
+			for known := range defaultDots {
+				if strings.EqualFold(string(known), name) {
+					kind, ok = known, true
+				}
+			}
+			if !ok {
+				problems = append(problems, fmt.Errorf("Invalid dotChars entry %v", name))
+				continue
+			}
+			userPrefs.dots[kind] = mark
+		}
+	}
+	if prefs.ShowDots != "" {
+		userPrefs.showDots = (prefs.ShowDots == "false")
+	}
+	userPrefs.deviceAssignments = make(map[string]string)
+	for device, calendarID := range prefs.DeviceAssignments {
+		if device == "" {
+			problems = append(problems, fmt.Errorf("Invalid serial number in deviceAssignments: it is empty"))
+			continue
+		}
+		userPrefs.deviceAssignments[device] = calendarID
+	}
+	userPrefs.deviceCalibration = make(map[string]calibration)
+	for device, layout := range prefs.DeviceCalibration {
+		if device == "" {
+			problems = append(problems, fmt.Errorf("Invalid serial number in deviceCalibration: it is empty"))
+			continue
+		}
+		deviceCalibration := identityCalibration
+		for _, factor := range []struct {
+			name  string
+			value *float64
+			field *float64
+		}{{"red", layout.Red, &deviceCalibration.red}, {"green", layout.Green, &deviceCalibration.green},
+			{"blue", layout.Blue, &deviceCalibration.blue}} {
+			if factor.value == nil {
+				continue
+			}
+			if *factor.value < 0 || *factor.value > 1 {
+				problems = append(problems, fmt.Errorf("Invalid %v %v in deviceCalibration for device %v, must be from 0 to 1",
+					factor.name, *factor.value, device))
+				continue
+			}
+			*factor.field = *factor.value
+		}
+		if layout.Gamma != nil {
+			if *layout.Gamma <= 0 {
+				problems = append(problems, fmt.Errorf("Invalid gamma %v in deviceCalibration for device %v, must be more than 0",
+					*layout.Gamma, device))
+			} else {
+				deviceCalibration.gamma = *layout.Gamma
+			}
+		}
+		userPrefs.deviceCalibration[device] = deviceCalibration
+	}
+	userPrefs.statusPort = int(prefs.StatusPort)
+	userPrefs.metricsPort = int(prefs.MetricsPort)
+	if prefs.FailureColor != "" {
+		state, ok := userPrefs.stateByName(prefs.FailureColor)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid failureColor: %v", prefs.FailureColor))
+		} else {
+			userPrefs.failureState = state
+		}
+	}
+	if prefs.AuthErrorColor != "" {
+		state, ok := userPrefs.stateByName(prefs.AuthErrorColor)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid authErrorColor: %v", prefs.AuthErrorColor))
+		} else {
+			userPrefs.authErrorState = state
+		}
+	}
+	if prefs.FailureThreshold != nil {
+		if *prefs.FailureThreshold < 0 {
+			problems = append(problems, fmt.Errorf("Invalid failureThreshold %v", *prefs.FailureThreshold))
+		} else {
+			userPrefs.failureThreshold = int(*prefs.FailureThreshold)
+		}
+	}
+	if prefs.LogFormat != "" {
+		userPrefs.logFormat = logFormat(prefs.LogFormat)
+		if !userPrefs.logFormat.isValidLogFormat() {
+			problems = append(problems, fmt.Errorf("Invalid logFormat %v", prefs.LogFormat))
+		}
+	}
+	if prefs.DeviceType != "" {
+		userPrefs.deviceType = deviceType(prefs.DeviceType)
+		if !userPrefs.deviceType.isValidDeviceType() {
+			problems = append(problems, fmt.Errorf("Invalid deviceType %v", prefs.DeviceType))
+		}
+	}
+	userPrefs.devicePatterns = prefs.DevicePatterns
+	if prefs.FadeMillis < 0 {
+		problems = append(problems, fmt.Errorf("Invalid fadeMillis %v", prefs.FadeMillis))
+	}
+	userPrefs.fadeMillis = int(prefs.FadeMillis)
+	if prefs.FlashIntervalMillis != 0 && (prefs.FlashIntervalMillis < 100 || prefs.FlashIntervalMillis > 5000) {
+		problems = append(problems, fmt.Errorf("Invalid flashIntervalMillis %v, must be from 100 to 5000", prefs.FlashIntervalMillis))
+	}
+	userPrefs.flashIntervalMillis = int(prefs.FlashIntervalMillis)
+	if prefs.FlashOnMillis != 0 && (prefs.FlashOnMillis < 100 || prefs.FlashOnMillis > 5000) {
+		problems = append(problems, fmt.Errorf("Invalid flashOnMillis %v, must be from 100 to 5000", prefs.FlashOnMillis))
+	}
+	userPrefs.flashOnMillis = int(prefs.FlashOnMillis)
+	if prefs.FlashOffMillis != 0 && (prefs.FlashOffMillis < 100 || prefs.FlashOffMillis > 5000) {
+		problems = append(problems, fmt.Errorf("Invalid flashOffMillis %v, must be from 100 to 5000", prefs.FlashOffMillis))
+	}
+	userPrefs.flashOffMillis = int(prefs.FlashOffMillis)
+	if prefs.MaxBackoff != 0 {
+		userPrefs.maxBackoff = int(prefs.MaxBackoff)
+	}
+	userPrefs.privacyMode = prefs.PrivacyMode
+	if prefs.Backend != "" {
+		userPrefs.backend = backendType(prefs.Backend)
+		if !userPrefs.backend.isValidBackend() {
+			problems = append(problems, fmt.Errorf("Invalid backend %v", prefs.Backend))
+		}
+	}
+	userPrefs.caldavURL = prefs.CaldavURL
+	userPrefs.caldavUsername = prefs.CaldavUsername
+	userPrefs.caldavPassword = prefs.CaldavPassword
+	if userPrefs.backend == backendCaldav && userPrefs.caldavURL == "" {
+		problems = append(problems, fmt.Errorf("The caldav backend needs a caldavURL"))
+	}
+	userPrefs.outlookClientID = prefs.OutlookClientID
+	userPrefs.outlookClientSecret = prefs.OutlookClientSecret
+	userPrefs.outlookTenant = "common"
+	if prefs.OutlookTenant != "" {
+		userPrefs.outlookTenant = prefs.OutlookTenant
+	}
+	if userPrefs.backend == backendOutlook && userPrefs.outlookClientID == "" {
+		problems = append(problems, fmt.Errorf("The outlook backend needs an outlookClientID"))
+	}
+	var ruleProblems []error
+	userPrefs.colorRules, ruleProblems = userPrefs.parseColorRules(prefs.ColorRules, "colorRules")
+	problems = append(problems, ruleProblems...)
+	userPrefs.meetingEndRules, ruleProblems = userPrefs.parseColorRules(prefs.MeetingEndColors, "meetingEndColors")
+	problems = append(problems, ruleProblems...)
+	userPrefs.travelRules, ruleProblems = userPrefs.parseColorRules(prefs.TravelColors, "travelColors")
+	problems = append(problems, ruleProblems...)
+	userPrefs.showMeetingEndCountdown = prefs.ShowMeetingEndCountdown
+	userPrefs.useEventColors = prefs.UseEventColors
+	userPrefs.controlSocket = prefs.ControlSocket
+	userPrefs.grpcPort = int(prefs.GRPCPort)
+	userPrefs.grpcAddress = "localhost"
+	if prefs.GRPCAddress != "" {
+		userPrefs.grpcAddress = prefs.GRPCAddress
+	}
+	userPrefs.logFile = prefs.LogFile
+	userPrefs.statusFile = prefs.StatusFile
+	userPrefs.tokenFile = prefs.TokenFile
+	userPrefs.dndCalendar = prefs.DNDCalendar
+	userPrefs.outOfOffice = prefs.OutOfOffice
+	if prefs.OutOfOfficePattern != "" {
+		regex, err := regexp.Compile("(?i)" + prefs.OutOfOfficePattern)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("Invalid outOfOfficePattern %v: %v", prefs.OutOfOfficePattern, err))
+		} else {
+			userPrefs.outOfOfficeRegex = regex
+		}
+	}
+	userPrefs.notify = prefs.Notify
+	userPrefs.soundOnImminent = prefs.SoundOnImminent
+	userPrefs.soundFile = prefs.SoundFile
+	if prefs.SoundFile != "" {
+		if _, err := os.Stat(prefs.SoundFile); err != nil {
+			problems = append(problems, fmt.Errorf("Invalid soundFile: %v", err))
+		}
+	}
+	userPrefs.slackToken = prefs.SlackToken
+	userPrefs.webhookURL = prefs.WebhookURL
+	userPrefs.deciderCommand = strings.Fields(prefs.DeciderCommand)
+	if prefs.MQTTBroker != "" {
+		if _, _, err := parseMQTTBroker(prefs.MQTTBroker); err != nil {
+			problems = append(problems, fmt.Errorf("Invalid mqttBroker %v: %v", prefs.MQTTBroker, err))
+		}
+	}
+	userPrefs.mqttBroker = prefs.MQTTBroker
+	userPrefs.mqttUsername = prefs.MQTTUsername
+	userPrefs.mqttPassword = prefs.MQTTPassword
+	if prefs.MQTTTopic != "" {
+		userPrefs.mqttTopic = prefs.MQTTTopic
+	}
+	userPrefs.pauseWhenLocked = prefs.PauseWhenLocked
+	userPrefs.skipFreeEvents = prefs.SkipFreeEvents
+	userPrefs.onlyMyEvents = prefs.OnlyMyEvents
+	if prefs.MinEventMinutes < 0 {
+		problems = append(problems, fmt.Errorf("Invalid minEventMinutes %v", prefs.MinEventMinutes))
+	}
+	userPrefs.minEventMinutes = int(prefs.MinEventMinutes)
+	if prefs.EndGraceMinutes < 0 {
+		problems = append(problems, fmt.Errorf("Invalid endGraceMinutes %v", prefs.EndGraceMinutes))
+	}
+	userPrefs.endGraceMinutes = int(prefs.EndGraceMinutes)
+	if prefs.LeadTimeMinutes < -maxLeadTimeMinutes || prefs.LeadTimeMinutes > maxLeadTimeMinutes {
+		problems = append(problems, fmt.Errorf("Invalid leadTimeMinutes %v, must be from %v to %v", prefs.LeadTimeMinutes,
+			-maxLeadTimeMinutes, maxLeadTimeMinutes))
+	}
+	userPrefs.leadTimeMinutes = int(prefs.LeadTimeMinutes)
+	userPrefs.useEventReminders = prefs.UseEventReminders
+	if prefs.ThresholdHysteresis < 0 {
+		problems = append(problems, fmt.Errorf("Invalid thresholdHysteresis %v", prefs.ThresholdHysteresis))
+	}
+	userPrefs.thresholdHysteresis = int(prefs.ThresholdHysteresis)
+	if prefs.SkipAllDayEvents != nil {
+		userPrefs.skipAllDayEvents = *prefs.SkipAllDayEvents
+	}
+	if prefs.Simulate {
+		userPrefs.simulate = true
+	}
+	if prefs.LogMaxSizeMB < 0 {
+		problems = append(problems, fmt.Errorf("Invalid logMaxSizeMB %v", prefs.LogMaxSizeMB))
+	}
+	if prefs.LogMaxSizeMB != 0 {
+		userPrefs.logMaxSizeMB = int(prefs.LogMaxSizeMB)
+	}
+	if prefs.LogKeepFiles != nil {
+		if *prefs.LogKeepFiles < 0 {
+			problems = append(problems, fmt.Errorf("Invalid logKeepFiles %v", *prefs.LogKeepFiles))
+		}
+		userPrefs.logKeepFiles = int(*prefs.LogKeepFiles)
+	}
+	if prefs.Brightness != nil {
+		if *prefs.Brightness < 0 || *prefs.Brightness > 100 {
+			problems = append(problems, fmt.Errorf("Invalid brightness %v, must be from 0 to 100", *prefs.Brightness))
+		}
+		userPrefs.brightness = int(*prefs.Brightness)
+	}
+	if prefs.NightBrightness != nil {
+		if *prefs.NightBrightness < 0 || *prefs.NightBrightness > 100 {
+			problems = append(problems, fmt.Errorf("Invalid nightBrightness %v, must be from 0 to 100", *prefs.NightBrightness))
+		}
+		nightBrightness := int(*prefs.NightBrightness)
+		userPrefs.nightBrightness = &nightBrightness
+		userPrefs.nightStartTime, err = parseTimeOfDay(prefs.NightStartTime, "night start")
+		if err != nil {
+			problems = append(problems, err)
+		}
+		userPrefs.nightEndTime, err = parseTimeOfDay(prefs.NightEndTime, "night end")
+		if err != nil {
+			problems = append(problems, err)
+		}
+		if userPrefs.nightStartTime == nil || userPrefs.nightEndTime == nil {
+			problems = append(problems, fmt.Errorf("nightBrightness needs both nightStartTime and nightEndTime"))
+		}
+	}
+	if prefs.QuietHours != nil {
+		start, startErr := parseTimeOfDay(prefs.QuietHours.StartTime, "quietHours start")
+		end, endErr := parseTimeOfDay(prefs.QuietHours.EndTime, "quietHours end")
+		if startErr != nil || endErr != nil {
+			for _, err := range []error{startErr, endErr} {
+				if err != nil {
+					problems = append(problems, err)
+				}
+			}
+		} else if start == nil || end == nil {
+			problems = append(problems, fmt.Errorf("Invalid quietHours: needs both a startTime and an endTime"))
+		} else {
+			userPrefs.quietHours = &workHours{startTime: start, endTime: end}
+		}
+	}
+	userPrefs.eventColorMap = make(map[string]calendarState)
+	for colorID, color := range prefs.EventColorMap {
+		state, ok := userPrefs.stateByName(color)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid color in eventColorMap: %v", color))
+			continue
+		}
+		userPrefs.eventColorMap[colorID] = state
+	}
+	for keyword, color := range prefs.KeywordPatterns {
+		state, ok := userPrefs.stateByName(color)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid color in keywordPatterns: %v", color))
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + keyword)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("Invalid keyword in keywordPatterns %v : %v", keyword, err))
+			continue
+		}
+		userPrefs.keywordPatterns = append(userPrefs.keywordPatterns, keywordPattern{regexp: re, state: state})
+	}
+	// Check longer, more specific keywords first, so that the order doesn't depend on the map.
+	sort.Slice(userPrefs.keywordPatterns, func(i, j int) bool {
+		a, b := userPrefs.keywordPatterns[i].regexp.String(), userPrefs.keywordPatterns[j].regexp.String()
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	if prefs.BusyWindow != nil {
+		if *prefs.BusyWindow <= 0 {
+			problems = append(problems, fmt.Errorf("Invalid busyWindow: %v", *prefs.BusyWindow))
+		}
+		userPrefs.busyWindow = int(*prefs.BusyWindow)
+	}
+	for meetings, color := range prefs.BusyColors {
+		count, err := strconv.Atoi(meetings)
+		if err != nil || count < 1 {
+			problems = append(problems, fmt.Errorf("Invalid number of meetings in busyColors: %v", meetings))
+			continue
+		}
+		state, ok := userPrefs.stateByName(color)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid color in busyColors: %v", color))
+			continue
+		}
+		userPrefs.busyRules = append(userPrefs.busyRules, busyRule{meetings: count, state: state})
+	}
+	// Check the busiest rules first.
+	sort.Slice(userPrefs.busyRules, func(i, j int) bool {
+		return userPrefs.busyRules[i].meetings > userPrefs.busyRules[j].meetings
+	})
+	userPrefs.eventTypes = make(map[string]eventTypeRule)
+	for eventType, color := range prefs.EventTypes {
+		if strings.EqualFold(color, "ignore") {
+			userPrefs.eventTypes[strings.ToLower(eventType)] = eventTypeRule{ignore: true}
+			continue
+		}
+		state, ok := userPrefs.stateByName(color)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid color in eventTypes: %v", color))
+			continue
+		}
+		userPrefs.eventTypes[strings.ToLower(eventType)] = eventTypeRule{state: state}
+	}
+	if prefs.IdleColor != "" {
+		state, ok := userPrefs.stateByName(prefs.IdleColor)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid idleColor: %v", prefs.IdleColor))
+		} else {
+			userPrefs.idleState = state
+		}
+	}
+	if prefs.ExitColor != "" {
+		state, ok := userPrefs.stateByName(prefs.ExitColor)
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Errorf("Invalid exitColor: %v", prefs.ExitColor))
+		case state.flashDuration > 0 || (state.split && state.led2.flashDuration > 0):
+			problems = append(problems, fmt.Errorf("Invalid exitColor %v, must be a steady color", prefs.ExitColor))
+		default:
+			userPrefs.exitState = &state
+		}
+	}
+	if prefs.BreakEndingColor != "" {
+		state, ok := userPrefs.stateByName(prefs.BreakEndingColor)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid breakEndingColor: %v", prefs.BreakEndingColor))
+		} else {
+			userPrefs.breakEndingState = &state
+		}
+	}
+	if prefs.BreakEndingMinutes < 0 {
+		problems = append(problems, fmt.Errorf("Invalid breakEndingMinutes %v", prefs.BreakEndingMinutes))
+	} else if prefs.BreakEndingMinutes > 0 {
+		userPrefs.breakEndingMinutes = int(prefs.BreakEndingMinutes)
+	}
+	if prefs.VideoCallColor != "" {
+		state, ok := userPrefs.stateByName(prefs.VideoCallColor)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid videoCallColor: %v", prefs.VideoCallColor))
+		} else {
+			userPrefs.videoCallState = &state
+		}
+	}
+	if prefs.TentativeColor != "" {
+		state, ok := userPrefs.stateByName(prefs.TentativeColor)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid tentativeColor: %v", prefs.TentativeColor))
+		} else {
+			userPrefs.tentativeState = &state
+		}
+	}
+	if prefs.DeclinedColor != "" {
+		state, ok := userPrefs.stateByName(prefs.DeclinedColor)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid declinedColor: %v", prefs.DeclinedColor))
+		} else {
+			userPrefs.declinedState = &state
+		}
+	}
+	if prefs.RampColors != nil {
+		start, startOK := userPrefs.stateByName(prefs.RampColors.StartColor)
+		end, endOK := userPrefs.stateByName(prefs.RampColors.EndColor)
+		switch {
+		case !startOK:
+			problems = append(problems, fmt.Errorf("Invalid startColor in rampColors: %v", prefs.RampColors.StartColor))
+		case !endOK:
+			problems = append(problems, fmt.Errorf("Invalid endColor in rampColors: %v", prefs.RampColors.EndColor))
+		case prefs.RampColors.Minutes <= 0:
+			problems = append(problems, fmt.Errorf("Invalid minutes in rampColors %v, must be more than 0", prefs.RampColors.Minutes))
+		default:
+			userPrefs.ramp = &colorRamp{start: start, end: end, minutes: int(prefs.RampColors.Minutes)}
+		}
+	}
+	if prefs.JustStartedColor != "" {
+		state, ok := userPrefs.stateByName(prefs.JustStartedColor)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid justStartedColor: %v", prefs.JustStartedColor))
+		} else {
+			userPrefs.justStartedState = &state
+		}
+	}
+	if prefs.JustStartedMinutes != nil {
+		if *prefs.JustStartedMinutes <= 0 {
+			problems = append(problems, fmt.Errorf("Invalid justStartedMinutes %v, must be more than 0", *prefs.JustStartedMinutes))
+		}
+		userPrefs.justStartedMinutes = int(*prefs.JustStartedMinutes)
+	}
+	if prefs.VideoCallRegex != "" {
+		userPrefs.videoCallRegex, err = regexp.Compile(prefs.VideoCallRegex)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("Invalid videoCallRegex %v : %v", prefs.VideoCallRegex, err))
+		}
+	}
+	if prefs.TravelPattern != "" {
+		userPrefs.travelRegex, err = regexp.Compile("(?i)" + prefs.TravelPattern)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("Invalid travelPattern %v : %v", prefs.TravelPattern, err))
+		}
+	}
+	if prefs.ExcludeRegex != "" {
+		userPrefs.excludeRegex, err = regexp.Compile(prefs.ExcludeRegex)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("Invalid excludeRegex %v : %v", prefs.ExcludeRegex, err))
+		}
+	}
+	if prefs.IncludeRegex != "" {
+		userPrefs.includeRegex, err = regexp.Compile(prefs.IncludeRegex)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("Invalid includeRegex %v : %v", prefs.IncludeRegex, err))
+		}
+	}
+	if err := applyOverrides(userPrefs); err != nil {
+		problems = append(problems, err)
+	}
+	problems = append(problems, userPrefs.validate()...)
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	fmt.Fprintf(debug, "User prefs: %v\n", userPrefs)
+	return userPrefs, nil
+}
+
+// parseColorRules reads rules in the form of ColorRules.  which is the name of the option, for error messages.
+func (userPrefs *UserPrefs) parseColorRules(layouts []colorRuleLayout, which string) ([]colorRule, []error) {
+	var rules []colorRule
+	var problems []error
+	for _, layout := range layouts {
+		state, ok := userPrefs.stateByName(layout.Color)
+		if !ok {
+			problems = append(problems, fmt.Errorf("Invalid color in %v: %v", which, layout.Color))
+			continue
+		}
+		if layout.LED < 0 || layout.LED > 2 {
+			problems = append(problems, fmt.Errorf("Invalid LED in %v: %v", which, layout.LED))
+			continue
+		}
+		rules = append(rules, colorRule{minutes: layout.Minutes, state: state, led: blink1.LED(layout.LED)})
+	}
+	return rules, problems
+}
+
+// configProblems is everything found wrong with the config, so that it can all be fixed in one go.
+type configProblems []error
+
+func (problems configProblems) Error() string {
+	if len(problems) == 1 {
+		return problems[0].Error()
+	}
+	lines := make([]string, len(problems))
+	for i, problem := range problems {
+		lines[i] = "  " + problem.Error()
+	}
+	return fmt.Sprintf("%v problems with the config:\n%v", len(problems), strings.Join(lines, "\n"))
+}
+
+// validate checks the settings that depend on each other, or that may have come from flags or the environment rather
+// than the config file.  Each problem names the setting it is about.
+func (userPrefs *UserPrefs) validate() configProblems {
+	var problems configProblems
+	if userPrefs.pollInterval <= 0 {
+		problems = append(problems, fmt.Errorf("Invalid pollInterval %v, must be more than 0", userPrefs.pollInterval))
+	}
+	if userPrefs.pollJitter < 0 || (userPrefs.pollJitter > 0 && 2*userPrefs.pollJitter >= userPrefs.pollInterval) {
+		problems = append(problems, fmt.Errorf("Invalid pollJitter %v, must be from 0 to less than half of pollInterval",
+			userPrefs.pollJitter))
+	}
+	if userPrefs.deviceFailureRetries < retryForever {
+		problems = append(problems, fmt.Errorf("Invalid deviceFailureRetries %v", userPrefs.deviceFailureRetries))
+	}
+	if userPrefs.connectRetries < retryForever {
+		problems = append(problems, fmt.Errorf("Invalid connectRetries %v", userPrefs.connectRetries))
+	}
+	if userPrefs.connectRetryInterval <= 0 {
+		problems = append(problems, fmt.Errorf("Invalid connectRetryInterval %v, must be more than 0", userPrefs.connectRetryInterval))
+	}
+	if userPrefs.maxBackoff <= 0 {
+		problems = append(problems, fmt.Errorf("Invalid maxBackoff %v, must be more than 0", userPrefs.maxBackoff))
+	}
+	if userPrefs.deviceMaxBackoff <= 0 {
+		problems = append(problems, fmt.Errorf("Invalid deviceMaxBackoff %v, must be more than 0", userPrefs.deviceMaxBackoff))
+	}
+	if userPrefs.devicePatterns && userPrefs.deviceType != deviceBlink1 {
+		problems = append(problems, fmt.Errorf("Invalid devicePatterns: only a blink(1) can play patterns"))
+	}
+	if userPrefs.soundOnImminent && userPrefs.soundFile == "" {
+		problems = append(problems, fmt.Errorf("Invalid soundOnImminent: soundFile must be set too"))
+	}
+	if len(userPrefs.calendars) == 0 {
+		problems = append(problems, fmt.Errorf("Invalid calendars: there must be at least one calendar"))
+	}
+	for _, calendarID := range userPrefs.calendars {
+		if calendarID == "" {
+			problems = append(problems, fmt.Errorf("Invalid calendars: calendar IDs can't be empty"))
+			break
+		}
+	}
+	if userPrefs.backend == backendICS {
+		for _, calendarID := range userPrefs.calendars {
+			if feed, err := url.Parse(calendarID); err != nil || feed.Host == "" {
+				problems = append(problems, fmt.Errorf("Invalid calendars: %v isn't the URL of an iCalendar feed", calendarID))
+			}
+		}
+	}
+	if userPrefs.startTime != nil && userPrefs.endTime != nil && !userPrefs.startTime.Before(*userPrefs.endTime) {
+		problems = append(problems, fmt.Errorf("Invalid startTime %v: must be before endTime %v",
+			userPrefs.startTime.Format("15:04"), userPrefs.endTime.Format("15:04")))
+	}
+	// Days in workHours can take one of their times from startTime and endTime, so check what they end up with.
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if _, ok := userPrefs.workHours[day]; !ok {
+			continue
+		}
+		periods, _ := userPrefs.periodsFor(day)
+		if hours := periods[0]; hours.startTime != nil && hours.endTime != nil && !hours.startTime.Before(*hours.endTime) {
+			problems = append(problems, fmt.Errorf("Invalid workHours for %v: startTime must be before endTime", day))
+		}
+	}
+	return problems
+}
+
+// parseTimeOfDay parses an hh:mm time from the config file, returning nil if it is empty.  Which names the time for
+// error messages.
+func parseTimeOfDay(value string, which string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %v time %v : %v", which, value, err)
+	}
+	return &t, nil
+}
+
+// envOverrides maps each environment variable that can override the config file to the flag it stands in for.  They
+// are applied after the config file and before the flags, so a flag set on the command line still wins.
+var envOverrides = []struct{ name, flag string }{
+	{"CALBLINK_CALENDAR", "calendar"},
+	{"CALBLINK_CLIENT_SECRET", "clientsecret"},
+	{"CALBLINK_POLL_INTERVAL", "poll_interval"},
+	{"CALBLINK_RESPONSE_STATE", "response_state"},
+	{"CALBLINK_DEVICE_FAILURE_RETRIES", "device_failure_retries"},
+	{"CALBLINK_SHOW_DOTS", "show_dots"},
+	{"CALBLINK_SIMULATE", "simulate"},
+	{"CALBLINK_TOKEN_FILE", "token_file"},
+}
+
+// applyOverrides overrides the config file with any environment variables in envOverrides, and then with any flags
+// that were set explicitly on the command line, in order of their names.
+func applyOverrides(userPrefs *UserPrefs) error {
+	for _, env := range envOverrides {
+		value, ok := os.LookupEnv(env.name)
+		if !ok {
+			continue
+		}
+		if err := applyOverride(userPrefs, env.flag, value); err != nil {
+			return fmt.Errorf("%v in %v", err, env.name)
+		}
+	}
+	names := make([]string, 0, len(userPrefs.options.Overrides))
+	for name := range userPrefs.options.Overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var err error
+	for _, name := range names {
+		if flagErr := applyOverride(userPrefs, name, userPrefs.options.Overrides[name]); flagErr != nil {
+			err = flagErr
+		}
+	}
+	return err
+}
+
+// applyOverride sets the option that the named flag overrides, checking the value as the flag package would.
+func applyOverride(userPrefs *UserPrefs, name string, value string) error {
+	switch name {
+	case "calendar":
+		userPrefs.calendars = []string{value}
+	case "clientsecret":
+		userPrefs.clientSecretFile = value
+	case "poll_interval", "device_failure_retries":
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("Invalid %v %v", name, value)
+		}
+		if name == "poll_interval" {
+			userPrefs.pollInterval = number
+		} else {
+			userPrefs.deviceFailureRetries = number
+		}
+	case "response_state":
+		userPrefs.responseState = responseState(value)
+		if !userPrefs.responseState.isValidState() {
+			return fmt.Errorf("Invalid response state %v", userPrefs.responseState)
+		}
+	case "show_dots", "simulate":
+		setting, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid %v %v", name, value)
+		}
+		if name == "show_dots" {
+			userPrefs.showDots = setting
+		} else {
+			userPrefs.simulate = setting
+		}
+	case "token_file":
+		userPrefs.tokenFile = value
+	}
+	return nil
+}
+
+// tomorrow returns midnight at the start of the day after now, in now's time zone.
+func tomorrow(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+}
+
+// maxSkippedDays is how far ahead nextWorkday looks, so that a config that skips every day can't loop it forever.
+const maxSkippedDays = 366
+
+// isSkipDay reports whether the day now falls on is skipped, by SkipDays or SkipDates.
+func (userPrefs *UserPrefs) isSkipDay(now time.Time) bool {
+	return userPrefs.skipDays[now.Weekday()] || userPrefs.skipDates[now.Format("2006-01-02")]
+}
+
+// nextWorkday returns midnight at the start of the next day after now that is neither a skip day, nor a skip date, nor
+// one of the dates in Holidays.  Holiday calendars aren't checked, since that would mean fetching them for days ahead;
+// a day off on one of them is found when it comes.
+func nextWorkday(now time.Time, userPrefs *UserPrefs) time.Time {
+	day := tomorrow(now)
+	for i := 0; i < maxSkippedDays; i++ {
+		if !userPrefs.isSkipDay(day) && !userPrefs.holidays.isHoliday(day) {
+			return day
+		}
+		day = tomorrow(day)
+	}
+	return tomorrow(now)
+}
+
+// offSchedule decides whether the schedule keeps the devices off at now: on a skip day, on a holiday, or outside the
+// work hours.  If it does, it returns how long to stay off, the progress mark, and why, for the explanation; otherwise
+// wait is 0.  Everything that needs a fetch comes in through holiday, which returns today's holiday or "", and
+// runningOver, which reports whether an event is keeping the devices on past the end of one of the periods, so that the
+// rest depends only on its arguments.
+func offSchedule(now time.Time, userPrefs *UserPrefs, holiday func(time.Time) string,
+	runningOver func(time.Time, []workHours) bool) (wait time.Duration, dot dotKind, reason string) {
+	weekday := now.Weekday()
+	// Skip days and holidays sleep straight through any that follow, such as a long weekend.
+	if userPrefs.isSkipDay(now) {
+		wake := nextWorkday(now, userPrefs)
+		reason = fmt.Sprintf("%v is a skip date", now.Format("2006-01-02"))
+		if userPrefs.skipDays[weekday] {
+			reason = fmt.Sprintf("%v is a skip day", weekday)
+		}
+		return wake.Sub(now), dotSkipDay, fmt.Sprintf("%v, until %v", reason, wake.Format("Mon 2006-01-02"))
+	}
+	if name := holiday(now); name != "" {
+		wake := nextWorkday(now, userPrefs)
+		return wake.Sub(now), dotSkipDay, fmt.Sprintf("holiday (%v), until %v", name, wake.Format("Mon 2006-01-02"))
+	}
+	periods, schedule := userPrefs.periodsFor(weekday)
+	fmt.Fprintf(output.debug, "Using %v schedule\n", schedule)
+	wait, dot = untilWorkPeriod(now, periods)
+	if wait <= 0 || runningOver(now, periods) {
+		return 0, "", ""
+	}
+	if dot == dotBeforeStart {
+		return wait, dot, fmt.Sprintf("before start time (%v schedule)", schedule)
+	}
+	return wait, dot, fmt.Sprintf("after end time (%v schedule)", schedule)
+}
+
+// tickEvents is what decideTick needs from outside: the control socket's requests, the screen lock, what each device is
+// showing, and the calendars.  The calendars come in through functions, which are only called once a pass gets as far
+// as needing them, so that a pass settled without them, such as outside the work hours, doesn't fetch them.
+type tickEvents struct {
+	snoozedUntil  time.Time
+	override      calendarState
+	overrideUntil time.Time
+	locked        bool
+	// displays are the devices, with their calendars, their failures so far and what they are showing.  decideTick
+	// doesn't change them.
+	displays []*deviceDisplay
+	// reconnected is set once the backend has been reconnected because the token was refused.
+	reconnected bool
+	// backoff is the wait after the last poll if it failed, or 0.
+	backoff time.Duration
+	// holiday and runningOver are as for offSchedule.
+	holiday     func(now time.Time) string
+	runningOver func(now time.Time, periods []workHours) bool
+	// dnd returns the event on DndCalendar that is going on, if any.
+	dnd func(now time.Time) *calendar.Event
+	// away returns the out of office event going on in the calendar, if any.
+	away func(now time.Time, calendarID string) *calendar.Event
+	// fetch returns the next event in the calendar for the numbered device, with the errors fetchEvents gives.
+	fetch func(now time.Time, device int, calendarID string) (*upcomingEvent, error)
+	// decide asks DeciderCommand for the numbered device's state.  It is only called if there is a DeciderCommand.
+	decide func(now time.Time, device int, next *upcomingEvent, state calendarState) calendarState
+}
+
+// tickPattern is what a pass decided the devices show: all of them the same state, or each its own.
+type tickPattern struct {
+	// all is the state every device shows, if they all show the same one for the same reason, such as a snooze.
+	all *calendarState
+	// explanation says why all is shown, for the dry run explanations.
+	explanation string
+	// devices has what each device shows, if all isn't set.
+	devices []deviceDecision
+	dot     dotKind
+	// quiet is set during quiet hours, when the devices are kept off whatever they are given.
+	quiet bool
+	// authRefused is set if a calendar server refused the token, and rateLimited if one is rate limiting us.
+	authRefused bool
+	rateLimited bool
+}
+
+// deviceDecision is what a pass decided one device shows.
+type deviceDecision struct {
+	// show is set if the device shows state, for next; otherwise it keeps the state it has.
+	show  bool
+	state calendarState
+	next  *upcomingEvent
+	// failed is set if a calendar for the device couldn't be fetched, which counts towards FailureThreshold.
+	failed bool
+	// notify is set if the device is changing color as next becomes imminent, which brings up a notification.
+	notify bool
+	// explanation says what the device shows and why, for the dry run explanations.
+	explanation string
+}
+
+// decideTick decides what the devices show at now, and when to decide again.  In order of precedence, from highest:
+//  1. an override from the control socket, even during quiet hours
+//  2. a snooze from the control socket
+//  3. off while the screen is locked, with PauseWhenLocked
+//  4. off on skip days and holidays
+//  5. off outside the work hours
+//  6. off during an event on DndCalendar
+//  7. off during an out of office event, with OutOfOffice
+//  8. off during quiet hours
+//  9. FailureColor, once fetching has failed more than FailureThreshold polls in a row
+//  10. the color for the next event
+//
+// The first seven don't fetch the calendars, so a failing fetch can never show FailureColor over them.  Quiet hours
+// keep a device off whatever it would otherwise show, FailureColor included; the failure is only logged.  Everything
+// that needs a fetch, a command or the previous pass comes in through events, so that the rest depends only on the
+// arguments.
+func decideTick(now time.Time, userPrefs *UserPrefs, events *tickEvents) (pattern tickPattern, nextWake time.Time) {
+	overridden := now.Before(events.overrideUntil)
+	// An override is asked for on purpose, so it shows even during quiet hours.
+	pattern.quiet = userPrefs.inQuietHours(now) && !overridden
+	all := func(state calendarState, dot dotKind, wake time.Time, format string, args ...interface{}) (tickPattern,
+		time.Time) {
+		pattern.all = &state
+		pattern.dot = dot
+		pattern.explanation = fmt.Sprintf("%v - %v", state.name, fmt.Sprintf(format, args...))
+		return pattern, wake
+	}
+	if overridden {
+		return all(events.override, dotOverride, events.overrideUntil, "overridden until %v",
+			events.overrideUntil.Format("15:04:05"))
+	}
+	if now.Before(events.snoozedUntil) {
+		return all(black, dotSnoozed, events.snoozedUntil, "snoozed until %v", events.snoozedUntil.Format("15:04:05"))
+	}
+	if events.locked {
+		return all(black, dotLocked, now.Add(pollWait(now, userPrefs)), "the screen is locked")
+	}
+	if wait, dot, reason := offSchedule(now, userPrefs, events.holiday, events.runningOver); wait > 0 {
+		return all(black, dot, now.Add(wait), "%v", reason)
+	}
+	if userPrefs.dndCalendar != "" {
+		if dnd := events.dnd(now); dnd != nil {
+			return all(black, dotDND, now.Add(pollWait(now, userPrefs)), "do not disturb for %q", dnd.Summary)
+		}
+	}
+	if userPrefs.outOfOffice {
+		checked := make(map[string]bool)
+		for _, display := range events.displays {
+			for _, calendarID := range display.calendars {
+				if checked[calendarID] {
+					continue
+				}
+				checked[calendarID] = true
+				if away := events.away(now, calendarID); away != nil {
+					return all(black, dotAway, now.Add(pollWait(now, userPrefs)), "out of office for %q", away.Summary)
+				}
+			}
+		}
+	}
+	// rateLimitedFor is the longest wait any calendar server asked for this pass.
+	var rateLimitedFor time.Duration
+	pattern.dot = dotNormal
+	for i, display := range events.displays {
+		var err, limitErr error
+		candidates := make([]*upcomingEvent, 0, len(display.calendars))
+		for _, calendarID := range display.calendars {
+			next, fetchErr := events.fetch(now, i, calendarID)
+			// A calendar that doesn't exist is left out, rather than counted as a failure.
+			if _, notFound := fetchErr.(calendarNotFoundError); notFound {
+				continue
+			}
+			if limited, ok := fetchErr.(rateLimitError); ok {
+				limitErr = fetchErr
+				pattern.rateLimited = true
+				if limited.retryAfter > rateLimitedFor {
+					rateLimitedFor = limited.retryAfter
+				}
+			} else if fetchErr != nil {
+				err = fetchErr
+				pattern.authRefused = pattern.authRefused || needsConsent(fetchErr)
+			}
+			candidates = append(candidates, next)
+		}
+		if err == nil && len(candidates) == 0 {
+			err = fmt.Errorf("none of the calendars for device %v were found", i)
+			fmt.Fprintf(output.debug, "%v\n", err)
+		}
+		var decision deviceDecision
+		switch {
+		case err == nil && limitErr != nil:
+			// Being rate limited goes away by itself, so it keeps the color without counting as a failure.
+			decision.explanation = fmt.Sprintf("%v - kept while the calendar server is rate limiting", display.state.name)
+			pattern.dot = dotError
+		case err != nil:
+			// Leave the same color, set a flag. If we get more than a critical number of these,
+			// set the failure color to tell the user we are in a failed state.
+			decision.failed = true
+			failures := display.failures + 1
+			if needsConsent(err) && events.reconnected {
+				// Signing in again is the only fix, so there's no point waiting for the threshold.
+				decision.show, decision.state = true, userPrefs.authErrorState
+				decision.explanation = fmt.Sprintf("%v - the calendar server refused the token", userPrefs.authErrorState.name)
+			} else if failures > userPrefs.failureThreshold {
+				decision.show, decision.state = true, userPrefs.failureState
+				if pattern.quiet {
+					decision.explanation = fmt.Sprintf("%v - quiet hours, instead of %v for %v failed fetches in a row",
+						black.name, userPrefs.failureState.name, failures)
+				} else {
+					decision.explanation = fmt.Sprintf("%v - %v failed fetches in a row", userPrefs.failureState.name, failures)
+				}
+			} else {
+				decision.explanation = fmt.Sprintf("%v - kept after a failed fetch", display.state.name)
+			}
+			pattern.dot = dotError
+		default:
+			next := soonestEvent(now, candidates, userPrefs)
+			state := blinkStateForEvent(now, next, userPrefs)
+			if userPrefs.thresholdHysteresis > 0 {
+				state = heldState(now, next, state, display.next, display.state, userPrefs)
+			}
+			if len(userPrefs.deciderCommand) > 0 {
+				state = events.decide(now, i, next, state)
+			}
+			decision.show, decision.state, decision.next = true, state, next
+			// Notify on the change of color as the event becomes imminent.  The snooze and off-hours cases never get
+			// this far, so they never notify, and nor do quiet hours.
+			decision.notify = state != display.state && state != black && isImminent(now, next) && !pattern.quiet
+			if pattern.quiet {
+				decision.explanation = fmt.Sprintf("%v - quiet hours, instead of %v for %v", black.name, state.name,
+					describeEvent(now, next))
+			} else {
+				decision.explanation = fmt.Sprintf("%v - %v", state.name, describeEvent(now, next))
+			}
+		}
+		pattern.devices = append(pattern.devices, decision)
+	}
+	if pattern.dot != dotError {
+		return pattern, now.Add(pollWait(now, userPrefs))
+	}
+	pollInterval := time.Duration(userPrefs.pollInterval) * time.Second
+	wait := nextBackoff(events.backoff, pollInterval, time.Duration(userPrefs.maxBackoff)*time.Second)
+	if pattern.rateLimited {
+		if rateLimitedFor == 0 {
+			rateLimitedFor = rateLimitWait
+		}
+		if wait < rateLimitedFor {
+			wait = rateLimitedFor
+		}
+	}
+	return pattern, now.Add(wait)
+}
+
+// setHourMinuteFromTime returns the time of day t on the same day as now, in now's time zone.
+func setHourMinuteFromTime(now time.Time, t time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+}
+
+func printStartInfo(userPrefs *UserPrefs, displays []*deviceDisplay) {
+	fmt.Fprintf(output.status, "Running with %v second intervals for calendar ID %v\n", userPrefs.pollInterval,
+		strings.Join(userPrefs.calendars, ", "))
+	if userPrefs.profile != "" {
+		fmt.Fprintf(output.status, "Using profile %v\n", userPrefs.profile)
+	}
+	if len(displays) > 1 || !sameCalendars(displays[0].calendars, userPrefs.calendars) {
+		for i, display := range displays {
+			fmt.Fprintf(output.status, "Device %v shows calendar ID %v\n", i, strings.Join(display.calendars, ", "))
+		}
+	}
+	for calendarID, state := range userPrefs.calendarColors {
+		if userPrefs.calendarColorMode == calendarColorBlend {
+			fmt.Fprintf(output.status, "Events from %v blended with %v\n", calendarID, state.name)
+		} else {
+			fmt.Fprintf(output.status, "Events from %v shown as %v\n", calendarID, state.name)
+		}
+	}
+	switch userPrefs.responseState {
+	case responseStateAll:
+		fmt.Fprintln(output.status, "All events shown, regardless of accepted/rejected status.")
+	case responseStateAccepted:
+		fmt.Fprintln(output.status, "Only accepted events shown.")
+	case responseStateNotRejected:
+		fmt.Fprintln(output.status, "Rejected events not shown.")
+	}
+	for calendarID, state := range userPrefs.calendarResponseStates {
+		fmt.Fprintf(output.status, "Events from %v shown with response state %v\n", calendarID, state)
+	}
+	if len(userPrefs.excludes) > 0 {
+		fmt.Fprintln(output.status, "Excluded events:")
+		for item := range userPrefs.excludes {
+			fmt.Fprintf(output.status, "   %v\n", item)
+		}
+	}
+	skipDays := ""
+	join := ""
+	for i, val := range userPrefs.skipDays {
+		if val {
+			skipDays += join
+			skipDays += time.Weekday(i).String()
+			join = ", "
+		}
+	}
+	if len(skipDays) > 0 {
+		fmt.Fprintln(output.status, "Skip days: "+skipDays)
+	}
+	if len(userPrefs.skipDates) > 0 {
+		dates := make([]string, 0, len(userPrefs.skipDates))
+		for date := range userPrefs.skipDates {
+			dates = append(dates, date)
+		}
+		sort.Strings(dates)
+		fmt.Fprintln(output.status, "Skip dates: "+strings.Join(dates, ", "))
+	}
+	if userPrefs.skipFreeEvents {
+		fmt.Fprintln(output.status, "Events marked as free not shown.")
+	}
+	if userPrefs.onlyMyEvents {
+		fmt.Fprintf(output.status, "Only events organized or created by %v shown.\n", userPrefs.accountEmail)
+	}
+	if !userPrefs.skipAllDayEvents {
+		fmt.Fprintln(output.status, "All-day events shown.")
+	}
+	if userPrefs.excludeRegex != nil {
+		fmt.Fprintf(output.status, "Excluding events matching %v\n", userPrefs.excludeRegex)
+	}
+	if userPrefs.includeRegex != nil {
+		fmt.Fprintf(output.status, "Only including events matching %v\n", userPrefs.includeRegex)
+	}
+	if len(userPrefs.colorRules) > 0 {
+		fmt.Fprintln(output.status, "Color rules:")
+		printColorRules(userPrefs.colorRules)
+	}
+	if userPrefs.showMeetingEndCountdown {
+		fmt.Fprintln(output.status, "Meetings going on now are shown by the time until they end.")
+		if len(userPrefs.meetingEndRules) > 0 {
+			fmt.Fprintln(output.status, "Meeting end colors:")
+			printColorRules(userPrefs.meetingEndRules)
+		}
+	}
+	if userPrefs.ramp != nil {
+		fmt.Fprintf(output.status, "Shifting from %v to %v over the %v minutes before each event\n", userPrefs.ramp.start.name,
+			userPrefs.ramp.end.name, userPrefs.ramp.minutes)
+	}
+	if userPrefs.useEventReminders {
+		fmt.Fprintln(output.status, "Events with their own popup reminder are warned about from the reminder.")
+	}
+	if userPrefs.travelRegex != nil {
+		fmt.Fprintf(output.status, "Events matching %v are travel\n", userPrefs.travelRegex)
+		if len(userPrefs.travelRules) > 0 {
+			fmt.Fprintln(output.status, "Travel colors:")
+			printColorRules(userPrefs.travelRules)
+		}
+	}
+	if len(userPrefs.workPeriods) > 0 {
+		fmt.Fprintln(output.status, "Work periods:")
+		for _, period := range userPrefs.workPeriods {
+			fmt.Fprintf(output.status, "   %v\n", timeRestrictions(period.startTime, period.endTime))
+		}
+	} else if timeString := timeRestrictions(userPrefs.startTime, userPrefs.endTime); len(timeString) > 0 {
+		fmt.Fprintln(output.status, "Time restrictions: "+timeString)
+	}
+	for i := 0; i < 7; i++ {
+		weekday := time.Weekday(i)
+		if _, ok := userPrefs.workHours[weekday]; ok {
+			periods, _ := userPrefs.periodsFor(weekday)
+			if timeString := timeRestrictions(periods[0].startTime, periods[0].endTime); len(timeString) > 0 {
+				fmt.Fprintf(output.status, "%v time restrictions: %v\n", weekday, timeString)
+			}
+		}
+	}
+	if userPrefs.quietHours != nil {
+		fmt.Fprintf(output.status, "Quiet hours from %v until %v\n", userPrefs.quietHours.startTime.Format("15:04"),
+			userPrefs.quietHours.endTime.Format("15:04"))
+	}
+}
+
+// printColorRules prints each of the color rules, with the LED it lights and the minutes it applies under.
+func printColorRules(rules []colorRule) {
+	for _, rule := range rules {
+		led := ""
+		if rule.led != blink1.LEDAll {
+			led = fmt.Sprintf(" on LED %v", rule.led)
+		}
+		if rule.minutes != nil {
+			fmt.Fprintf(output.status, "   %v%v under %v minutes\n", rule.state.name, led, *rule.minutes)
+		} else {
+			fmt.Fprintf(output.status, "   %v%v otherwise\n", rule.state.name, led)
+		}
+	}
+}
+
+// timeRestrictions describes a start and end time, either of which may be nil.
+func timeRestrictions(startTime *time.Time, endTime *time.Time) string {
+	timeString := ""
+	if startTime != nil {
+		timeString += fmt.Sprintf("after %02d:%02d", startTime.Hour(), startTime.Minute())
+	}
+	if endTime != nil {
+		if len(timeString) > 0 {
+			timeString += " and "
+		}
+		timeString += fmt.Sprintf("until %02d:%02d", endTime.Hour(), endTime.Minute())
+	}
+	return timeString
+}
+
+// connect sets up the calendar backend chosen in the user's prefs.
+func connect(userPrefs *UserPrefs) calendarBackend {
+	if userPrefs.backend == backendCaldav {
+		backend, err := newCaldavBackend(userPrefs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return backend
+	}
+	if userPrefs.backend == backendOutlook {
+		return newOutlookBackend(userPrefs)
+	}
+	if userPrefs.backend == backendICS {
+		return newICSBackend()
+	}
+
+	// BEGIN GOOGLE CALENDAR API SAMPLE CODE
+	ctx := context.Background()
+
+	b, err := ioutil.ReadFile(userPrefs.clientSecretFile)
+	if err != nil {
+		log.Fatalf("Unable to read client secret file: %v", err)
+	}
+
+	config, err := google.ConfigFromJSON(b, calendar.CalendarReadonlyScope)
+	if err != nil {
+		log.Fatalf("Unable to parse client secret file to config: %v", err)
+	}
+	client := getClient(ctx, config, tokenPath(userPrefs, googleTokenName))
+
+	srv, err := calendar.New(client)
+	if err != nil {
+		log.Fatalf("Unable to retrieve calendar Client %v", err)
+	}
+	// END GOOGLE CALENDAR API SAMPLE CODE
+
+	return &googleBackend{srv: srv}
+}
+
+var (
+	// pollJitterRand chooses the offsets for PollJitter.
+	pollJitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	// lastPollJitter is the offset that pollWait gave the last wait, which the next one takes back off.
+	lastPollJitter time.Duration
+)
+
+// pollWait returns the wait from now until the next poll: PollInterval, or with AlignPolls, until the next multiple of
+// PollInterval by the clock in now's time zone, moved by PollJitter.
+func pollWait(now time.Time, userPrefs *UserPrefs) time.Duration {
+	pollInterval := time.Duration(userPrefs.pollInterval) * time.Second
+	if userPrefs.pollJitter == 0 {
+		lastPollJitter = 0
+	}
+	// Work from the usual time of this poll, rather than the time jitter moved it to, so that the polls don't drift, and
+	// an aligned poll that was moved early doesn't line up with the multiple it was moved away from.
+	usual := now.Add(-lastPollJitter)
+	wait := pollInterval
+	if userPrefs.alignPolls {
+		// Truncate works from UTC, so shift into local time first, so that intervals of an hour or more line up too.
+		_, offset := usual.Zone()
+		local := usual.Add(time.Duration(offset) * time.Second)
+		wait = local.Truncate(pollInterval).Add(pollInterval).Sub(local)
+	}
+	wait -= lastPollJitter
+	if userPrefs.pollJitter > 0 {
+		maxJitter := time.Duration(userPrefs.pollJitter) * time.Second
+		lastPollJitter = time.Duration(pollJitterRand.Int63n(int64(2*maxJitter)+1)) - maxJitter
+		wait += lastPollJitter
+	}
+	return wait
+}
+
+// nextBackoff returns the wait before the next poll after another failed one: double the current wait, starting from
+// the poll interval, but no more than maxBackoff.  The wait is never less than the poll interval.
+func nextBackoff(current time.Duration, pollInterval time.Duration, maxBackoff time.Duration) time.Duration {
+	if current < pollInterval {
+		current = pollInterval
+	}
+	next := current * 2
+	if next > maxBackoff {
+		next = maxBackoff
+	}
+	if next < pollInterval {
+		next = pollInterval
+	}
+	return next
+}
+
+// identifyHold is how long --identify shows each color for.
+const identifyHold = time.Second
+
+// identify shows every built-in and custom color on the devices in turn, printing the name of each.  It doesn't need
+// a calendar, so it works offline.
+func identify(displays []*deviceDisplay, userPrefs *UserPrefs) {
+	startRunners(displays, userPrefs)
+	states := append(append([]calendarState{}, namedStates...), userPrefs.customStates...)
+	for _, state := range states {
+		// Show flashing colors for a whole flash at least.
+		hold := identifyHold
+		if on, off := displays[0].blinker.flashTimes(state.ledPattern); on+off > hold {
+			hold = on + off
+		}
+		fmt.Fprintln(output.status, state.name)
+		executeAll(state, displays)
+		time.Sleep(hold)
+	}
+}
+
+// startRunners starts each device's patternRunner, for --identify and --calibrate, with the brightness and timings from
+// the user's prefs.
+func startRunners(displays []*deviceDisplay, userPrefs *UserPrefs) {
+	now := time.Now().In(userPrefs.timezone)
+	for _, display := range displays {
+		display.blinker.setBrightness(userPrefs.brightnessAt(now))
+		display.blinker.setFadeTime(time.Duration(userPrefs.fadeMillis) * time.Millisecond)
+		display.blinker.setFlashTiming(time.Duration(userPrefs.flashIntervalMillis)*time.Millisecond,
+			time.Duration(userPrefs.flashOnMillis)*time.Millisecond, time.Duration(userPrefs.flashOffMillis)*time.Millisecond)
+		go display.blinker.patternRunner()
+	}
+}
+
+// calibrationStates are the reference colors --calibrate shows.  Each channel on its own shows up differences in its
+// strength, and white and gray show up differences in the balance of the channels and in gamma.
+var calibrationStates = []calendarState{
+	red,
+	green,
+	blue,
+	{name: "White", ledPattern: ledPattern{blinkState: blink1.State{Red: 255, Green: 255, Blue: 255}}},
+	{name: "Gray", ledPattern: ledPattern{blinkState: blink1.State{Red: 128, Green: 128, Blue: 128}}},
+}
+
+// calibrationHold is how long --calibrate shows each color for if there is no terminal to press Enter on.
+const calibrationHold = 10 * time.Second
+
+// calibrationTest shows each of the reference colors on every device at once, for --calibrate, calibrated as the user's
+// prefs say, so that the devices can be compared side by side.  Each color is shown until Enter is pressed.
+func calibrationTest(displays []*deviceDisplay, userPrefs *UserPrefs) {
+	startRunners(displays, userPrefs)
+	for _, display := range displays {
+		serial := display.blinker.deviceSerial()
+		calibration, ok := userPrefs.deviceCalibration[serial]
+		if !ok {
+			calibration = identityCalibration
+		}
+		fmt.Fprintf(output.status, "Device %v (serial number %q): red %v, green %v, blue %v, gamma %v\n", display.number, serial,
+			calibration.red, calibration.green, calibration.blue, calibration.gamma)
+	}
+	stdin := bufio.NewReader(os.Stdin)
+	for _, state := range calibrationStates {
+		executeAll(state, displays)
+		fmt.Fprintf(output.status, "%v - press Enter for the next color", state.name)
+		if _, err := stdin.ReadString('\n'); err != nil {
+			fmt.Fprintln(output.status)
+			time.Sleep(calibrationHold)
+		}
+	}
+}
+
+// Exit codes for --check_auth.
+const (
+	checkAuthOK      = 0
+	checkAuthFailed  = 1
+	checkAuthConsent = 2
+)
+
+// checkAuth reads every calendar once, for --check_auth, and returns the exit code.  It never asks you to sign in: if
+// there is no cached token, or the token can no longer be refreshed, it says so and returns checkAuthConsent.
+func checkAuth(userPrefs *UserPrefs) int {
+	tokenFile := backendTokenFile(userPrefs)
+	if tokenFile != "" {
+		if _, err := tokenFromFile(tokenFile); err != nil {
+			fmt.Fprintf(output.status, "No usable token in %v (%v).  Run calblink without --check_auth to sign in.\n", tokenFile, err)
+			return checkAuthConsent
+		}
+	}
+	backend := connect(userPrefs)
+	now := time.Now().In(userPrefs.timezone)
+	result := checkAuthOK
+	for _, calendarID := range userPrefs.calendars {
+		_, err := backend.fetchEvents(now, calendarID, userPrefs)
+		switch {
+		case err == nil:
+			fmt.Fprintf(output.status, "%v: OK\n", calendarID)
+		case needsConsent(err):
+			fmt.Fprintf(output.status, "%v: the token in %v was refused (%v).  Remove it and run calblink without --check_auth "+
+				"to sign in again.\n", calendarID, tokenFile, err)
+			return checkAuthConsent
+		default:
+			fmt.Fprintf(output.status, "%v: %v\n", calendarID, err)
+			result = checkAuthFailed
+		}
+	}
+	return result
+}
+
+// backendTokenFile returns the file the OAuth token for the backend is cached in, or "" if the backend doesn't use OAuth.
+func backendTokenFile(userPrefs *UserPrefs) string {
+	switch userPrefs.backend {
+	case backendGoogle:
+		return tokenPath(userPrefs, googleTokenName)
+	case backendOutlook:
+		return tokenPath(userPrefs, outlookTokenName)
+	}
+	return ""
+}
+
+// needsConsent reports whether the error is the OAuth server refusing to refresh the token, which means signing in
+// again.
+func needsConsent(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	_, ok := err.(*oauth2.RetrieveError)
+	return ok
+}
+
+// listCalendars prints the calendars the account can read, for --list_calendars, so that you can find the IDs to put
+// in Calendars.
+func listCalendars(userPrefs *UserPrefs) {
+	calendars, err := connect(userPrefs).listCalendars()
+	if err != nil {
+		log.Fatalf("Unable to list calendars: %v", err)
+	}
+	for _, info := range calendars {
+		name := info.name
+		if info.primary {
+			name += " (primary)"
+		}
+		fmt.Fprintf(output.status, "%v: %v\n", name, info.id)
+	}
+}
+
@@ -0,0 +1,213 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// caldavBackend reads events from a CalDAV server.  Calendar IDs are the paths (or full URLs) of calendar collections,
+// resolved against the server URL; "primary" means the server URL itself.
+type caldavBackend struct {
+	client   *http.Client
+	server   *url.URL
+	username string
+	password string
+}
+
+// caldavWindow is how far ahead of now events are fetched.
+const caldavWindow = 24 * time.Hour
+
+func newCaldavBackend(userPrefs *UserPrefs) (*caldavBackend, error) {
+	server, err := url.Parse(userPrefs.caldavURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CalDAV URL %v: %v", userPrefs.caldavURL, err)
+	}
+	return &caldavBackend{
+		client:   &http.Client{Timeout: 30 * time.Second},
+		server:   server,
+		username: userPrefs.caldavUsername,
+		password: userPrefs.caldavPassword,
+	}, nil
+}
+
+// accountEmail returns the username, which CalDAV servers usually take to be an email address.
+func (backend *caldavBackend) accountEmail() (string, error) {
+	if !strings.Contains(backend.username, "@") {
+		return "", fmt.Errorf("onlyMyEvents needs a caldavUsername that is an email address")
+	}
+	return backend.username, nil
+}
+
+// listCalendars asks the server which collections under the server URL are calendars.  The server URL is usually the
+// account's calendar home, which holds all its calendars.
+func (backend *caldavBackend) listCalendars() ([]calendarInfo, error) {
+	req, err := http.NewRequest("PROPFIND", backend.server.String(), strings.NewReader(caldavCollectionsQuery))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", "1")
+	if backend.username != "" {
+		req.SetBasicAuth(backend.username, backend.password)
+	}
+	resp, err := backend.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("CalDAV query of %v failed: %v", backend.server, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	collections := caldavCollections{}
+	if err := xml.Unmarshal(data, &collections); err != nil {
+		return nil, fmt.Errorf("Unable to parse CalDAV response: %v", err)
+	}
+	var calendars []calendarInfo
+	for _, response := range collections.Responses {
+		for _, propstat := range response.Propstat {
+			if propstat.Prop.ResourceType.Calendar == nil {
+				continue
+			}
+			name := propstat.Prop.DisplayName
+			if name == "" {
+				name = response.Href
+			}
+			calendars = append(calendars, calendarInfo{id: response.Href, name: name})
+			break
+		}
+	}
+	return calendars, nil
+}
+
+// caldavCollections is the part of a PROPFIND response that we need.  Calendar is only set for calendar collections.
+type caldavCollections struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Prop struct {
+				DisplayName  string `xml:"DAV: displayname"`
+				ResourceType struct {
+					Calendar *struct{} `xml:"urn:ietf:params:xml:ns:caldav calendar"`
+				} `xml:"DAV: resourcetype"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+const caldavCollectionsQuery = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:">
+  <D:prop><D:displayname/><D:resourcetype/></D:prop>
+</D:propfind>
+`
+
+// caldavMultistatus is the part of a REPORT response that we need.
+type caldavMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				CalendarData string `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+const caldavQuery = `<?xml version="1.0" encoding="utf-8"?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop><C:calendar-data/></D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VEVENT">
+        <C:time-range start="%v" end="%v"/>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>
+`
+
+// fetchEvents asks the server for the events in the calendar that overlap the next day, and expands any recurring ones
+// locally.
+func (backend *caldavBackend) fetchEvents(now time.Time, calendarID string, userPrefs *UserPrefs) ([]*calendar.Event, error) {
+	collection := backend.server
+	if calendarID != "" && calendarID != "primary" {
+		ref, err := url.Parse(calendarID)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CalDAV calendar %v: %v", calendarID, err)
+		}
+		collection = backend.server.ResolveReference(ref)
+	}
+	end := now.Add(caldavWindow)
+	body := fmt.Sprintf(caldavQuery, now.UTC().Format("20060102T150405Z"), end.UTC().Format("20060102T150405Z"))
+	req, err := http.NewRequest("REPORT", collection.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", "1")
+	if backend.username != "" {
+		req.SetBasicAuth(backend.username, backend.password)
+	}
+	resp, err := backend.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, calendarNotFoundError{calendarID}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, rateLimitError{calendarID, retryAfter(resp.Header)}
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("CalDAV query of %v failed: %v", collection, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	multistatus := caldavMultistatus{}
+	if err := xml.Unmarshal(data, &multistatus); err != nil {
+		return nil, fmt.Errorf("Unable to parse CalDAV response: %v", err)
+	}
+	var events []*icalEvent
+	for _, response := range multistatus.Responses {
+		for _, propstat := range response.Propstat {
+			if propstat.Prop.CalendarData == "" {
+				continue
+			}
+			parsed, err := parseICalEvents(strings.NewReader(propstat.Prop.CalendarData))
+			if err != nil {
+				fmt.Fprintf(output.debug, "Skipping %v: %v\n", response.Href, err)
+				continue
+			}
+			events = append(events, parsed...)
+		}
+	}
+	return expandICalEvents(events, now, end, backend.username), nil
+}
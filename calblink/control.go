@@ -0,0 +1,191 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+// The control socket accepts one command per line and writes back one line of reply per command.  Commands are:
+//   snooze <duration>  - turn the blink(1) off for the duration, such as 30m or 1h15m
+//   override <duration> <color>
+//                      - show the color, such as Red, for the duration whatever the calendar says
+//   release <duration> - close the devices for the duration, so that another program can use them, then reopen them
+//   resume             - end a snooze, override or release early
+//   dismiss            - pass over the upcoming event that each device is showing, until it starts, for the one after it
+//   status             - describe the current state
+//   profile <name>     - switch to the named profile in the config file, as though it had been given with --profile
+// A snooze and an override replace any snooze or override that is already going on, and a release replaces any
+// release.  calblink keeps polling while the devices are released.
+// Replies to commands that fail start with "error: ".
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// controlCommand is a command from the control socket, for the main loop to carry out.  The main loop must send exactly
+// one line of reply on reply.
+type controlCommand struct {
+	name     string
+	duration time.Duration
+	// color is the name of the color for override.  The main loop looks it up, since it depends on the user's prefs.
+	color string
+	// profile is the name of the profile for profile.
+	profile string
+	reply   chan string
+}
+
+// parseControlCommand checks that a line from the control socket is a well-formed command.
+func parseControlCommand(line string) (controlCommand, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return controlCommand{}, fmt.Errorf("empty command")
+	}
+	command := controlCommand{name: strings.ToLower(fields[0])}
+	switch command.name {
+	case "snooze", "release":
+		if len(fields) != 2 {
+			return command, fmt.Errorf("usage: %v <duration>", command.name)
+		}
+		duration, err := time.ParseDuration(fields[1])
+		if err != nil || duration <= 0 {
+			return command, fmt.Errorf("invalid duration %q", fields[1])
+		}
+		command.duration = duration
+	case "override":
+		if len(fields) < 3 {
+			return command, fmt.Errorf("usage: override <duration> <color>")
+		}
+		duration, err := time.ParseDuration(fields[1])
+		if err != nil || duration <= 0 {
+			return command, fmt.Errorf("invalid duration %q", fields[1])
+		}
+		command.duration = duration
+		// Color names can have spaces in them, such as Red Flash.
+		command.color = strings.Join(fields[2:], " ")
+	case "profile":
+		if len(fields) != 2 {
+			return command, fmt.Errorf("usage: profile <name>")
+		}
+		command.profile = fields[1]
+	case "resume", "status", "dismiss":
+		if len(fields) != 1 {
+			return command, fmt.Errorf("usage: %v", command.name)
+		}
+	default:
+		return command, fmt.Errorf("unknown command %q", fields[0])
+	}
+	return command, nil
+}
+
+// startControlSocket listens on the Unix domain socket at path, and sends each command it receives on commands.  The
+// socket is removed when the program exits.
+func startControlSocket(path string, commands chan<- controlCommand) {
+	// A socket left behind by a previous run would stop us listening.
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatalf("Unable to listen on control socket %v: %v", path, err)
+	}
+	atExit(func() {
+		listener.Close()
+		os.Remove(path)
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				fmt.Fprintf(output.debug, "Control socket closed: %v\n", err)
+				return
+			}
+			go handleControlConnection(conn, commands)
+		}
+	}()
+}
+
+// handleControlConnection reads commands from a single connection until it is closed.
+func handleControlConnection(conn net.Conn, commands chan<- controlCommand) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		command, err := parseControlCommand(scanner.Text())
+		reply := ""
+		if err != nil {
+			reply = "error: " + err.Error()
+		} else {
+			command.reply = make(chan string, 1)
+			commands <- command
+			reply = <-command.reply
+		}
+		if _, err := fmt.Fprintln(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// QueryStatus asks the calblink already running with the same controlSocket what it is showing, for --status.
+func QueryStatus(userPrefs *UserPrefs) (string, error) {
+	if userPrefs.controlSocket == "" {
+		return "", fmt.Errorf("Unable to ask for the status: controlSocket isn't set in the config file")
+	}
+	reply, err := sendControlCommand(userPrefs.controlSocket, "status")
+	if err != nil {
+		return "", fmt.Errorf("Unable to reach calblink on control socket %v: %v", userPrefs.controlSocket, err)
+	}
+	return reply, nil
+}
+
+// sendControlCommand sends one command to the calblink listening on the control socket at path, and returns its reply.
+func sendControlCommand(path string, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(reply, "\n"), nil
+}
+
+// describeStatus is the reply to the status command.
+func describeStatus(displays []*deviceDisplay, snoozedUntil time.Time, override calendarState, overrideUntil time.Time) string {
+	var parts []string
+	for i, display := range displays {
+		part := fmt.Sprintf("device %v: %v", i, display.state.name)
+		if display.next != nil {
+			part += fmt.Sprintf(", next event %q from %v at %v", display.next.Summary, display.next.calendarID,
+				display.next.startTime.Format("15:04"))
+		}
+		if until := display.blinker.releasedUntil(); !until.IsZero() {
+			part += ", released until " + until.Format("15:04:05")
+		}
+		parts = append(parts, part)
+	}
+	if time.Now().Before(snoozedUntil) {
+		parts = append(parts, "snoozed until "+snoozedUntil.Format("15:04:05"))
+	}
+	if time.Now().Before(overrideUntil) {
+		parts = append(parts, fmt.Sprintf("overridden with %v until %v", override.name, overrideUntil.Format("15:04:05")))
+	}
+	return strings.Join(parts, "; ")
+}
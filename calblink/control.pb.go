@@ -0,0 +1,545 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The gRPC control interface, served on grpcPort.  It does what the control socket does, for programs that would rather
+// speak gRPC.  After changing this file, regenerate control.pb.go and control_grpc.pb.go with:
+//   protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: control.proto
+
+package calblink
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type GetStatusRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetStatusRequest) Reset() {
+	*x = GetStatusRequest{}
+	mi := &file_control_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetStatusRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetStatusRequest) ProtoMessage() {}
+
+func (x *GetStatusRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetStatusRequest.ProtoReflect.Descriptor instead.
+func (*GetStatusRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{0}
+}
+
+type StatusUpdatesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatusUpdatesRequest) Reset() {
+	*x = StatusUpdatesRequest{}
+	mi := &file_control_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatusUpdatesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatusUpdatesRequest) ProtoMessage() {}
+
+func (x *StatusUpdatesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatusUpdatesRequest.ProtoReflect.Descriptor instead.
+func (*StatusUpdatesRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{1}
+}
+
+type SnoozeRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Duration      *durationpb.Duration   `protobuf:"bytes,1,opt,name=duration,proto3" json:"duration,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SnoozeRequest) Reset() {
+	*x = SnoozeRequest{}
+	mi := &file_control_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SnoozeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SnoozeRequest) ProtoMessage() {}
+
+func (x *SnoozeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SnoozeRequest.ProtoReflect.Descriptor instead.
+func (*SnoozeRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *SnoozeRequest) GetDuration() *durationpb.Duration {
+	if x != nil {
+		return x.Duration
+	}
+	return nil
+}
+
+type ResumeRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ResumeRequest) Reset() {
+	*x = ResumeRequest{}
+	mi := &file_control_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ResumeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ResumeRequest) ProtoMessage() {}
+
+func (x *ResumeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ResumeRequest.ProtoReflect.Descriptor instead.
+func (*ResumeRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{3}
+}
+
+type SetOverrideColorRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Color         string                 `protobuf:"bytes,1,opt,name=color,proto3" json:"color,omitempty"`
+	Duration      *durationpb.Duration   `protobuf:"bytes,2,opt,name=duration,proto3" json:"duration,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetOverrideColorRequest) Reset() {
+	*x = SetOverrideColorRequest{}
+	mi := &file_control_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetOverrideColorRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetOverrideColorRequest) ProtoMessage() {}
+
+func (x *SetOverrideColorRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetOverrideColorRequest.ProtoReflect.Descriptor instead.
+func (*SetOverrideColorRequest) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *SetOverrideColorRequest) GetColor() string {
+	if x != nil {
+		return x.Color
+	}
+	return ""
+}
+
+func (x *SetOverrideColorRequest) GetDuration() *durationpb.Duration {
+	if x != nil {
+		return x.Duration
+	}
+	return nil
+}
+
+// CommandReply is the reply the control socket would have given.
+type CommandReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Message       string                 `protobuf:"bytes,1,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CommandReply) Reset() {
+	*x = CommandReply{}
+	mi := &file_control_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CommandReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CommandReply) ProtoMessage() {}
+
+func (x *CommandReply) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CommandReply.ProtoReflect.Descriptor instead.
+func (*CommandReply) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *CommandReply) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+// Status is the status document served on statusPort, with the reply to the control socket's status command as its
+// summary.  In privacyMode only the color of each device is filled in.
+type Status struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Devices       []*DeviceStatus        `protobuf:"bytes,1,rep,name=devices,proto3" json:"devices,omitempty"`
+	LastPoll      *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=last_poll,json=lastPoll,proto3" json:"last_poll,omitempty"`
+	Summary       string                 `protobuf:"bytes,3,opt,name=summary,proto3" json:"summary,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Status) Reset() {
+	*x = Status{}
+	mi := &file_control_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Status) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Status) ProtoMessage() {}
+
+func (x *Status) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Status.ProtoReflect.Descriptor instead.
+func (*Status) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Status) GetDevices() []*DeviceStatus {
+	if x != nil {
+		return x.Devices
+	}
+	return nil
+}
+
+func (x *Status) GetLastPoll() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastPoll
+	}
+	return nil
+}
+
+func (x *Status) GetSummary() string {
+	if x != nil {
+		return x.Summary
+	}
+	return ""
+}
+
+type DeviceStatus struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	Calendars         []string               `protobuf:"bytes,1,rep,name=calendars,proto3" json:"calendars,omitempty"`
+	Color             string                 `protobuf:"bytes,2,opt,name=color,proto3" json:"color,omitempty"`
+	NextEvent         string                 `protobuf:"bytes,3,opt,name=next_event,json=nextEvent,proto3" json:"next_event,omitempty"`
+	NextEventStart    *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=next_event_start,json=nextEventStart,proto3" json:"next_event_start,omitempty"`
+	NextEventCalendar string                 `protobuf:"bytes,5,opt,name=next_event_calendar,json=nextEventCalendar,proto3" json:"next_event_calendar,omitempty"`
+	MinutesUntilStart *int64                 `protobuf:"varint,6,opt,name=minutes_until_start,json=minutesUntilStart,proto3,oneof" json:"minutes_until_start,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *DeviceStatus) Reset() {
+	*x = DeviceStatus{}
+	mi := &file_control_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeviceStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeviceStatus) ProtoMessage() {}
+
+func (x *DeviceStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_control_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeviceStatus.ProtoReflect.Descriptor instead.
+func (*DeviceStatus) Descriptor() ([]byte, []int) {
+	return file_control_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *DeviceStatus) GetCalendars() []string {
+	if x != nil {
+		return x.Calendars
+	}
+	return nil
+}
+
+func (x *DeviceStatus) GetColor() string {
+	if x != nil {
+		return x.Color
+	}
+	return ""
+}
+
+func (x *DeviceStatus) GetNextEvent() string {
+	if x != nil {
+		return x.NextEvent
+	}
+	return ""
+}
+
+func (x *DeviceStatus) GetNextEventStart() *timestamppb.Timestamp {
+	if x != nil {
+		return x.NextEventStart
+	}
+	return nil
+}
+
+func (x *DeviceStatus) GetNextEventCalendar() string {
+	if x != nil {
+		return x.NextEventCalendar
+	}
+	return ""
+}
+
+func (x *DeviceStatus) GetMinutesUntilStart() int64 {
+	if x != nil && x.MinutesUntilStart != nil {
+		return *x.MinutesUntilStart
+	}
+	return 0
+}
+
+var File_control_proto protoreflect.FileDescriptor
+
+const file_control_proto_rawDesc = "" +
+	"\n" +
+	"\rcontrol.proto\x12\bcalblink\x1a\x1egoogle/protobuf/duration.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\x12\n" +
+	"\x10GetStatusRequest\"\x16\n" +
+	"\x14StatusUpdatesRequest\"F\n" +
+	"\rSnoozeRequest\x125\n" +
+	"\bduration\x18\x01 \x01(\v2\x19.google.protobuf.DurationR\bduration\"\x0f\n" +
+	"\rResumeRequest\"f\n" +
+	"\x17SetOverrideColorRequest\x12\x14\n" +
+	"\x05color\x18\x01 \x01(\tR\x05color\x125\n" +
+	"\bduration\x18\x02 \x01(\v2\x19.google.protobuf.DurationR\bduration\"(\n" +
+	"\fCommandReply\x12\x18\n" +
+	"\amessage\x18\x01 \x01(\tR\amessage\"\x8d\x01\n" +
+	"\x06Status\x120\n" +
+	"\adevices\x18\x01 \x03(\v2\x16.calblink.DeviceStatusR\adevices\x127\n" +
+	"\tlast_poll\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\blastPoll\x12\x18\n" +
+	"\asummary\x18\x03 \x01(\tR\asummary\"\xa4\x02\n" +
+	"\fDeviceStatus\x12\x1c\n" +
+	"\tcalendars\x18\x01 \x03(\tR\tcalendars\x12\x14\n" +
+	"\x05color\x18\x02 \x01(\tR\x05color\x12\x1d\n" +
+	"\n" +
+	"next_event\x18\x03 \x01(\tR\tnextEvent\x12D\n" +
+	"\x10next_event_start\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\x0enextEventStart\x12.\n" +
+	"\x13next_event_calendar\x18\x05 \x01(\tR\x11nextEventCalendar\x123\n" +
+	"\x13minutes_until_start\x18\x06 \x01(\x03H\x00R\x11minutesUntilStart\x88\x01\x01B\x16\n" +
+	"\x14_minutes_until_start2\xce\x02\n" +
+	"\aControl\x129\n" +
+	"\tGetStatus\x12\x1a.calblink.GetStatusRequest\x1a\x10.calblink.Status\x129\n" +
+	"\x06Snooze\x12\x17.calblink.SnoozeRequest\x1a\x16.calblink.CommandReply\x129\n" +
+	"\x06Resume\x12\x17.calblink.ResumeRequest\x1a\x16.calblink.CommandReply\x12M\n" +
+	"\x10SetOverrideColor\x12!.calblink.SetOverrideColorRequest\x1a\x16.calblink.CommandReply\x12C\n" +
+	"\rStatusUpdates\x12\x1e.calblink.StatusUpdatesRequest\x1a\x10.calblink.Status0\x01B\rZ\v./;calblinkb\x06proto3"
+
+var (
+	file_control_proto_rawDescOnce sync.Once
+	file_control_proto_rawDescData []byte
+)
+
+func file_control_proto_rawDescGZIP() []byte {
+	file_control_proto_rawDescOnce.Do(func() {
+		file_control_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_control_proto_rawDesc), len(file_control_proto_rawDesc)))
+	})
+	return file_control_proto_rawDescData
+}
+
+var file_control_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_control_proto_goTypes = []any{
+	(*GetStatusRequest)(nil),        // 0: calblink.GetStatusRequest
+	(*StatusUpdatesRequest)(nil),    // 1: calblink.StatusUpdatesRequest
+	(*SnoozeRequest)(nil),           // 2: calblink.SnoozeRequest
+	(*ResumeRequest)(nil),           // 3: calblink.ResumeRequest
+	(*SetOverrideColorRequest)(nil), // 4: calblink.SetOverrideColorRequest
+	(*CommandReply)(nil),            // 5: calblink.CommandReply
+	(*Status)(nil),                  // 6: calblink.Status
+	(*DeviceStatus)(nil),            // 7: calblink.DeviceStatus
+	(*durationpb.Duration)(nil),     // 8: google.protobuf.Duration
+	(*timestamppb.Timestamp)(nil),   // 9: google.protobuf.Timestamp
+}
+var file_control_proto_depIdxs = []int32{
+	8,  // 0: calblink.SnoozeRequest.duration:type_name -> google.protobuf.Duration
+	8,  // 1: calblink.SetOverrideColorRequest.duration:type_name -> google.protobuf.Duration
+	7,  // 2: calblink.Status.devices:type_name -> calblink.DeviceStatus
+	9,  // 3: calblink.Status.last_poll:type_name -> google.protobuf.Timestamp
+	9,  // 4: calblink.DeviceStatus.next_event_start:type_name -> google.protobuf.Timestamp
+	0,  // 5: calblink.Control.GetStatus:input_type -> calblink.GetStatusRequest
+	2,  // 6: calblink.Control.Snooze:input_type -> calblink.SnoozeRequest
+	3,  // 7: calblink.Control.Resume:input_type -> calblink.ResumeRequest
+	4,  // 8: calblink.Control.SetOverrideColor:input_type -> calblink.SetOverrideColorRequest
+	1,  // 9: calblink.Control.StatusUpdates:input_type -> calblink.StatusUpdatesRequest
+	6,  // 10: calblink.Control.GetStatus:output_type -> calblink.Status
+	5,  // 11: calblink.Control.Snooze:output_type -> calblink.CommandReply
+	5,  // 12: calblink.Control.Resume:output_type -> calblink.CommandReply
+	5,  // 13: calblink.Control.SetOverrideColor:output_type -> calblink.CommandReply
+	6,  // 14: calblink.Control.StatusUpdates:output_type -> calblink.Status
+	10, // [10:15] is the sub-list for method output_type
+	5,  // [5:10] is the sub-list for method input_type
+	5,  // [5:5] is the sub-list for extension type_name
+	5,  // [5:5] is the sub-list for extension extendee
+	0,  // [0:5] is the sub-list for field type_name
+}
+
+func init() { file_control_proto_init() }
+func file_control_proto_init() {
+	if File_control_proto != nil {
+		return
+	}
+	file_control_proto_msgTypes[7].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_control_proto_rawDesc), len(file_control_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_control_proto_goTypes,
+		DependencyIndexes: file_control_proto_depIdxs,
+		MessageInfos:      file_control_proto_msgTypes,
+	}.Build()
+	File_control_proto = out.File
+	file_control_proto_goTypes = nil
+	file_control_proto_depIdxs = nil
+}
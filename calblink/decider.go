@@ -0,0 +1,145 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The decider command lets a program of your own choose the color.  For each device, on every poll that gets as far as
+// the calendar, it is run with a deciderInput as JSON on stdin, and the first line it writes to stdout is the name of
+// the color to show, as in ColorRules.  It can also write "default", or nothing, to keep the color calblink chose.  If
+// it fails, takes longer than deciderTimeout, or names a color that doesn't exist, calblink's color is used.
+
+// deciderTimeout is how long the decider command can take before it is killed.
+const deciderTimeout = 5 * time.Second
+
+// deciderInput is what the decider command reads on stdin.  Event is null if there's no upcoming event.
+type deciderInput struct {
+	Time   string `json:"time"`
+	Device int    `json:"device"`
+	// Color is the color calblink would show without the decider.
+	Color string        `json:"color"`
+	Event *deciderEvent `json:"event"`
+}
+
+// deciderEvent is the next event, as the decider command sees it.  Start and End are RFC 3339 times, or YYYY-MM-DD
+// dates for all-day events.  MinutesUntilStart is negative once the event has started.
+type deciderEvent struct {
+	Summary           string  `json:"summary"`
+	Calendar          string  `json:"calendar"`
+	Start             string  `json:"start"`
+	End               string  `json:"end"`
+	AllDay            bool    `json:"allDay"`
+	MinutesUntilStart float64 `json:"minutesUntilStart"`
+	VideoCall         bool    `json:"videoCall"`
+	BusyCount         int     `json:"busyCount"`
+}
+
+// stateDecider runs the decider command.  It only remembers whether the last run failed, so that a command that keeps
+// failing is only logged once until it works again.
+type stateDecider struct {
+	failing bool
+}
+
+// decide returns the color the decider command chooses for the display, or state, calblink's own choice, if it doesn't
+// choose one.
+func (decider *stateDecider) decide(now time.Time, display int, next *upcomingEvent, state calendarState, userPrefs *UserPrefs) calendarState {
+	name, err := runDecider(userPrefs.deciderCommand, newDeciderInput(now, display, next, state))
+	if err == nil && name != "" && name != "default" {
+		chosen, ok := userPrefs.stateByName(name)
+		if ok {
+			fmt.Fprintf(output.debug, "Decider chose %v instead of %v\n", chosen.name, state.name)
+			state = chosen
+		} else {
+			err = fmt.Errorf("unknown color %q", name)
+		}
+	}
+	if err != nil {
+		if !decider.failing {
+			log.Printf("Decider command failed, using calblink's own colors until it works: %v", err)
+		}
+		fmt.Fprintf(output.debug, "Decider command failed: %v\n", err)
+	} else if decider.failing {
+		log.Printf("Decider command is working again")
+	}
+	decider.failing = err != nil
+	return state
+}
+
+func newDeciderInput(now time.Time, display int, next *upcomingEvent, state calendarState) deciderInput {
+	input := deciderInput{Time: now.Format(time.RFC3339), Device: display, Color: state.name}
+	if next == nil {
+		return input
+	}
+	input.Event = &deciderEvent{
+		Summary:           next.Summary,
+		Calendar:          next.calendarID,
+		AllDay:            isAllDayEvent(next.Event),
+		MinutesUntilStart: next.startTime.Sub(now).Minutes(),
+		VideoCall:         next.videoCall,
+		BusyCount:         next.busyCount,
+	}
+	if input.Event.AllDay {
+		input.Event.Start = next.Start.Date
+		input.Event.End = next.End.Date
+	} else {
+		input.Event.Start = next.Start.DateTime
+		input.Event.End = next.End.DateTime
+	}
+	return input
+}
+
+// runDecider runs the command with the input on stdin, and returns the first line of its output, trimmed.
+func runDecider(command []string, input deciderInput) (string, error) {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			if message := strings.TrimSpace(stderr.String()); message != "" {
+				return "", fmt.Errorf("%v: %v", err, message)
+			}
+			return "", err
+		}
+	case <-time.After(deciderTimeout):
+		cmd.Process.Kill()
+		<-done
+		return "", fmt.Errorf("timed out after %v", deciderTimeout)
+	}
+	line, _ := bufio.NewReader(&stdout).ReadString('\n')
+	return strings.TrimSpace(line), nil
+}
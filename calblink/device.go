@@ -0,0 +1,400 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/boombuler/hid"
+	blink1 "github.com/hink/go-blink1"
+)
+
+// Device is a USB light that calblink can drive.  Colors are given as blink(1) states, which carry the LED to set
+// and the fade time; devices that can't fade or address single LEDs do the best they can.
+type Device interface {
+	SetColor(state blink1.State) error
+	Off() error
+	Close() error
+	// Serial returns the device's USB serial number, or "" if it can't be read.
+	Serial() string
+}
+
+// patternDevice is a light that can store a sequence of colors and play it by itself, so that a flashing color keeps
+// flashing even if calblink stalls.
+type patternDevice interface {
+	Device
+	// WritePatternLine stores a color at position pos of the pattern.  Playing the line fades to the color over its
+	// FadeTime, and then goes on to the next line.
+	WritePatternLine(pos int, state blink1.State) error
+	// PlayPattern plays the lines from start to end, over and over, until the color is next set.
+	PlayPattern(start, end int) error
+}
+
+// deviceType is an enumerated list of the kinds of light that calblink can drive.
+type deviceType string
+
+const (
+	deviceBlink1  = deviceType("blink1")
+	deviceLuxafor = deviceType("luxafor")
+)
+
+func (device deviceType) isValidDeviceType() bool {
+	switch device {
+	case deviceBlink1:
+		return true
+	case deviceLuxafor:
+		return true
+	}
+	return false
+}
+
+// deviceOpener returns the function that opens a device of the kind the user's prefs ask for: the one with the given
+// serial number, or the next one that isn't in use if the serial is "".  Each device is calibrated as the user's prefs
+// say for its serial number.  A dry run has no colors to calibrate.
+func deviceOpener(userPrefs *UserPrefs) func(serial string) (Device, error) {
+	if userPrefs.dryRun {
+		return func(serial string) (Device, error) {
+			return dryRunDevice{}, nil
+		}
+	}
+	open := func(serial string) (Device, error) {
+		return openBlink1Device()
+	}
+	switch {
+	case userPrefs.simulate:
+		open = func(serial string) (Device, error) {
+			return openSimulatedDevice(serial), nil
+		}
+	case userPrefs.deviceType == deviceLuxafor:
+		open = openLuxaforDevice
+	case userPrefs.devicePatterns:
+		open = openBlink1PatternDevice
+	case len(userPrefs.deviceAssignments) > 0 || len(userPrefs.deviceCalibration) > 0:
+		// go-blink1 can't tell the devices apart, so they are opened directly to read their serial numbers.
+		open = openBlink1HIDDevice
+	}
+	if len(userPrefs.deviceCalibration) == 0 {
+		return open
+	}
+	return func(serial string) (Device, error) {
+		device, err := open(serial)
+		if err != nil {
+			return nil, err
+		}
+		calibration, ok := userPrefs.deviceCalibration[device.Serial()]
+		if !ok || calibration == identityCalibration {
+			return device, nil
+		}
+		return calibrate(device, calibration), nil
+	}
+}
+
+// calibration corrects the colors sent to a device, so that devices that show the same color differently can be made to
+// match.  Each channel is raised to the power gamma, as a fraction of full, and then scaled by its factor.
+type calibration struct {
+	red, green, blue float64
+	gamma            float64
+}
+
+// identityCalibration leaves colors as they are.
+var identityCalibration = calibration{red: 1, green: 1, blue: 1, gamma: 1}
+
+// apply returns the state with its colors calibrated.  Off stays off.
+func (calibration calibration) apply(state blink1.State) blink1.State {
+	channel := func(value uint8, scale float64) uint8 {
+		return uint8(math.Round(255 * math.Pow(float64(value)/255, calibration.gamma) * scale))
+	}
+	state.Red = channel(state.Red, calibration.red)
+	state.Green = channel(state.Green, calibration.green)
+	state.Blue = channel(state.Blue, calibration.blue)
+	return state
+}
+
+// calibratedDevice calibrates every color before passing it on to the device.
+type calibratedDevice struct {
+	Device
+	calibration calibration
+}
+
+// calibratedPatternDevice is a calibratedDevice for a device that can play patterns, which calibrates the lines of the
+// pattern as well.
+type calibratedPatternDevice struct {
+	calibratedDevice
+	pattern patternDevice
+}
+
+// calibrate wraps the device so that its colors are calibrated, keeping its ability to play patterns if it has one.
+func calibrate(device Device, calibration calibration) Device {
+	calibrated := calibratedDevice{Device: device, calibration: calibration}
+	if pattern, ok := device.(patternDevice); ok {
+		return &calibratedPatternDevice{calibratedDevice: calibrated, pattern: pattern}
+	}
+	return &calibrated
+}
+
+func (device *calibratedDevice) SetColor(state blink1.State) error {
+	return device.Device.SetColor(device.calibration.apply(state))
+}
+
+func (device *calibratedPatternDevice) WritePatternLine(pos int, state blink1.State) error {
+	return device.pattern.WritePatternLine(pos, device.calibration.apply(state))
+}
+
+func (device *calibratedPatternDevice) PlayPattern(start, end int) error {
+	return device.pattern.PlayPattern(start, end)
+}
+
+var (
+	// openHIDPaths holds the paths of the devices that openHIDDevice has opened and that are still in use, so that each
+	// call opens a different one, as blink1.OpenNextDevice does.
+	openHIDPathsMu sync.Mutex
+	openHIDPaths   = make(map[string]bool)
+)
+
+// openHIDDevice opens the device with the given USB IDs and serial number, or the next one that isn't already in use if
+// serial is "", and returns it along with the information about it; closeHIDDevice needs its path.  Name is what the
+// device is called in the error if there isn't one.
+func openHIDDevice(vendorID, productID uint16, serial string, name string) (hid.Device, *hid.DeviceInfo, error) {
+	openHIDPathsMu.Lock()
+	defer openHIDPathsMu.Unlock()
+	var found *hid.DeviceInfo
+	// Read the whole list, rather than stopping at the first match, so that the enumeration isn't left blocked.
+	for info := range hid.FindDevices(vendorID, productID) {
+		if found == nil && !openHIDPaths[info.Path] && (serial == "" || info.SerialNumber == serial) {
+			found = info
+		}
+	}
+	if found == nil && serial != "" {
+		return nil, nil, fmt.Errorf("no %v with serial number %v found", name, serial)
+	}
+	if found == nil {
+		return nil, nil, fmt.Errorf("no %v found", name)
+	}
+	device, err := found.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	openHIDPaths[found.Path] = true
+	return device, found, nil
+}
+
+// closeHIDDevice closes a device opened by openHIDDevice.
+func closeHIDDevice(device hid.Device, path string) {
+	device.Close()
+	openHIDPathsMu.Lock()
+	defer openHIDPathsMu.Unlock()
+	delete(openHIDPaths, path)
+}
+
+// blink1Device is a blink(1).
+type blink1Device struct {
+	device *blink1.Device
+}
+
+func openBlink1Device() (Device, error) {
+	device, err := blink1.OpenNextDevice()
+	if err != nil {
+		return nil, err
+	}
+	return &blink1Device{device: device}, nil
+}
+
+func (device *blink1Device) SetColor(state blink1.State) error {
+	return device.device.SetState(state)
+}
+
+func (device *blink1Device) Off() error {
+	return device.device.SetState(blink1.OffState)
+}
+
+func (device *blink1Device) Close() error {
+	device.device.Close()
+	return nil
+}
+
+// Serial is always "", since go-blink1 doesn't read it; see blink1HIDDevice.
+func (device *blink1Device) Serial() string {
+	return ""
+}
+
+// The blink(1)'s USB IDs, and the commands blink1HIDDevice uses.  Each command is a HID feature report: the report
+// ID, the command, and up to 7 bytes of arguments.  Times are in units of 10 milliseconds.
+const (
+	blink1VendorID  = 0x27b8
+	blink1ProductID = 0x01ed
+
+	blink1ReportID           = 1
+	blink1CommandFade        = 'c' // r, g, b, time high, time low, LED
+	blink1CommandPatternLine = 'P' // r, g, b, time high, time low, position
+	blink1CommandPlay        = 'p' // 1 to play or 0 to stop, start, end, count (0 is forever)
+)
+
+// blink1HIDDevice is a blink(1) driven with its own commands, rather than through go-blink1, so that it can be told
+// apart from the others by its serial number.
+type blink1HIDDevice struct {
+	device hid.Device
+	path   string
+	serial string
+}
+
+func openBlink1HIDDevice(serial string) (Device, error) {
+	device, err := newBlink1HIDDevice(serial)
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func newBlink1HIDDevice(serial string) (*blink1HIDDevice, error) {
+	device, info, err := openHIDDevice(blink1VendorID, blink1ProductID, serial, "blink(1)")
+	if err != nil {
+		return nil, err
+	}
+	return &blink1HIDDevice{device: device, path: info.Path, serial: info.SerialNumber}, nil
+}
+
+func (device *blink1HIDDevice) command(command byte, args ...byte) error {
+	report := make([]byte, 9)
+	report[0] = blink1ReportID
+	report[1] = command
+	copy(report[2:], args)
+	return device.device.WriteFeature(report)
+}
+
+// blink1Time splits a duration into the high and low bytes of a time in blink(1) units.
+func blink1Time(d time.Duration) (byte, byte) {
+	units := d / (10 * time.Millisecond)
+	if units > 0xffff {
+		units = 0xffff
+	}
+	return byte(units >> 8), byte(units)
+}
+
+func (device *blink1HIDDevice) SetColor(state blink1.State) error {
+	high, low := blink1Time(state.FadeTime)
+	return device.command(blink1CommandFade, state.Red, state.Green, state.Blue, high, low, byte(state.LED))
+}
+
+func (device *blink1HIDDevice) Off() error {
+	return device.SetColor(blink1.OffState)
+}
+
+func (device *blink1HIDDevice) Close() error {
+	closeHIDDevice(device.device, device.path)
+	return nil
+}
+
+func (device *blink1HIDDevice) Serial() string {
+	return device.serial
+}
+
+// blink1PatternDevice is a blink1HIDDevice that can store and play patterns.  The mk1 can't play just part of its
+// pattern, so it must not be used with one.
+type blink1PatternDevice struct {
+	*blink1HIDDevice
+	// playing is set while the device is playing a pattern, which has to be stopped before it is given a color.
+	playing bool
+}
+
+func openBlink1PatternDevice(serial string) (Device, error) {
+	device, err := newBlink1HIDDevice(serial)
+	if err != nil {
+		return nil, err
+	}
+	return &blink1PatternDevice{blink1HIDDevice: device}, nil
+}
+
+func (device *blink1PatternDevice) SetColor(state blink1.State) error {
+	if device.playing {
+		if err := device.command(blink1CommandPlay, 0); err != nil {
+			return err
+		}
+		device.playing = false
+	}
+	return device.blink1HIDDevice.SetColor(state)
+}
+
+func (device *blink1PatternDevice) Off() error {
+	return device.SetColor(blink1.OffState)
+}
+
+// WritePatternLine stores the color for both LEDs; the state's LED is ignored.
+func (device *blink1PatternDevice) WritePatternLine(pos int, state blink1.State) error {
+	high, low := blink1Time(state.FadeTime)
+	return device.command(blink1CommandPatternLine, state.Red, state.Green, state.Blue, high, low, byte(pos))
+}
+
+func (device *blink1PatternDevice) PlayPattern(start, end int) error {
+	if err := device.command(blink1CommandPlay, 1, byte(start), byte(end), 0); err != nil {
+		return err
+	}
+	device.playing = true
+	return nil
+}
+
+// The Luxafor flag's USB IDs, and the LED groups its static color command can address.
+const (
+	luxaforVendorID  = 0x04d8
+	luxaforProductID = 0xf372
+
+	luxaforCommandColor = 0x01
+	luxaforAllLEDs      = 0xff
+	luxaforFrontLEDs    = 0x41
+	luxaforBackLEDs     = 0x42
+)
+
+// luxaforDevice is a Luxafor flag.  It has no fade command that matches the blink(1)'s, so colors are set instantly.
+// The blink(1)'s LED 1 and LED 2 map to the front and back of the flag.
+type luxaforDevice struct {
+	device hid.Device
+	path   string
+	serial string
+}
+
+func openLuxaforDevice(serial string) (Device, error) {
+	device, info, err := openHIDDevice(luxaforVendorID, luxaforProductID, serial, "Luxafor flag")
+	if err != nil {
+		return nil, err
+	}
+	return &luxaforDevice{device: device, path: info.Path, serial: info.SerialNumber}, nil
+}
+
+func (device *luxaforDevice) SetColor(state blink1.State) error {
+	led := byte(luxaforAllLEDs)
+	switch state.LED {
+	case blink1.LED1:
+		led = luxaforFrontLEDs
+	case blink1.LED2:
+		led = luxaforBackLEDs
+	}
+	// The leading 0 is the HID report ID, which the flag doesn't use.
+	return device.device.Write([]byte{0, luxaforCommandColor, led, state.Red, state.Green, state.Blue, 0, 0, 0})
+}
+
+func (device *luxaforDevice) Off() error {
+	return device.SetColor(blink1.OffState)
+}
+
+func (device *luxaforDevice) Close() error {
+	closeHIDDevice(device.device, device.path)
+	return nil
+}
+
+func (device *luxaforDevice) Serial() string {
+	return device.serial
+}
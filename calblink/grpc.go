@@ -0,0 +1,169 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// controlServer serves the gRPC control interface in control.proto.  Each call is carried out by the main loop, as a
+// command from the control socket is, so both act on the same state.
+type controlServer struct {
+	UnimplementedControlServer
+	board       *statusBoard
+	commands    chan<- controlCommand
+	privacyMode bool
+}
+
+// startGRPCServer serves the gRPC control interface on the given address and port in the background, and arranges for
+// the server to shut down when the program exits.  The server has no authentication or TLS, which is why it listens on
+// localhost unless the user asks for another address.
+func startGRPCServer(address string, port int, board *statusBoard, commands chan<- controlCommand, privacyMode bool) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+	if err != nil {
+		log.Fatalf("Unable to listen on gRPC address %v port %v: %v", address, port, err)
+	}
+	server := newGRPCServer(board, commands, privacyMode)
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Printf("gRPC server failed: %v", err)
+		}
+	}()
+	// Stop rather than GracefulStop, since StatusUpdates streams never finish by themselves.
+	atExit(server.Stop)
+}
+
+func newGRPCServer(board *statusBoard, commands chan<- controlCommand, privacyMode bool) *grpc.Server {
+	server := grpc.NewServer()
+	RegisterControlServer(server, &controlServer{board: board, commands: commands, privacyMode: privacyMode})
+	return server
+}
+
+// run has the main loop carry out the command, and returns its reply.  A reply that says the command failed is turned
+// into an error.
+func (server *controlServer) run(ctx context.Context, command controlCommand) (string, error) {
+	command.reply = make(chan string, 1)
+	select {
+	case server.commands <- command:
+	case <-ctx.Done():
+		return "", status.FromContextError(ctx.Err()).Err()
+	}
+	select {
+	case reply := <-command.reply:
+		if strings.HasPrefix(reply, "error: ") {
+			return "", status.Error(codes.FailedPrecondition, strings.TrimPrefix(reply, "error: "))
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return "", status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+func (server *controlServer) GetStatus(ctx context.Context, request *GetStatusRequest) (*Status, error) {
+	return server.status(ctx)
+}
+
+// status returns the status board, with the reply to the status command as its summary.
+func (server *controlServer) status(ctx context.Context) (*Status, error) {
+	summary, err := server.run(ctx, controlCommand{name: "status"})
+	if err != nil {
+		return nil, err
+	}
+	doc := server.board.document(server.privacyMode)
+	result := &Status{Summary: summary}
+	if doc.LastPoll != nil {
+		result.LastPoll = timestamppb.New(*doc.LastPoll)
+	}
+	for _, device := range doc.Devices {
+		deviceStatus := &DeviceStatus{
+			Calendars:         device.Calendars,
+			Color:             device.Color,
+			NextEvent:         device.NextEvent,
+			NextEventCalendar: device.NextEventCalendar,
+			MinutesUntilStart: device.MinutesUntilStart,
+		}
+		if device.NextEventStart != nil {
+			deviceStatus.NextEventStart = timestamppb.New(*device.NextEventStart)
+		}
+		result.Devices = append(result.Devices, deviceStatus)
+	}
+	return result, nil
+}
+
+func (server *controlServer) Snooze(ctx context.Context, request *SnoozeRequest) (*CommandReply, error) {
+	duration := request.GetDuration().AsDuration()
+	if duration <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid duration %v", duration)
+	}
+	reply, err := server.run(ctx, controlCommand{name: "snooze", duration: duration})
+	if err != nil {
+		return nil, err
+	}
+	return &CommandReply{Message: reply}, nil
+}
+
+func (server *controlServer) Resume(ctx context.Context, request *ResumeRequest) (*CommandReply, error) {
+	reply, err := server.run(ctx, controlCommand{name: "resume"})
+	if err != nil {
+		return nil, err
+	}
+	return &CommandReply{Message: reply}, nil
+}
+
+func (server *controlServer) SetOverrideColor(ctx context.Context, request *SetOverrideColorRequest) (*CommandReply, error) {
+	duration := request.GetDuration().AsDuration()
+	if duration <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid duration %v", duration)
+	}
+	if request.GetColor() == "" {
+		return nil, status.Error(codes.InvalidArgument, "no color")
+	}
+	reply, err := server.run(ctx, controlCommand{name: "override", duration: duration, color: request.GetColor()})
+	if err != nil {
+		return nil, err
+	}
+	return &CommandReply{Message: reply}, nil
+}
+
+// StatusUpdates sends the status straight away, and again each time the state of a device changes, until the client
+// goes away or the server stops.
+func (server *controlServer) StatusUpdates(request *StatusUpdatesRequest, stream Control_StatusUpdatesServer) error {
+	ctx := stream.Context()
+	for {
+		// Watch for changes before reading the status, so that none are missed in between.
+		changes := server.board.changes()
+		current, err := server.status(ctx)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(current); err != nil {
+			return err
+		}
+		select {
+		case <-changes:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// startTestGRPCServer serves the control interface over an in-memory connection, and returns a client for it along with
+// the channel its commands arrive on, in place of the main loop.
+func startTestGRPCServer(t *testing.T, board *statusBoard) (ControlClient, <-chan controlCommand) {
+	commands := make(chan controlCommand)
+	listener := bufconn.Listen(1 << 16)
+	server := newGRPCServer(board, commands, false)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewControlClient(conn), commands
+}
+
+// answer replies to each command as the main loop would, with reply, until the test ends.
+func answer(t *testing.T, commands <-chan controlCommand, reply func(controlCommand) string) {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case command := <-commands:
+				command.reply <- reply(command)
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func TestGRPCCommands(t *testing.T) {
+	client, commands := startTestGRPCServer(t, &statusBoard{})
+	var got []controlCommand
+	answer(t, commands, func(command controlCommand) string {
+		got = append(got, command)
+		if command.color == "Plaid" {
+			return `error: unknown color "Plaid"`
+		}
+		return "done " + command.name
+	})
+	ctx := context.Background()
+	reply, err := client.Snooze(ctx, &SnoozeRequest{Duration: durationpb.New(30 * time.Minute)})
+	if err != nil || reply.Message != "done snooze" {
+		t.Errorf("Snooze = %v, %v", reply, err)
+	}
+	if _, err := client.Snooze(ctx, &SnoozeRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Snooze with no duration = %v, want InvalidArgument", err)
+	}
+	reply, err = client.SetOverrideColor(ctx, &SetOverrideColorRequest{Color: "Red Flash", Duration: durationpb.New(time.Hour)})
+	if err != nil || reply.Message != "done override" {
+		t.Errorf("SetOverrideColor = %v, %v", reply, err)
+	}
+	if _, err := client.SetOverrideColor(ctx, &SetOverrideColorRequest{Color: "Plaid", Duration: durationpb.New(time.Hour)}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("SetOverrideColor with an unknown color = %v, want FailedPrecondition", err)
+	}
+	if reply, err := client.Resume(ctx, &ResumeRequest{}); err != nil || reply.Message != "done resume" {
+		t.Errorf("Resume = %v, %v", reply, err)
+	}
+	want := []controlCommand{
+		{name: "snooze", duration: 30 * time.Minute},
+		{name: "override", duration: time.Hour, color: "Red Flash"},
+		{name: "override", duration: time.Hour, color: "Plaid"},
+		{name: "resume"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("main loop got %v commands, want %v", len(got), len(want))
+	}
+	for i := range want {
+		got[i].reply = nil
+		if got[i] != want[i] {
+			t.Errorf("command %v = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestGRPCStatusUpdates(t *testing.T) {
+	board := &statusBoard{}
+	display := &deviceDisplay{calendars: []string{"primary"}, state: green}
+	board.update([]*deviceDisplay{display})
+	client, commands := startTestGRPCServer(t, board)
+	answer(t, commands, func(command controlCommand) string { return "all well" })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.StatusUpdates(ctx, &StatusUpdatesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Devices) != 1 || first.Devices[0].Color != "Green" || first.Summary != "all well" {
+		t.Errorf("first status = %v", first)
+	}
+	display.state = red
+	board.update([]*deviceDisplay{display})
+	second, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second.Devices) != 1 || second.Devices[0].Color != "Red" {
+		t.Errorf("status after the change = %v", second)
+	}
+}
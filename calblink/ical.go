@@ -0,0 +1,597 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+// A minimal iCalendar (RFC 5545) reader, covering the parts of VEVENT that calblink needs: start and end times (with
+// time zones), recurrence rules and exceptions, attendees and transparency.  Events are converted to calendar.Event so
+// that the rest of calblink can treat them exactly like Google Calendar events.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// icalProperty is a single content line, after unfolding.
+type icalProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// icalAttendee is an ATTENDEE of an event.
+type icalAttendee struct {
+	email    string
+	partstat string
+}
+
+// icalEvent is a VEVENT, reduced to the properties calblink uses.
+type icalEvent struct {
+	uid          string
+	summary      string
+	description  string
+	location     string
+	status       string
+	transparency string
+	start        time.Time
+	end          time.Time
+	allDay       bool
+	rrule        string
+	exdates      []time.Time
+	recurrenceID *time.Time
+	organizer    string
+	attendees    []icalAttendee
+}
+
+// maxRecurrences bounds how many occurrences of a single recurring event are generated, so that a bad rule can't hang us.
+const maxRecurrences = 10000
+
+// readICalLines reads and unfolds the content lines of an iCalendar stream.
+func readICalLines(r io.Reader) ([]icalProperty, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	properties := make([]icalProperty, 0, len(lines))
+	for _, line := range lines {
+		property, err := parseICalLine(line)
+		if err != nil {
+			return nil, err
+		}
+		properties = append(properties, property)
+	}
+	return properties, nil
+}
+
+// parseICalLine splits a content line into its name, parameters and value.
+func parseICalLine(line string) (icalProperty, error) {
+	property := icalProperty{params: make(map[string]string)}
+	// The value starts at the first colon that isn't inside a quoted parameter value.
+	inQuotes := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			inQuotes = !inQuotes
+		} else if c == ':' && !inQuotes {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return property, fmt.Errorf("Invalid iCalendar line %q", line)
+	}
+	property.value = line[colon+1:]
+	parts := strings.Split(line[:colon], ";")
+	property.name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		if eq := strings.Index(param, "="); eq >= 0 {
+			property.params[strings.ToUpper(param[:eq])] = strings.Trim(param[eq+1:], "\"")
+		}
+	}
+	return property, nil
+}
+
+// unescapeICalText undoes the escaping of TEXT values.
+func unescapeICalText(value string) string {
+	replacer := strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+	return replacer.Replace(value)
+}
+
+// parseICalTime parses a DATE or DATE-TIME value.  Times ending in Z are UTC, times with a TZID are in that zone, and
+// floating times are in local time.  Unknown time zones are treated as local time.
+func parseICalTime(property icalProperty) (t time.Time, allDay bool, err error) {
+	value := property.value
+	if property.params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err = time.ParseInLocation("20060102", value, time.Local)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	location := time.Local
+	if tzid := property.params["TZID"]; tzid != "" {
+		if loc, err := time.LoadLocation(tzid); err == nil {
+			location = loc
+		} else {
+			fmt.Fprintf(output.debug, "Unknown time zone %v, using local time\n", tzid)
+		}
+	}
+	t, err = time.ParseInLocation("20060102T150405", value, location)
+	return t, false, err
+}
+
+// parseICalDuration parses a DURATION value such as PT1H30M or -P1D.
+func parseICalDuration(value string) (time.Duration, error) {
+	sign := time.Duration(1)
+	if strings.HasPrefix(value, "-") {
+		sign = -1
+		value = value[1:]
+	} else {
+		value = strings.TrimPrefix(value, "+")
+	}
+	if !strings.HasPrefix(value, "P") {
+		return 0, fmt.Errorf("Invalid duration %q", value)
+	}
+	var duration time.Duration
+	inTime := false
+	number := ""
+	for _, c := range value[1:] {
+		switch {
+		case c >= '0' && c <= '9':
+			number += string(c)
+			continue
+		case c == 'T':
+			inTime = true
+			continue
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid duration %q", value)
+		}
+		number = ""
+		unit := time.Duration(0)
+		switch {
+		case c == 'W' && !inTime:
+			unit = 7 * 24 * time.Hour
+		case c == 'D' && !inTime:
+			unit = 24 * time.Hour
+		case c == 'H' && inTime:
+			unit = time.Hour
+		case c == 'M' && inTime:
+			unit = time.Minute
+		case c == 'S' && inTime:
+			unit = time.Second
+		default:
+			return 0, fmt.Errorf("Invalid duration %q", value)
+		}
+		duration += time.Duration(n) * unit
+	}
+	return sign * duration, nil
+}
+
+// parseICalEvents reads all the VEVENTs in an iCalendar stream.
+func parseICalEvents(r io.Reader) ([]*icalEvent, error) {
+	properties, err := readICalLines(r)
+	if err != nil {
+		return nil, err
+	}
+	var events []*icalEvent
+	var event *icalEvent
+	var duration *time.Duration
+	// Nested components such as VALARM have properties of their own that mustn't be mistaken for the event's.
+	depth := 0
+	for _, property := range properties {
+		switch {
+		case property.name == "BEGIN" && strings.ToUpper(property.value) == "VEVENT":
+			event = &icalEvent{}
+			duration = nil
+			depth = 0
+			continue
+		case event == nil:
+			continue
+		case property.name == "BEGIN":
+			depth++
+			continue
+		case property.name == "END" && depth > 0:
+			depth--
+			continue
+		case property.name == "END" && strings.ToUpper(property.value) == "VEVENT":
+			if event.start.IsZero() {
+				fmt.Fprintf(output.debug, "Skipping iCalendar event %q with no start time\n", event.summary)
+			} else {
+				if event.end.IsZero() {
+					switch {
+					case duration != nil:
+						event.end = event.start.Add(*duration)
+					case event.allDay:
+						event.end = event.start.AddDate(0, 0, 1)
+					default:
+						event.end = event.start
+					}
+				}
+				events = append(events, event)
+			}
+			event = nil
+			continue
+		case depth > 0:
+			continue
+		}
+		switch property.name {
+		case "UID":
+			event.uid = property.value
+		case "SUMMARY":
+			event.summary = unescapeICalText(property.value)
+		case "DESCRIPTION":
+			event.description = unescapeICalText(property.value)
+		case "LOCATION":
+			event.location = unescapeICalText(property.value)
+		case "STATUS":
+			event.status = strings.ToUpper(property.value)
+		case "TRANSP":
+			event.transparency = strings.ToUpper(property.value)
+		case "DTSTART":
+			event.start, event.allDay, err = parseICalTime(property)
+		case "DTEND":
+			event.end, _, err = parseICalTime(property)
+		case "DURATION":
+			var d time.Duration
+			d, err = parseICalDuration(property.value)
+			duration = &d
+		case "RRULE":
+			event.rrule = property.value
+		case "EXDATE":
+			for _, value := range strings.Split(property.value, ",") {
+				var exdate time.Time
+				exdate, _, err = parseICalTime(icalProperty{name: property.name, params: property.params, value: value})
+				if err != nil {
+					break
+				}
+				event.exdates = append(event.exdates, exdate)
+			}
+		case "RECURRENCE-ID":
+			var recurrenceID time.Time
+			recurrenceID, _, err = parseICalTime(property)
+			event.recurrenceID = &recurrenceID
+		case "ORGANIZER":
+			event.organizer = icalAddress(property.value)
+		case "ATTENDEE":
+			email := icalAddress(property.value)
+			event.attendees = append(event.attendees, icalAttendee{email: email, partstat: strings.ToUpper(property.params["PARTSTAT"])})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v in iCalendar event %q: %v", property.name, event.summary, err)
+		}
+	}
+	return events, nil
+}
+
+// icalAddress returns the email address in an ORGANIZER or ATTENDEE value, which is usually a mailto: URI.
+func icalAddress(value string) string {
+	if strings.HasPrefix(strings.ToLower(value), "mailto:") {
+		return value[len("mailto:"):]
+	}
+	return value
+}
+
+// recurrenceRule is a parsed RRULE.  Only the parts calblink supports are kept; see occurrences.
+type recurrenceRule struct {
+	freq       string
+	interval   int
+	count      int
+	until      *time.Time
+	byDay      []weekdayNum
+	byMonthDay []int
+}
+
+// weekdayNum is an entry in BYDAY, such as MO, 2TU or -1FR.  N is 0 when there's no ordinal.
+type weekdayNum struct {
+	n       int
+	weekday time.Weekday
+}
+
+var icalWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// parseRecurrenceRule parses an RRULE value.  Start is the event's DTSTART, which UNTIL values are interpreted against.
+func parseRecurrenceRule(value string, start time.Time) (*recurrenceRule, error) {
+	rule := &recurrenceRule{interval: 1}
+	for _, part := range strings.Split(value, ";") {
+		eq := strings.Index(part, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("Invalid RRULE %q", value)
+		}
+		name, arg := strings.ToUpper(part[:eq]), part[eq+1:]
+		var err error
+		switch name {
+		case "FREQ":
+			rule.freq = strings.ToUpper(arg)
+		case "INTERVAL":
+			rule.interval, err = strconv.Atoi(arg)
+			if err == nil && rule.interval < 1 {
+				err = fmt.Errorf("interval must be positive")
+			}
+		case "COUNT":
+			rule.count, err = strconv.Atoi(arg)
+		case "UNTIL":
+			var until time.Time
+			var untilDate bool
+			until, untilDate, err = parseICalTime(icalProperty{params: map[string]string{"TZID": start.Location().String()}, value: arg})
+			if untilDate {
+				// A date is inclusive, so allow occurrences at any time that day.
+				until = until.AddDate(0, 0, 1).Add(-time.Second)
+			}
+			rule.until = &until
+		case "BYDAY":
+			for _, day := range strings.Split(arg, ",") {
+				if len(day) < 2 {
+					return nil, fmt.Errorf("Invalid BYDAY in RRULE %q", value)
+				}
+				weekday, ok := icalWeekdays[strings.ToUpper(day[len(day)-2:])]
+				if !ok {
+					return nil, fmt.Errorf("Invalid BYDAY in RRULE %q", value)
+				}
+				n := 0
+				if len(day) > 2 {
+					n, err = strconv.Atoi(day[:len(day)-2])
+				}
+				rule.byDay = append(rule.byDay, weekdayNum{n: n, weekday: weekday})
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(arg, ",") {
+				var n int
+				n, err = strconv.Atoi(day)
+				if err != nil {
+					break
+				}
+				rule.byMonthDay = append(rule.byMonthDay, n)
+			}
+		default:
+			fmt.Fprintf(output.debug, "Ignoring unsupported RRULE part %v\n", part)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v in RRULE %q: %v", name, value, err)
+		}
+	}
+	switch rule.freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+	default:
+		return nil, fmt.Errorf("Unsupported FREQ in RRULE %q", value)
+	}
+	return rule, nil
+}
+
+// atTimeOfDay returns the given day at the same wall-clock time as t, in t's location.
+func atTimeOfDay(year int, month time.Month, day int, t time.Time) time.Time {
+	return time.Date(year, month, day, t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+}
+
+// candidates returns the possible occurrences in the period'th period (day, week, month or year, depending on the
+// frequency) after the one containing start.
+func (rule *recurrenceRule) candidates(start time.Time, period int) []time.Time {
+	switch rule.freq {
+	case "DAILY":
+		return []time.Time{start.AddDate(0, 0, period)}
+	case "WEEKLY":
+		if len(rule.byDay) == 0 {
+			return []time.Time{start.AddDate(0, 0, 7*period)}
+		}
+		// Weeks start on Monday.
+		offset := (int(start.Weekday()) + 6) % 7
+		monday := start.AddDate(0, 0, 7*period-offset)
+		var days []time.Time
+		for _, day := range rule.byDay {
+			days = append(days, monday.AddDate(0, 0, (int(day.weekday)+6)%7))
+		}
+		return days
+	case "MONTHLY":
+		first := time.Date(start.Year(), start.Month()+time.Month(period), 1, 0, 0, 0, 0, start.Location())
+		daysInMonth := first.AddDate(0, 1, -1).Day()
+		var days []time.Time
+		for _, n := range rule.byMonthDay {
+			if n < 0 {
+				n = daysInMonth + n + 1
+			}
+			if n >= 1 && n <= daysInMonth {
+				days = append(days, atTimeOfDay(first.Year(), first.Month(), n, start))
+			}
+		}
+		for _, day := range rule.byDay {
+			var matches []int
+			for d := 1; d <= daysInMonth; d++ {
+				if time.Date(first.Year(), first.Month(), d, 0, 0, 0, 0, start.Location()).Weekday() == day.weekday {
+					matches = append(matches, d)
+				}
+			}
+			switch {
+			case day.n == 0:
+				for _, d := range matches {
+					days = append(days, atTimeOfDay(first.Year(), first.Month(), d, start))
+				}
+			case day.n > 0 && day.n <= len(matches):
+				days = append(days, atTimeOfDay(first.Year(), first.Month(), matches[day.n-1], start))
+			case day.n < 0 && -day.n <= len(matches):
+				days = append(days, atTimeOfDay(first.Year(), first.Month(), matches[len(matches)+day.n], start))
+			}
+		}
+		if len(rule.byMonthDay) == 0 && len(rule.byDay) == 0 && start.Day() <= daysInMonth {
+			days = append(days, atTimeOfDay(first.Year(), first.Month(), start.Day(), start))
+		}
+		return days
+	case "YEARLY":
+		year := start.Year() + period
+		// Skip February 29th in years that don't have one, rather than moving it to March 1st.
+		if start.Month() == time.February && start.Day() == 29 && time.Date(year, time.March, 0, 0, 0, 0, 0, time.UTC).Day() != 29 {
+			return nil
+		}
+		return []time.Time{atTimeOfDay(year, start.Month(), start.Day(), start)}
+	}
+	return nil
+}
+
+// occurrences returns the start times of the event's occurrences that begin before to and end after from.  Non-recurring
+// events have at most one occurrence.  EXDATEs are left out.
+func (event *icalEvent) occurrences(from time.Time, to time.Time) ([]time.Time, error) {
+	duration := event.end.Sub(event.start)
+	if event.rrule == "" {
+		if event.start.Before(to) && event.start.Add(duration).After(from) {
+			return []time.Time{event.start}, nil
+		}
+		return nil, nil
+	}
+	rule, err := parseRecurrenceRule(event.rrule, event.start)
+	if err != nil {
+		return nil, err
+	}
+	excluded := make(map[int64]bool)
+	for _, exdate := range event.exdates {
+		excluded[exdate.Unix()] = true
+	}
+	var starts []time.Time
+	count := 0
+	for period := 0; period < maxRecurrences; period += rule.interval {
+		candidates := rule.candidates(event.start, period)
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+		for _, candidate := range candidates {
+			if candidate.Before(event.start) {
+				continue
+			}
+			if !candidate.Before(to) || (rule.until != nil && candidate.After(*rule.until)) ||
+				(rule.count > 0 && count >= rule.count) {
+				return starts, nil
+			}
+			count++
+			if !excluded[candidate.Unix()] && candidate.Add(duration).After(from) {
+				starts = append(starts, candidate)
+			}
+		}
+	}
+	return starts, nil
+}
+
+// expandICalEvents returns all the occurrences of the given events that overlap from and to, as calendar.Events sorted by
+// start time.  Self is the email address of the user, which is used to find their response to each event.
+func expandICalEvents(events []*icalEvent, from time.Time, to time.Time, self string) []*calendar.Event {
+	// Modified occurrences of a recurring event replace the original occurrence.
+	overridden := make(map[string]map[int64]bool)
+	for _, event := range events {
+		if event.recurrenceID != nil {
+			if overridden[event.uid] == nil {
+				overridden[event.uid] = make(map[int64]bool)
+			}
+			overridden[event.uid][event.recurrenceID.Unix()] = true
+		}
+	}
+	var result []*calendar.Event
+	for _, event := range events {
+		if event.status == "CANCELLED" {
+			continue
+		}
+		starts, err := event.occurrences(from, to)
+		if err != nil {
+			fmt.Fprintf(output.debug, "Skipping iCalendar event %q: %v\n", event.summary, err)
+			continue
+		}
+		for _, start := range starts {
+			if event.recurrenceID == nil && overridden[event.uid][start.Unix()] {
+				continue
+			}
+			result = append(result, event.toCalendarEvent(start, self))
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return eventSortKey(result[i]) < eventSortKey(result[j])
+	})
+	return result
+}
+
+// eventSortKey orders events by start time, as the Google Calendar API does.
+func eventSortKey(event *calendar.Event) string {
+	if event.Start.DateTime != "" {
+		t, _ := time.Parse(time.RFC3339, event.Start.DateTime)
+		return t.UTC().Format(time.RFC3339)
+	}
+	t, _ := time.ParseInLocation("2006-01-02", event.Start.Date, time.Local)
+	return t.UTC().Format(time.RFC3339)
+}
+
+// icalResponseStatus maps PARTSTAT values onto Google Calendar response statuses.
+var icalResponseStatus = map[string]string{
+	"ACCEPTED":     "accepted",
+	"DECLINED":     "declined",
+	"TENTATIVE":    "tentative",
+	"NEEDS-ACTION": "needsAction",
+}
+
+// toCalendarEvent converts the occurrence of the event starting at start to a calendar.Event.
+func (event *icalEvent) toCalendarEvent(start time.Time, self string) *calendar.Event {
+	end := start.Add(event.end.Sub(event.start))
+	item := &calendar.Event{
+		Id:          event.uid,
+		Summary:     event.summary,
+		Description: event.description,
+		Location:    event.location,
+		Start:       &calendar.EventDateTime{},
+		End:         &calendar.EventDateTime{},
+	}
+	if event.allDay {
+		item.Start.Date = start.Format("2006-01-02")
+		item.End.Date = end.Format("2006-01-02")
+	} else {
+		item.Start.DateTime = start.Format(time.RFC3339)
+		item.End.DateTime = end.Format(time.RFC3339)
+	}
+	if event.transparency == "TRANSPARENT" {
+		item.Transparency = "transparent"
+	}
+	if event.organizer != "" {
+		item.Organizer = &calendar.EventOrganizer{
+			Email: event.organizer,
+			Self:  self != "" && strings.EqualFold(event.organizer, self),
+		}
+	}
+	for _, attendee := range event.attendees {
+		status, ok := icalResponseStatus[attendee.partstat]
+		if !ok {
+			status = "needsAction"
+		}
+		item.Attendees = append(item.Attendees, &calendar.EventAttendee{
+			Email:          attendee.email,
+			Self:           self != "" && strings.EqualFold(attendee.email, self),
+			ResponseStatus: status,
+		})
+	}
+	return item
+}
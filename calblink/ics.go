@@ -0,0 +1,145 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// icsBackend reads events from iCalendar feeds, such as the secret addresses calendar services give for subscribing to
+// a calendar.  Calendar IDs are the URLs of the feeds.  Feeds are read-only and say nothing about who is reading them,
+// so there is no response to events.
+type icsBackend struct {
+	client *http.Client
+	feeds  map[string]*icsFeed
+}
+
+// icsFeed is the last copy of a feed that was fetched, along with what the server said about caching it.
+type icsFeed struct {
+	events       []*icalEvent
+	etag         string
+	lastModified string
+	// freshUntil is when the copy needs checking with the server again.  It is zero if the server didn't give a max-age.
+	freshUntil time.Time
+}
+
+// icsWindow is how far ahead of now events are expanded.
+const icsWindow = 24 * time.Hour
+
+// icsMaxAge matches the max-age directive in a Cache-Control header.
+var icsMaxAge = regexp.MustCompile(`(?i)(?:^|[,\s])max-age=(\d+)`)
+
+func newICSBackend() *icsBackend {
+	return &icsBackend{client: &http.Client{Timeout: 30 * time.Second}, feeds: make(map[string]*icsFeed)}
+}
+
+// fetchEvents returns the feed's events that overlap the next day, expanding any recurring ones.  The feed is only
+// downloaded again when the server says it has changed, or when it doesn't support conditional requests.
+func (backend *icsBackend) fetchEvents(now time.Time, calendarID string, userPrefs *UserPrefs) ([]*calendar.Event, error) {
+	feed, err := backend.fetchFeed(calendarID)
+	if err != nil {
+		return nil, err
+	}
+	return expandICalEvents(feed.events, now, now.Add(icsWindow), ""), nil
+}
+
+func (backend *icsBackend) fetchFeed(calendarID string) (*icsFeed, error) {
+	cached := backend.feeds[calendarID]
+	if cached != nil && time.Now().Before(cached.freshUntil) {
+		fmt.Fprintf(output.debug, "Using cached copy of %v\n", calendarID)
+		return cached, nil
+	}
+	address := calendarID
+	// Subscription links often use webcal:, which is http(s) by another name.
+	if strings.HasPrefix(strings.ToLower(address), "webcal://") {
+		address = "https://" + address[len("webcal://"):]
+	}
+	req, err := http.NewRequest("GET", address, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid iCalendar feed %v: %v", calendarID, err)
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	resp, err := backend.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		fmt.Fprintf(output.debug, "%v hasn't changed\n", calendarID)
+		cached.freshUntil = icsFreshUntil(resp.Header)
+		return cached, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, calendarNotFoundError{calendarID}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, rateLimitError{calendarID, retryAfter(resp.Header)}
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("Fetching iCalendar feed %v failed: %v", calendarID, resp.Status)
+	}
+	events, err := parseICalEvents(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse iCalendar feed %v: %v", calendarID, err)
+	}
+	feed := &icsFeed{
+		events:       events,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		freshUntil:   icsFreshUntil(resp.Header),
+	}
+	backend.feeds[calendarID] = feed
+	return feed, nil
+}
+
+// icsFreshUntil returns when a response stops being fresh, according to its Cache-Control max-age, or zero if it
+// doesn't say or mustn't be reused without checking.
+func icsFreshUntil(header http.Header) time.Time {
+	cacheControl := header.Get("Cache-Control")
+	if strings.Contains(strings.ToLower(cacheControl), "no-cache") {
+		return time.Time{}
+	}
+	match := icsMaxAge.FindStringSubmatch(cacheControl)
+	if match == nil {
+		return time.Time{}
+	}
+	seconds, err := strconv.Atoi(match[1])
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(seconds) * time.Second)
+}
+
+// accountEmail fails, since a feed doesn't say who is reading it.
+func (backend *icsBackend) accountEmail() (string, error) {
+	return "", fmt.Errorf("the ics backend can't tell which events are yours")
+}
+
+// listCalendars fails, since each feed is a calendar of its own and there is nowhere to ask for a list of them.
+func (backend *icsBackend) listCalendars() ([]calendarInfo, error) {
+	return nil, fmt.Errorf("the ics backend has no list of calendars; each calendar is the URL of a feed")
+}
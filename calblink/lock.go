@@ -0,0 +1,46 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// lockPollInterval is how often the screen lock is checked.
+const lockPollInterval = 5 * time.Second
+
+// watchScreenLock sends on changes whenever the screen is locked or unlocked, starting with whether it is locked now.
+// screenLocked is provided for each platform; where it can't tell, a warning is logged and nothing is ever sent.
+func watchScreenLock(changes chan<- bool) {
+	if !lockDetectionAvailable {
+		log.Printf("pauseWhenLocked isn't supported on this platform, so it is ignored")
+		return
+	}
+	go func() {
+		known, wasLocked := false, false
+		for {
+			locked, err := screenLocked()
+			if err != nil {
+				fmt.Fprintf(output.debug, "Unable to tell if the screen is locked: %v\n", err)
+			} else if !known || locked != wasLocked {
+				known, wasLocked = true, locked
+				changes <- locked
+			}
+			time.Sleep(lockPollInterval)
+		}
+	}()
+}
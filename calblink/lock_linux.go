@@ -0,0 +1,38 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const lockDetectionAvailable = true
+
+// screenLocked asks systemd-logind whether the session is locked.  Desktops that lock through logind, such as GNOME
+// and KDE, set its LockedHint.
+func screenLocked() (bool, error) {
+	session := os.Getenv("XDG_SESSION_ID")
+	if session == "" {
+		return false, fmt.Errorf("XDG_SESSION_ID isn't set")
+	}
+	out, err := exec.Command("loginctl", "show-session", session, "--property=LockedHint").Output()
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) == "LockedHint=yes", nil
+}
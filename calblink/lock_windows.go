@@ -0,0 +1,31 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"os/exec"
+	"strings"
+)
+
+const lockDetectionAvailable = true
+
+// screenLocked reports whether the lock screen is up, which is when LogonUI.exe is running.
+func screenLocked() (bool, error) {
+	out, err := exec.Command("tasklist", "/FI", "IMAGENAME eq LogonUI.exe", "/NH").Output()
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(string(out), "LogonUI.exe"), nil
+}
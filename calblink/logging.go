@@ -0,0 +1,172 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFormat is an enumerated list of formats for log output.
+type logFormat string
+
+const (
+	logFormatText = logFormat("text")
+	logFormatJSON = logFormat("json")
+)
+
+func (format logFormat) isValidLogFormat() bool {
+	switch format {
+	case logFormatText:
+		return true
+	case logFormatJSON:
+		return true
+	}
+	return false
+}
+
+// logLevel is the level of a log entry.
+type logLevel string
+
+const (
+	levelDebug = logLevel("debug")
+	levelInfo  = logLevel("info")
+	levelWarn  = logLevel("warn")
+	levelError = logLevel("error")
+)
+
+// jsonLogging is set once log output has been switched to JSON by useJSONLogging.
+var jsonLogging bool
+
+// jsonDebugOut is where debug output goes in JSON format, once debug mode is on.
+var jsonDebugOut io.Writer = ioutil.Discard
+
+// debugTarget is where debug output should go when debug mode is turned on.
+func debugTarget() io.Writer {
+	if jsonLogging {
+		return jsonDebugOut
+	}
+	return output.status
+}
+
+// useJSONLogging makes all output JSON, one entry per line, written to out: status messages at the info level, debug
+// messages at the debug level, and messages from the log package at the error level.  Progress dots would break up the
+// entries, so they are turned off.
+func useJSONLogging(out io.Writer) {
+	mu := &sync.Mutex{}
+	jsonLogging = true
+	jsonDebugOut = &jsonLineWriter{mu: mu, out: out, level: levelDebug}
+	if output.debug != ioutil.Discard {
+		output.debug = jsonDebugOut
+	}
+	output.status = &jsonLineWriter{mu: mu, out: out, level: levelInfo}
+	log.SetFlags(0)
+	log.SetOutput(&jsonLineWriter{mu: mu, out: out, level: levelError})
+	output.dot = ioutil.Discard
+}
+
+// logEvent records something that happened, with fields describing it given as pairs of keys and values.  In JSON
+// format it is an entry of its own at the given level, with the fields alongside the message; debug entries are only
+// written in debug mode.  In text format it is a debug message.
+func logEvent(level logLevel, message string, keyvals ...interface{}) {
+	if !jsonLogging {
+		var parts []string
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			parts = append(parts, fmt.Sprintf("%v=%q", keyvals[i], fmt.Sprint(keyvals[i+1])))
+		}
+		fmt.Fprintf(output.debug, "%v %v\n", message, strings.Join(parts, " "))
+		return
+	}
+	if level == levelDebug && output.debug == ioutil.Discard {
+		return
+	}
+	fields := make(map[string]interface{})
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		value := keyvals[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		fields[fmt.Sprint(keyvals[i])] = value
+	}
+	writer := output.status.(*jsonLineWriter)
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	writeJSONEntry(writer.out, level, message, fields)
+}
+
+// writeJSONEntry writes a single entry.  The time, level and message come first, and then the fields in order of name.
+func writeJSONEntry(out io.Writer, level logLevel, message string, fields map[string]interface{}) {
+	var entry bytes.Buffer
+	entry.WriteString("{")
+	writeField := func(key string, value interface{}) {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			encoded, _ = json.Marshal(fmt.Sprint(value))
+		}
+		if entry.Len() > 1 {
+			entry.WriteString(",")
+		}
+		name, _ := json.Marshal(key)
+		entry.Write(name)
+		entry.WriteString(":")
+		entry.Write(encoded)
+	}
+	writeField("time", time.Now().Format(time.RFC3339))
+	writeField("level", level)
+	writeField("msg", message)
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeField(key, fields[key])
+	}
+	entry.WriteString("}\n")
+	out.Write(entry.Bytes())
+}
+
+// jsonLineWriter turns each line written to it into a JSON entry at its level.  Writers for the same output share a
+// mutex, so that entries aren't interleaved.
+type jsonLineWriter struct {
+	mu    *sync.Mutex
+	out   io.Writer
+	level logLevel
+	line  []byte
+}
+
+func (writer *jsonLineWriter) Write(p []byte) (int, error) {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	writer.line = append(writer.line, p...)
+	for {
+		end := bytes.IndexByte(writer.line, '\n')
+		if end < 0 {
+			return len(p), nil
+		}
+		if message := strings.TrimSpace(string(writer.line[:end])); message != "" {
+			writeJSONEntry(writer.out, writer.level, message, nil)
+		}
+		writer.line = writer.line[end+1:]
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fetchLatencyBuckets are the upper bounds, in seconds, of the fetch latency histogram buckets.
+var fetchLatencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// calblinkMetrics collects the numbers exported on the metrics endpoint, in the Prometheus text format.  The main loop
+// records into it and the metrics server reads from it, so all access goes through the mutex.
+type calblinkMetrics struct {
+	mu             sync.Mutex
+	fetchSuccesses map[string]int64
+	fetchFailures  map[string]int64
+	latencyCounts  []int64 // One per bucket, not cumulative, plus one for +Inf.
+	latencySum     float64
+	latencyCount   int64
+	colors         []string
+	failureStreaks []int
+}
+
+func newCalblinkMetrics() *calblinkMetrics {
+	return &calblinkMetrics{
+		fetchSuccesses: make(map[string]int64),
+		fetchFailures:  make(map[string]int64),
+		latencyCounts:  make([]int64, len(fetchLatencyBuckets)+1),
+	}
+}
+
+// recordFetch records the result and latency of fetching a calendar.
+func (metrics *calblinkMetrics) recordFetch(calendarID string, latency time.Duration, err error) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if err != nil {
+		metrics.fetchFailures[calendarID]++
+	} else {
+		metrics.fetchSuccesses[calendarID]++
+	}
+	seconds := latency.Seconds()
+	bucket := sort.SearchFloat64s(fetchLatencyBuckets, seconds)
+	metrics.latencyCounts[bucket]++
+	metrics.latencySum += seconds
+	metrics.latencyCount++
+}
+
+// update records the current color and failure streak of each display.
+func (metrics *calblinkMetrics) update(displays []*deviceDisplay) {
+	colors := make([]string, len(displays))
+	failureStreaks := make([]int, len(displays))
+	for i, display := range displays {
+		colors[i] = display.state.name
+		failureStreaks[i] = display.failures
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.colors = colors
+	metrics.failureStreaks = failureStreaks
+}
+
+// write writes all the metrics in the Prometheus text format.
+func (metrics *calblinkMetrics) write(w io.Writer) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	writeCounter := func(name string, help string, values map[string]int64) {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", name, help, name)
+		calendars := make([]string, 0, len(values))
+		for calendarID := range values {
+			calendars = append(calendars, calendarID)
+		}
+		sort.Strings(calendars)
+		for _, calendarID := range calendars {
+			fmt.Fprintf(w, "%v{calendar=%q} %v\n", name, calendarID, values[calendarID])
+		}
+	}
+	writeCounter("calblink_fetch_success_total", "Successful calendar fetches.", metrics.fetchSuccesses)
+	writeCounter("calblink_fetch_failure_total", "Failed calendar fetches.", metrics.fetchFailures)
+
+	fmt.Fprintf(w, "# HELP calblink_fetch_duration_seconds Time taken to fetch a calendar.\n")
+	fmt.Fprintf(w, "# TYPE calblink_fetch_duration_seconds histogram\n")
+	cumulative := int64(0)
+	for i, bound := range fetchLatencyBuckets {
+		cumulative += metrics.latencyCounts[i]
+		fmt.Fprintf(w, "calblink_fetch_duration_seconds_bucket{le=\"%v\"} %v\n", bound, cumulative)
+	}
+	fmt.Fprintf(w, "calblink_fetch_duration_seconds_bucket{le=\"+Inf\"} %v\n", metrics.latencyCount)
+	fmt.Fprintf(w, "calblink_fetch_duration_seconds_sum %v\n", metrics.latencySum)
+	fmt.Fprintf(w, "calblink_fetch_duration_seconds_count %v\n", metrics.latencyCount)
+
+	// The color is a state set: one series per color, set to 1 for the current color and 0 for the rest.
+	fmt.Fprintf(w, "# HELP calblink_color Current color of each device (1 for the current color).\n")
+	fmt.Fprintf(w, "# TYPE calblink_color gauge\n")
+	for device, color := range metrics.colors {
+		for _, state := range namedStates {
+			value := 0
+			if state.name == color {
+				value = 1
+			}
+			fmt.Fprintf(w, "calblink_color{device=\"%v\",color=%q} %v\n", device, state.name, value)
+		}
+		// Custom colors aren't in namedStates, so they only get a series while they're shown.
+		if _, ok := builtinStateByName(color); !ok && color != "" {
+			fmt.Fprintf(w, "calblink_color{device=\"%v\",color=%q} 1\n", device, color)
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP calblink_failure_streak Consecutive failed polls for each device.\n")
+	fmt.Fprintf(w, "# TYPE calblink_failure_streak gauge\n")
+	for device, failures := range metrics.failureStreaks {
+		fmt.Fprintf(w, "calblink_failure_streak{device=\"%v\"} %v\n", device, failures)
+	}
+}
+
+// startMetricsServer serves the metrics at /metrics on the given port.
+func startMetricsServer(metrics *calblinkMetrics, port int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+	serveHTTP("Metrics", port, mux)
+}
@@ -0,0 +1,383 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// The MQTT publisher speaks just enough of MQTT 3.1.1 to publish: it connects, sends QoS 0 messages, and disconnects.
+// It never subscribes, so the broker has nothing to send it but the reply to connecting.
+
+// mqttDiscoveryPrefix is the topic prefix Home Assistant looks for discovery config under by default.
+const mqttDiscoveryPrefix = "homeassistant"
+
+// mqttHeartbeat is how often every state is published again, changed or not, so that a broker or Home Assistant that
+// has restarted catches up.  The broker is asked to drop the connection if it hears nothing for twice as long.
+const mqttHeartbeat = time.Minute
+
+// mqttTimeout is how long connecting or sending a message can take before the connection is abandoned.
+const mqttTimeout = 10 * time.Second
+
+// mqttQueueSize is how many messages can wait to be sent.  Any more are dropped rather than hold up the main loop.
+const mqttQueueSize = 64
+
+// mqttPublisher publishes the color and next event of each device to an MQTT broker, along with Home Assistant
+// discovery config so that they show up there as sensors.  Messages are sent by a worker over a single connection,
+// which is opened when needed and reopened after a failure, so an unreachable broker never blocks the main loop.
+type mqttPublisher struct {
+	address  string
+	useTLS   bool
+	username string
+	password string
+	topic    string
+	queue    chan mqttMessage
+	done     chan struct{}
+	// sent is what was last queued for each device, so that only changes are queued.  It is only used by the main loop.
+	sent map[int]mqttDeviceState
+
+	// conn is the connection to the broker, or nil if there isn't one, and retained is the latest retained message on
+	// each topic, for the heartbeat and for reconnecting.  They are only used by the worker.
+	conn     net.Conn
+	retained map[string]mqttMessage
+}
+
+// mqttDeviceState is what is published for a device.
+type mqttDeviceState struct {
+	color string
+	event string
+}
+
+// mqttMessage is a message to publish.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// newMQTTPublisher starts publishing to the broker, which is host:port, or a URL whose scheme is mqtt or mqtts (for
+// TLS).  The port defaults to 1883, or 8883 with TLS.
+func newMQTTPublisher(broker, username, password, topic string) (*mqttPublisher, error) {
+	address, useTLS, err := parseMQTTBroker(broker)
+	if err != nil {
+		return nil, err
+	}
+	mqtt := &mqttPublisher{
+		address:  address,
+		useTLS:   useTLS,
+		username: username,
+		password: password,
+		topic:    strings.TrimSuffix(topic, "/"),
+		queue:    make(chan mqttMessage, mqttQueueSize),
+		done:     make(chan struct{}),
+		sent:     make(map[int]mqttDeviceState),
+		retained: make(map[string]mqttMessage),
+	}
+	go mqtt.worker()
+	return mqtt, nil
+}
+
+func parseMQTTBroker(broker string) (address string, useTLS bool, err error) {
+	if !strings.Contains(broker, "://") {
+		broker = "mqtt://" + broker
+	}
+	parsed, err := url.Parse(broker)
+	if err != nil {
+		return "", false, err
+	}
+	port := "1883"
+	switch parsed.Scheme {
+	case "mqtt", "tcp":
+	case "mqtts", "ssl", "tls":
+		useTLS = true
+		port = "8883"
+	default:
+		return "", false, fmt.Errorf("unknown scheme %v", parsed.Scheme)
+	}
+	if parsed.Hostname() == "" {
+		return "", false, fmt.Errorf("no host in %v", broker)
+	}
+	if parsed.Port() != "" {
+		port = parsed.Port()
+	}
+	return net.JoinHostPort(parsed.Hostname(), port), useTLS, nil
+}
+
+// availabilityTopic is where calblink says whether it is running: "online", or "offline" once it has exited or lost
+// its connection.
+func (mqtt *mqttPublisher) availabilityTopic() string {
+	return mqtt.topic + "/status"
+}
+
+func (mqtt *mqttPublisher) deviceTopic(number int, sensor string) string {
+	return fmt.Sprintf("%v/device%v/%v", mqtt.topic, number, sensor)
+}
+
+// update queues the state of each display that has changed since the last update.  The first time a display is seen,
+// its discovery config is queued too.  In privacy mode only the color is published.
+func (mqtt *mqttPublisher) update(displays []*deviceDisplay, privacyMode bool) {
+	for _, display := range displays {
+		state := mqttDeviceState{color: display.state.name}
+		if display.next != nil && !privacyMode {
+			state.event = display.next.Summary
+		}
+		last, ok := mqtt.sent[display.number]
+		if ok && last == state {
+			continue
+		}
+		if !ok {
+			mqtt.announce(display.number, privacyMode)
+		}
+		mqtt.sent[display.number] = state
+		mqtt.enqueue(mqttMessage{topic: mqtt.deviceTopic(display.number, "color"), payload: []byte(state.color), retain: true})
+		if !privacyMode {
+			mqtt.enqueue(mqttMessage{topic: mqtt.deviceTopic(display.number, "event"), payload: []byte(state.event), retain: true})
+		}
+	}
+}
+
+// announce queues the Home Assistant discovery config for a device's sensors.
+func (mqtt *mqttPublisher) announce(number int, privacyMode bool) {
+	sensors := []struct{ key, name, icon string }{
+		{"color", "Color", "mdi:lightbulb"},
+		{"event", "Next event", "mdi:calendar"},
+	}
+	if privacyMode {
+		sensors = sensors[:1]
+	}
+	for _, sensor := range sensors {
+		id := strings.Replace(fmt.Sprintf("calblink_%v_device%v_%v", mqtt.topic, number, sensor.key), "/", "_", -1)
+		config := map[string]interface{}{
+			"name":               fmt.Sprintf("Device %v %v", number, strings.ToLower(sensor.name)),
+			"unique_id":          id,
+			"object_id":          id,
+			"state_topic":        mqtt.deviceTopic(number, sensor.key),
+			"availability_topic": mqtt.availabilityTopic(),
+			"icon":               sensor.icon,
+			"device": map[string]interface{}{
+				"identifiers": []string{"calblink_" + strings.Replace(mqtt.topic, "/", "_", -1)},
+				"name":        "calblink",
+				"sw_version":  Version,
+			},
+		}
+		payload, err := json.Marshal(config)
+		if err != nil {
+			log.Printf("Unable to make MQTT discovery config: %v", err)
+			continue
+		}
+		mqtt.enqueue(mqttMessage{topic: fmt.Sprintf("%v/sensor/%v/config", mqttDiscoveryPrefix, id), payload: payload, retain: true})
+	}
+}
+
+func (mqtt *mqttPublisher) enqueue(message mqttMessage) {
+	select {
+	case mqtt.queue <- message:
+	default:
+		fmt.Fprintf(output.debug, "MQTT queue full, dropping message for %v\n", message.topic)
+	}
+}
+
+func (mqtt *mqttPublisher) worker() {
+	heartbeat := time.NewTicker(mqttHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case message, ok := <-mqtt.queue:
+			if !ok {
+				mqtt.disconnect()
+				close(mqtt.done)
+				return
+			}
+			if message.retain {
+				mqtt.retained[message.topic] = message
+			}
+			if mqtt.conn == nil {
+				// Connecting sends every retained message, including this one.
+				mqtt.connect()
+			} else if err := mqtt.publish(message); err != nil {
+				mqtt.dropConnection(err)
+			}
+		case <-heartbeat.C:
+			if mqtt.conn == nil {
+				mqtt.connect()
+			} else {
+				mqtt.publishRetained()
+			}
+		}
+	}
+}
+
+// close publishes that calblink is offline and disconnects, for use at exit.  Anything still queued is sent first, if
+// it can be in time.  No more updates can be made after it.
+func (mqtt *mqttPublisher) close() {
+	close(mqtt.queue)
+	select {
+	case <-mqtt.done:
+	case <-time.After(mqttTimeout):
+	}
+}
+
+// connect opens the connection and publishes every retained message.  On failure it logs why, and the next message or
+// heartbeat tries again.
+func (mqtt *mqttPublisher) connect() {
+	fmt.Fprintf(output.debug, "Connecting to MQTT broker %v\n", mqtt.address)
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	var conn net.Conn
+	var err error
+	if mqtt.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", mqtt.address, &tls.Config{})
+	} else {
+		conn, err = dialer.Dial("tcp", mqtt.address)
+	}
+	if err != nil {
+		log.Printf("Unable to connect to MQTT broker %v: %v", mqtt.address, err)
+		return
+	}
+	conn.SetDeadline(time.Now().Add(mqttTimeout))
+	if err := mqtt.handshake(conn); err != nil {
+		conn.Close()
+		log.Printf("Unable to connect to MQTT broker %v: %v", mqtt.address, err)
+		return
+	}
+	mqtt.conn = conn
+	mqtt.publishRetained()
+}
+
+// handshake sends CONNECT, with a will that marks calblink offline, and waits for CONNACK.
+func (mqtt *mqttPublisher) handshake(conn net.Conn) error {
+	hostname, _ := os.Hostname()
+	var body bytes.Buffer
+	writeMQTTString(&body, "MQTT")
+	// Protocol level 4 is MQTT 3.1.1.  The flags ask for a clean session, and a retained will at QoS 0.
+	body.WriteByte(4)
+	flags := byte(0x02 | 0x04 | 0x20)
+	if mqtt.username != "" {
+		flags |= 0x80
+	}
+	if mqtt.password != "" {
+		flags |= 0x40
+	}
+	body.WriteByte(flags)
+	binary.Write(&body, binary.BigEndian, uint16(2*mqttHeartbeat/time.Second))
+	writeMQTTString(&body, fmt.Sprintf("calblink-%v-%v", hostname, os.Getpid()))
+	writeMQTTString(&body, mqtt.availabilityTopic())
+	writeMQTTString(&body, "offline")
+	if mqtt.username != "" {
+		writeMQTTString(&body, mqtt.username)
+	}
+	if mqtt.password != "" {
+		writeMQTTString(&body, mqtt.password)
+	}
+	if _, err := conn.Write(mqttPacket(0x10, body.Bytes())); err != nil {
+		return err
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return fmt.Errorf("no reply to connecting: %v", err)
+	}
+	if ack[0] != 0x20 || ack[1] != 2 {
+		return fmt.Errorf("unexpected reply to connecting: %x", ack)
+	}
+	switch ack[3] {
+	case 0:
+		return nil
+	case 4:
+		return fmt.Errorf("bad username or password")
+	case 5:
+		return fmt.Errorf("not authorized")
+	}
+	return fmt.Errorf("connection refused, code %v", ack[3])
+}
+
+// publishRetained says calblink is online, then publishes every retained message again.
+func (mqtt *mqttPublisher) publishRetained() {
+	messages := []mqttMessage{{topic: mqtt.availabilityTopic(), payload: []byte("online"), retain: true}}
+	for _, message := range mqtt.retained {
+		messages = append(messages, message)
+	}
+	for _, message := range messages {
+		if err := mqtt.publish(message); err != nil {
+			mqtt.dropConnection(err)
+			return
+		}
+	}
+}
+
+func (mqtt *mqttPublisher) publish(message mqttMessage) error {
+	var body bytes.Buffer
+	writeMQTTString(&body, message.topic)
+	body.Write(message.payload)
+	header := byte(0x30)
+	if message.retain {
+		header |= 0x01
+	}
+	mqtt.conn.SetDeadline(time.Now().Add(mqttTimeout))
+	_, err := mqtt.conn.Write(mqttPacket(header, body.Bytes()))
+	return err
+}
+
+func (mqtt *mqttPublisher) dropConnection(err error) {
+	log.Printf("Lost connection to MQTT broker %v: %v", mqtt.address, err)
+	mqtt.conn.Close()
+	mqtt.conn = nil
+}
+
+// disconnect publishes that calblink is offline and closes the connection cleanly, so that the broker doesn't send the
+// will as well.
+func (mqtt *mqttPublisher) disconnect() {
+	if mqtt.conn == nil {
+		return
+	}
+	if err := mqtt.publish(mqttMessage{topic: mqtt.availabilityTopic(), payload: []byte("offline"), retain: true}); err == nil {
+		mqtt.conn.Write(mqttPacket(0xe0, nil))
+	}
+	mqtt.conn.Close()
+	mqtt.conn = nil
+}
+
+// mqttPacket puts the fixed header, with the remaining length, in front of the rest of a packet.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// writeMQTTString writes a string with its length in front, as MQTT encodes strings.
+func writeMQTTString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gen2brain/beeep"
+)
+
+// notifyMinutes is how close to its start an event has to be for a change of color to bring up a notification.
+const notifyMinutes = 5
+
+// isImminent reports whether the event starts within notifyMinutes of now, and hasn't started yet.  An event that a
+// travel block leads to never is, since the travel block was.
+func isImminent(now time.Time, next *upcomingEvent) bool {
+	if next == nil || next.afterTravel {
+		return false
+	}
+	until := next.startTime.Sub(now)
+	return until >= 0 && until < notifyMinutes*time.Minute
+}
+
+// eventKey identifies a single occurrence of an event, so that it is only notified once.
+func eventKey(next *upcomingEvent) string {
+	return occurrenceKey(next.calendarID, next.Id, next.startTime)
+}
+
+// occurrenceKey is eventKey for an event that hasn't been made into an upcomingEvent yet.
+func occurrenceKey(calendarID string, id string, startTime time.Time) string {
+	return fmt.Sprintf("%v/%v/%v", calendarID, id, startTime.Unix())
+}
+
+// notifyEvent brings up a desktop notification for the event.
+func notifyEvent(next *upcomingEvent) {
+	message := "Starts at " + next.startTime.Format("15:04")
+	if next.Location != "" {
+		message += " in " + next.Location
+	}
+	fmt.Fprintf(output.debug, "Notifying %q: %v\n", next.Summary, message)
+	if err := beeep.Notify(next.Summary, message, ""); err != nil {
+		log.Printf("Unable to show notification: %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/microsoft"
+	"google.golang.org/api/calendar/v3"
+)
+
+// outlookBackend reads events from Outlook / Office 365 through Microsoft Graph.  Calendar IDs are Graph calendar IDs;
+// "primary" means the user's default calendar.
+type outlookBackend struct {
+	client *http.Client
+}
+
+// outlookWindow is how far ahead of now events are fetched.
+const outlookWindow = 24 * time.Hour
+
+// outlookRedirectURL is the redirect for native apps.  After signing in, the browser is left on a blank page whose URL
+// has the authorization code in its code parameter.
+const outlookRedirectURL = "https://login.microsoftonline.com/common/oauth2/nativeclient"
+
+// outlookTokenName is the file in the credentials directory that the OAuth token is cached in, unless TokenFile is set.
+const outlookTokenName = "calendar-blink1-outlook.json"
+
+func newOutlookBackend(userPrefs *UserPrefs) *outlookBackend {
+	config := &oauth2.Config{
+		ClientID:     userPrefs.outlookClientID,
+		ClientSecret: userPrefs.outlookClientSecret,
+		Endpoint:     microsoft.AzureADEndpoint(userPrefs.outlookTenant),
+		RedirectURL:  outlookRedirectURL,
+		Scopes:       []string{"offline_access", "https://graph.microsoft.com/Calendars.Read"},
+	}
+	cacheFile := tokenPath(userPrefs, outlookTokenName)
+	return &outlookBackend{client: getClient(context.Background(), config, cacheFile)}
+}
+
+// outlookEvent is the part of a Graph event that we need.
+type outlookEvent struct {
+	ID             string
+	Subject        string
+	BodyPreview    string
+	IsAllDay       bool
+	IsCancelled    bool
+	ShowAs         string
+	Start          outlookDateTime
+	End            outlookDateTime
+	Location       struct{ DisplayName string }
+	ResponseStatus struct{ Response string }
+	Organizer      struct{ EmailAddress struct{ Address string } }
+}
+
+// outlookDateTime is a Graph date and time.  We ask for times in UTC, so the zone can be ignored.
+type outlookDateTime struct {
+	DateTime string
+	TimeZone string
+}
+
+// outlookResponseStatuses maps Graph's response values onto Google Calendar's, so that ResponseState works the same way.
+var outlookResponseStatuses = map[string]string{
+	"none":                "needsAction",
+	"notResponded":        "needsAction",
+	"organizer":           "accepted",
+	"accepted":            "accepted",
+	"tentativelyAccepted": "tentative",
+	"declined":            "declined",
+}
+
+// fetchEvents asks Graph for the events in the calendar that overlap the next day.  Graph expands recurring events
+// itself.
+func (backend *outlookBackend) fetchEvents(now time.Time, calendarID string, userPrefs *UserPrefs) ([]*calendar.Event, error) {
+	path := "https://graph.microsoft.com/v1.0/me/calendarView"
+	if calendarID != "" && calendarID != "primary" {
+		path = "https://graph.microsoft.com/v1.0/me/calendars/" + url.PathEscape(calendarID) + "/calendarView"
+	}
+	query := url.Values{}
+	query.Set("startDateTime", now.UTC().Format(time.RFC3339))
+	query.Set("endDateTime", now.Add(outlookWindow).UTC().Format(time.RFC3339))
+	query.Set("$orderby", "start/dateTime")
+	query.Set("$top", "50")
+	req, err := http.NewRequest("GET", path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Prefer", `outlook.timezone="UTC"`)
+	resp, err := backend.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, calendarNotFoundError{calendarID}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, rateLimitError{calendarID, retryAfter(resp.Header)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Outlook query of %v failed: %v", calendarID, resp.Status)
+	}
+	var result struct {
+		Value []outlookEvent
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("Unable to parse Outlook response: %v", err)
+	}
+	var events []*calendar.Event
+	for _, event := range result.Value {
+		if event.IsCancelled {
+			continue
+		}
+		item, err := event.toCalendarEvent()
+		if err != nil {
+			fmt.Fprintf(output.debug, "Skipping %v: %v\n", event.Subject, err)
+			continue
+		}
+		events = append(events, item)
+	}
+	return events, nil
+}
+
+// accountEmail asks Graph for the signed-in user's email address.  Accounts without a mailbox only have their sign-in
+// name, which is usually the same.
+func (backend *outlookBackend) accountEmail() (string, error) {
+	resp, err := backend.client.Get("https://graph.microsoft.com/v1.0/me")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Outlook query of the signed-in user failed: %v", resp.Status)
+	}
+	var user struct {
+		Mail              string
+		UserPrincipalName string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return "", fmt.Errorf("Unable to parse Outlook response: %v", err)
+	}
+	if user.Mail != "" {
+		return user.Mail, nil
+	}
+	return user.UserPrincipalName, nil
+}
+
+// listCalendars asks Graph for the user's calendars, following Graph's paging.
+func (backend *outlookBackend) listCalendars() ([]calendarInfo, error) {
+	var calendars []calendarInfo
+	next := "https://graph.microsoft.com/v1.0/me/calendars"
+	for next != "" {
+		resp, err := backend.client.Get(next)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Value []struct {
+				ID                string
+				Name              string
+				IsDefaultCalendar bool
+			}
+			NextLink string `json:"@odata.nextLink"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Outlook query of calendars failed: %v", resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse Outlook response: %v", err)
+		}
+		for _, entry := range result.Value {
+			calendars = append(calendars, calendarInfo{id: entry.ID, name: entry.Name, primary: entry.IsDefaultCalendar})
+		}
+		next = result.NextLink
+	}
+	return calendars, nil
+}
+
+// toCalendarEvent converts a Graph event into the form the rest of calblink uses.  Your response is recorded as a self
+// attendee, as Google Calendar does.
+func (event *outlookEvent) toCalendarEvent() (*calendar.Event, error) {
+	start, err := event.Start.parse()
+	if err != nil {
+		return nil, err
+	}
+	end, err := event.End.parse()
+	if err != nil {
+		return nil, err
+	}
+	item := &calendar.Event{
+		Id:          event.ID,
+		Summary:     event.Subject,
+		Description: event.BodyPreview,
+		Location:    event.Location.DisplayName,
+		Start:       &calendar.EventDateTime{},
+		End:         &calendar.EventDateTime{},
+	}
+	if event.IsAllDay {
+		// All-day events run from midnight to midnight, so the date is all that matters.
+		item.Start.Date = start.Format("2006-01-02")
+		item.End.Date = end.Format("2006-01-02")
+	} else {
+		item.Start.DateTime = start.Format(time.RFC3339)
+		item.End.DateTime = end.Format(time.RFC3339)
+	}
+	if event.ShowAs == "free" {
+		item.Transparency = "transparent"
+	}
+	// Graph has no event types, but out of office is one of the ways an event can show you.
+	if event.ShowAs == "oof" {
+		item.EventType = "outOfOffice"
+	}
+	if address := event.Organizer.EmailAddress.Address; address != "" {
+		item.Organizer = &calendar.EventOrganizer{Email: address}
+	}
+	if status, ok := outlookResponseStatuses[event.ResponseStatus.Response]; ok {
+		item.Attendees = []*calendar.EventAttendee{{Self: true, ResponseStatus: status}}
+	}
+	return item, nil
+}
+
+func (dateTime outlookDateTime) parse() (time.Time, error) {
+	if dateTime.TimeZone != "" && !strings.EqualFold(dateTime.TimeZone, "UTC") {
+		return time.Time{}, fmt.Errorf("unexpected time zone %v", dateTime.TimeZone)
+	}
+	// Graph gives up to seven digits of fractional seconds and no zone.
+	return time.Parse("2006-01-02T15:04:05.9999999", dateTime.DateTime)
+}
@@ -0,0 +1,332 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redacted stands in for secrets in the config that --print_config prints.
+const redacted = "(redacted)"
+
+// PrintConfig prints the config in effect, for --print_config, as JSON.
+func PrintConfig(userPrefs *UserPrefs) {
+	data, err := json.MarshalIndent(effectiveConfig(userPrefs), "", "  ")
+	if err != nil {
+		log.Fatalf("Unable to encode the config: %v", err)
+	}
+	fmt.Println(string(data))
+}
+
+// effectiveConfig describes the config that is in effect, once the defaults, the config file, the environment and the
+// flags have all been applied, using the config file's names for the options.  Passwords, tokens, the client secret and
+// the webhook URL are replaced by redacted, so that the output can be shared when asking for help, as are the query
+// strings and user info of URLs, such as the caldavURL and ics feeds, which often carry a token.  Colors are given by
+// name, and custom colors are only listed.
+func effectiveConfig(userPrefs *UserPrefs) map[string]interface{} {
+	var skipDays []string
+	for day, skip := range userPrefs.skipDays {
+		if skip {
+			skipDays = append(skipDays, time.Weekday(day).String())
+		}
+	}
+	workHours := make(map[string]interface{})
+	for day, hours := range userPrefs.workHours {
+		workHours[day.String()] = configHours(hours)
+	}
+	var workPeriods []interface{}
+	for _, period := range userPrefs.workPeriods {
+		workPeriods = append(workPeriods, configHours(period))
+	}
+	dots := make(map[string]string)
+	for kind, mark := range userPrefs.dots {
+		dots[string(kind)] = mark
+	}
+	eventTypes := make(map[string]string)
+	for eventType, rule := range userPrefs.eventTypes {
+		if rule.ignore {
+			eventTypes[eventType] = "ignore"
+		} else {
+			eventTypes[eventType] = rule.state.name
+		}
+	}
+	keywordPatterns := make(map[string]string)
+	for _, pattern := range userPrefs.keywordPatterns {
+		keywordPatterns[pattern.regexp.String()] = pattern.state.name
+	}
+	busyColors := make(map[string]string)
+	for _, rule := range userPrefs.busyRules {
+		busyColors[strconv.Itoa(rule.meetings)] = rule.state.name
+	}
+	deviceCalibration := make(map[string]interface{})
+	for device, calibration := range userPrefs.deviceCalibration {
+		deviceCalibration[device] = map[string]float64{
+			"red":   calibration.red,
+			"green": calibration.green,
+			"blue":  calibration.blue,
+			"gamma": calibration.gamma,
+		}
+	}
+	var customColors []string
+	for _, state := range userPrefs.customStates {
+		customColors = append(customColors, state.name)
+	}
+	var quietHours, rampColors interface{}
+	if userPrefs.quietHours != nil {
+		quietHours = configHours(*userPrefs.quietHours)
+	}
+	if userPrefs.ramp != nil {
+		rampColors = map[string]interface{}{
+			"startColor": userPrefs.ramp.start.name,
+			"endColor":   userPrefs.ramp.end.name,
+			"minutes":    userPrefs.ramp.minutes,
+		}
+	}
+	var nightBrightness interface{}
+	if userPrefs.nightBrightness != nil {
+		nightBrightness = *userPrefs.nightBrightness
+	}
+	return map[string]interface{}{
+		"excludes":                configSet(userPrefs.excludes),
+		"startTime":               configTime(userPrefs.startTime),
+		"endTime":                 configTime(userPrefs.endTime),
+		"endGraceMinutes":         userPrefs.endGraceMinutes,
+		"skipDays":                skipDays,
+		"skipDates":               configSet(userPrefs.skipDates),
+		"pollInterval":            userPrefs.pollInterval,
+		"alignPolls":              userPrefs.alignPolls,
+		"pollJitter":              userPrefs.pollJitter,
+		"calendars":               configCalendars(userPrefs),
+		"calendarColors":          configStates(userPrefs.calendarColors),
+		"calendarColorMode":       userPrefs.calendarColorMode,
+		"overlapStrategy":         userPrefs.overlapStrategy,
+		"responseState":           userPrefs.responseState,
+		"deviceFailureRetries":    userPrefs.deviceFailureRetries,
+		"deviceMaxBackoff":        userPrefs.deviceMaxBackoff,
+		"connectRetries":          userPrefs.connectRetries,
+		"connectRetryInterval":    userPrefs.connectRetryInterval,
+		"showDots":                userPrefs.showDots,
+		"dotChars":                dots,
+		"deviceAssignments":       userPrefs.deviceAssignments,
+		"deviceCalibration":       deviceCalibration,
+		"statusPort":              userPrefs.statusPort,
+		"privacyMode":             userPrefs.privacyMode,
+		"workHours":               workHours,
+		"workPeriods":             workPeriods,
+		"backend":                 userPrefs.backend,
+		"caldavURL":               configURL(userPrefs.caldavURL),
+		"caldavUsername":          userPrefs.caldavUsername,
+		"caldavPassword":          configSecret(userPrefs.caldavPassword),
+		"outlookClientID":         userPrefs.outlookClientID,
+		"outlookClientSecret":     configSecret(userPrefs.outlookClientSecret),
+		"outlookTenant":           userPrefs.outlookTenant,
+		"colorRules":              configRules(userPrefs.colorRules),
+		"excludeRegex":            configRegexp(userPrefs.excludeRegex),
+		"includeRegex":            configRegexp(userPrefs.includeRegex),
+		"useEventColors":          userPrefs.useEventColors,
+		"eventColorMap":           configStates(userPrefs.eventColorMap),
+		"controlSocket":           userPrefs.controlSocket,
+		"grpcPort":                userPrefs.grpcPort,
+		"grpcAddress":             userPrefs.grpcAddress,
+		"profile":                 userPrefs.profile,
+		"brightness":              userPrefs.brightness,
+		"nightBrightness":         nightBrightness,
+		"nightStartTime":          configTime(userPrefs.nightStartTime),
+		"nightEndTime":            configTime(userPrefs.nightEndTime),
+		"quietHours":              quietHours,
+		"logFile":                 userPrefs.logFile,
+		"logMaxSizeMB":            userPrefs.logMaxSizeMB,
+		"logKeepFiles":            userPrefs.logKeepFiles,
+		"logFormat":               userPrefs.logFormat,
+		"simulate":                userPrefs.simulate,
+		"dryRun":                  userPrefs.dryRun,
+		"skipFreeEvents":          userPrefs.skipFreeEvents,
+		"onlyMyEvents":            userPrefs.onlyMyEvents,
+		"skipAllDayEvents":        userPrefs.skipAllDayEvents,
+		"minEventMinutes":         userPrefs.minEventMinutes,
+		"leadTimeMinutes":         userPrefs.leadTimeMinutes,
+		"useEventReminders":       userPrefs.useEventReminders,
+		"thresholdHysteresis":     userPrefs.thresholdHysteresis,
+		"metricsPort":             userPrefs.metricsPort,
+		"failureColor":            userPrefs.failureState.name,
+		"failureThreshold":        userPrefs.failureThreshold,
+		"authErrorColor":          userPrefs.authErrorState.name,
+		"maxBackoff":              userPrefs.maxBackoff,
+		"deviceType":              userPrefs.deviceType,
+		"devicePatterns":          userPrefs.devicePatterns,
+		"fadeMillis":              userPrefs.fadeMillis,
+		"flashIntervalMillis":     userPrefs.flashIntervalMillis,
+		"flashOnMillis":           userPrefs.flashOnMillis,
+		"flashOffMillis":          userPrefs.flashOffMillis,
+		"statusFile":              userPrefs.statusFile,
+		"notify":                  userPrefs.notify,
+		"soundOnImminent":         userPrefs.soundOnImminent,
+		"soundFile":               userPrefs.soundFile,
+		"keywordPatterns":         keywordPatterns,
+		"tokenFile":               userPrefs.tokenFile,
+		"dndCalendar":             userPrefs.dndCalendar,
+		"outOfOffice":             userPrefs.outOfOffice,
+		"outOfOfficePattern":      configRegexp(userPrefs.outOfOfficeRegex),
+		"videoCallColor":          configState(userPrefs.videoCallState),
+		"tentativeColor":          configState(userPrefs.tentativeState),
+		"declinedColor":           configState(userPrefs.declinedState),
+		"videoCallRegex":          configRegexp(userPrefs.videoCallRegex),
+		"customColors":            customColors,
+		"timezone":                userPrefs.timezone.String(),
+		"holidays":                configHolidays(userPrefs.holidays),
+		"slackToken":              configSecret(userPrefs.slackToken),
+		"webhookURL":              configSecret(userPrefs.webhookURL),
+		"deciderCommand":          userPrefs.deciderCommand,
+		"mqttBroker":              userPrefs.mqttBroker,
+		"mqttUsername":            userPrefs.mqttUsername,
+		"mqttPassword":            configSecret(userPrefs.mqttPassword),
+		"mqttTopic":               userPrefs.mqttTopic,
+		"clientSecretFile":        userPrefs.clientSecretFile,
+		"idleColor":               userPrefs.idleState.name,
+		"exitColor":               configState(userPrefs.exitState),
+		"breakEndingColor":        configState(userPrefs.breakEndingState),
+		"breakEndingMinutes":      userPrefs.breakEndingMinutes,
+		"busyWindow":              userPrefs.busyWindow,
+		"busyColors":              busyColors,
+		"eventTypes":              eventTypes,
+		"pauseWhenLocked":         userPrefs.pauseWhenLocked,
+		"showMeetingEndCountdown": userPrefs.showMeetingEndCountdown,
+		"meetingEndColors":        configRules(userPrefs.meetingEndRules),
+		"justStartedColor":        configState(userPrefs.justStartedState),
+		"justStartedMinutes":      userPrefs.justStartedMinutes,
+		"rampColors":              rampColors,
+		"travelPattern":           configRegexp(userPrefs.travelRegex),
+		"travelColors":            configRules(userPrefs.travelRules),
+	}
+}
+
+// configCalendars lists the calendars the way the config file does: just the ID, or an object for a calendar with its own
+// responseState.
+func configCalendars(userPrefs *UserPrefs) []interface{} {
+	var calendars []interface{}
+	for _, calendarID := range userPrefs.calendars {
+		if state, ok := userPrefs.calendarResponseStates[calendarID]; ok {
+			calendars = append(calendars, map[string]string{"id": configURL(calendarID), "responseState": string(state)})
+		} else {
+			calendars = append(calendars, configURL(calendarID))
+		}
+	}
+	return calendars
+}
+
+// configSecret hides a secret, unless it isn't set.
+func configSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// configURL hides the query string and user info of a URL, such as the token in an ics feed's URL.  Anything that isn't
+// a URL with a host, like a Google calendar ID, is left as it is.
+func configURL(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Host == "" {
+		return value
+	}
+	if parsed.RawQuery != "" {
+		parsed.RawQuery = redacted
+	}
+	if parsed.User == nil {
+		return parsed.String()
+	}
+	// url.User would escape the parentheses of redacted, so it goes in after the "//" that starts the host.
+	parsed.User = nil
+	return strings.Replace(parsed.String(), "//", "//"+redacted+"@", 1)
+}
+
+// configTime gives a time of day as hh:mm, or nil if it isn't set.
+func configTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Format("15:04")
+}
+
+func configHours(hours workHours) map[string]interface{} {
+	return map[string]interface{}{"startTime": configTime(hours.startTime), "endTime": configTime(hours.endTime)}
+}
+
+func configRegexp(regex *regexp.Regexp) interface{} {
+	if regex == nil {
+		return nil
+	}
+	return regex.String()
+}
+
+func configState(state *calendarState) interface{} {
+	if state == nil {
+		return nil
+	}
+	return state.name
+}
+
+func configStates(states map[string]calendarState) map[string]string {
+	names := make(map[string]string)
+	for key, state := range states {
+		names[key] = state.name
+	}
+	return names
+}
+
+// configSet lists the members of a set, in order.
+func configSet(set map[string]bool) []string {
+	var members []string
+	for member, ok := range set {
+		if ok {
+			members = append(members, member)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+func configRules(rules []colorRule) []interface{} {
+	var layouts []interface{}
+	for _, rule := range rules {
+		layout := map[string]interface{}{"color": rule.state.name}
+		if rule.minutes != nil {
+			layout["minutes"] = *rule.minutes
+		}
+		if rule.led != 0 {
+			layout["led"] = int(rule.led)
+		}
+		layouts = append(layouts, layout)
+	}
+	return layouts
+}
+
+// configHolidays lists the holidays the way the config file does: dates, then annual dates, then calendars.
+func configHolidays(holidays holidays) []string {
+	listed := configSet(holidays.dates)
+	listed = append(listed, configSet(holidays.annual)...)
+	for _, calendarID := range holidays.calendars {
+		listed = append(listed, configURL(calendarID))
+	}
+	return listed
+}
@@ -0,0 +1,724 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// Runner runs calblink from a set of UserPrefs: each pass reads the calendars, decides what each device shows, with
+// everything the prefs set up, from snoozing and overrides to quiet hours, do not disturb, holidays and device
+// assignments, and shows it.  Only one Runner can be in use at a time, since the output, the exit hooks and the profile
+// in use belong to the package.
+type Runner struct {
+	// Status takes informational messages.  NewRunner sets it to stdout, and LogFile in the prefs replaces it.
+	Status io.Writer
+	// Debug takes debug messages, or is nil to discard them.  LogFile in the prefs replaces it if it is set.
+	Debug io.Writer
+	// Dot takes the progress marks, if ShowDots is on and the log is in text, or is nil to send them to Status.
+	Dot io.Writer
+	// Once makes Run check the calendars and set the devices once, and then return, leaving them set.
+	Once bool
+
+	userPrefs *UserPrefs
+	device    Device
+	options   Options
+	started   sync.Once
+	// reload carries prefs that have been read again to Run, which puts them into effect at its next wait.
+	reload chan *UserPrefs
+	// stopped is closed by Stop.
+	stopped chan struct{}
+
+	// mu guards displays, which Stop turns off from another goroutine.
+	mu       sync.Mutex
+	displays []*deviceDisplay
+}
+
+// NewRunner returns a Runner that shows the calendars in userPrefs.  If device is nil, the devices are opened as the
+// prefs say, and DeviceAssignments decides which calendars each shows; otherwise device is the only one, and shows all
+// of them.
+func NewRunner(userPrefs *UserPrefs, device Device) *Runner {
+	setProfile(userPrefs.profile)
+	setExitState(userPrefs.exitState)
+	return &Runner{
+		Status:    os.Stdout,
+		userPrefs: userPrefs,
+		device:    device,
+		options:   userPrefs.options,
+		reload:    make(chan *UserPrefs, 1),
+		stopped:   make(chan struct{}),
+	}
+}
+
+// start sends the output where the Runner's fields and the prefs say.  It only does anything the first time.
+func (runner *Runner) start() {
+	runner.started.Do(func() {
+		userPrefs := runner.userPrefs
+		output = outputs{status: runner.Status, debug: runner.Debug, dot: ioutil.Discard}
+		if output.status == nil {
+			output.status = ioutil.Discard
+		}
+		if output.debug == nil {
+			output.debug = ioutil.Discard
+		}
+		if userPrefs.logFile != "" {
+			logFile, err := openRotatingFile(userPrefs.logFile, userPrefs.logMaxSizeMB, userPrefs.logKeepFiles)
+			if err != nil {
+				log.Fatalf("Unable to open log file %v: %v", userPrefs.logFile, err)
+			}
+			log.SetOutput(logFile)
+			output.status = logFile
+			if runner.Debug != nil {
+				output.debug = logFile
+			}
+		}
+		// This comes after the log file, so that JSON entries go wherever the rest of the output would have.
+		if userPrefs.logFormat == logFormatJSON {
+			useJSONLogging(output.status)
+		}
+		runner.useDots(userPrefs)
+		if userPrefs.dryRun {
+			dryRunOut = output.status
+		}
+	})
+}
+
+// useDots sets up the progress marks as userPrefs say.
+func (runner *Runner) useDots(userPrefs *UserPrefs) {
+	output.dot = ioutil.Discard
+	if userPrefs.showDots && !jsonLogging {
+		output.dot = output.status
+		if runner.Dot != nil {
+			output.dot = runner.Dot
+		}
+	}
+	dots = userPrefs.dots
+}
+
+// open opens the devices.
+func (runner *Runner) open() []*deviceDisplay {
+	var displays []*deviceDisplay
+	if runner.device == nil {
+		displays = openDisplays(runner.userPrefs)
+	} else {
+		device := runner.device
+		displays = []*deviceDisplay{{
+			blinker: newBlinkerState(runner.userPrefs.deviceFailureRetries,
+				time.Duration(runner.userPrefs.deviceMaxBackoff)*time.Second, func(serial string) (Device, error) {
+					return device, nil
+				}),
+		}}
+		assignCalendars(displays, runner.userPrefs)
+	}
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	runner.displays = displays
+	return displays
+}
+
+// readUserPrefs reads the config file again, with the named profile, for a reload or the profile control command.
+func (runner *Runner) readUserPrefs(profile string) (*UserPrefs, error) {
+	options := runner.options
+	options.Debug = output.debug
+	return readUserPrefs(options, true, profile)
+}
+
+// Reload reads the config file again, with the profile in use, and hands it to Run, which puts it into effect at its
+// next wait.  If the config is invalid, the error is returned and the current one is kept.
+func (runner *Runner) Reload() error {
+	userPrefs, err := runner.readUserPrefs(currentProfile())
+	if err != nil {
+		return err
+	}
+	// Nothing takes reloads while Run isn't waiting, so a reload that is still waiting is replaced rather than blocking,
+	// which would stop the caller turning the devices off.  This is the only sender, so there is room once the waiting
+	// one is gone.
+	select {
+	case runner.reload <- userPrefs:
+	default:
+		select {
+		case <-runner.reload:
+		default:
+		}
+		runner.reload <- userPrefs
+	}
+	return nil
+}
+
+// TurnOnDebug starts showing debug messages, wherever the informational ones go.
+func (runner *Runner) TurnOnDebug() {
+	fmt.Fprintln(output.status, "Turning on debug mode.")
+	output.debug = debugTarget()
+}
+
+// Stop leaves the devices showing ExitColor, or turns them off, and runs the exit hooks, which clear the Slack status
+// and close the MQTT connection.  Run returns at its next wait without showing anything more.  It is safe to call Stop
+// from another goroutine, and more than once.
+func (runner *Runner) Stop() {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	if runner.isStopped() {
+		return
+	}
+	close(runner.stopped)
+	shutDown(runner.displays)
+	runExitFuncs()
+}
+
+// isStopped reports whether Stop has been called.
+func (runner *Runner) isStopped() bool {
+	select {
+	case <-runner.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// Identify shows every built-in and custom color on the devices in turn, printing the name of each, and then turns
+// them off.
+func (runner *Runner) Identify() {
+	runner.start()
+	displays := runner.open()
+	identify(displays, runner.userPrefs)
+	turnOff(displays)
+}
+
+// Calibrate shows each of the reference colors on every device at once, until Enter is pressed, and then turns them
+// off.
+func (runner *Runner) Calibrate() {
+	runner.start()
+	displays := runner.open()
+	calibrationTest(displays, runner.userPrefs)
+	turnOff(displays)
+}
+
+// CheckAuth reads every calendar once without signing in, and returns the exit code for --check_auth.
+func (runner *Runner) CheckAuth() int {
+	runner.start()
+	return checkAuth(runner.userPrefs)
+}
+
+// ListCalendars prints the name and ID of every calendar the account can read.
+func (runner *Runner) ListCalendars() {
+	runner.start()
+	listCalendars(runner.userPrefs)
+}
+
+// Run shows the calendars on the devices until Stop is called, or for one pass if Once is set.
+func (runner *Runner) Run() {
+	runner.start()
+	userPrefs := runner.userPrefs
+	backend := connect(userPrefs)
+	// lookUpAccount sets the account's email address for OnlyMyEvents.  It is only looked up the first time it's needed.
+	var accountEmail string
+	lookUpAccount := func() error {
+		if !userPrefs.onlyMyEvents {
+			return nil
+		}
+		if accountEmail == "" {
+			email, err := backend.accountEmail()
+			if err != nil {
+				return err
+			}
+			accountEmail = email
+		}
+		userPrefs.accountEmail = accountEmail
+		return nil
+	}
+	// The account lookup is the only part of starting up that needs the calendar server, so it is retried
+	// ConnectRetries times.
+	for attempt := 1; ; attempt++ {
+		err := lookUpAccount()
+		if err == nil {
+			break
+		}
+		if userPrefs.connectRetries != retryForever && attempt > userPrefs.connectRetries {
+			log.Fatalf("Unable to find the account's email address for onlyMyEvents: %v", err)
+		}
+		wait := time.Duration(userPrefs.connectRetryInterval) * time.Second
+		log.Printf("Unable to find the account's email address for onlyMyEvents, attempt %v; trying again in %v: %v",
+			attempt, wait, err)
+		time.Sleep(wait)
+	}
+
+	displays := runner.open()
+	board := &statusBoard{}
+	if userPrefs.statusPort != 0 {
+		startStatusServer(board, userPrefs.statusPort, userPrefs.privacyMode)
+	}
+	metrics := newCalblinkMetrics()
+	if userPrefs.metricsPort != 0 {
+		startMetricsServer(metrics, userPrefs.metricsPort)
+	}
+	var slack *slackStatus
+	if userPrefs.slackToken != "" && !userPrefs.dryRun {
+		slack = newSlackStatus(userPrefs.slackToken)
+		// In once mode the light is left on at exit, so the status is left too; it expires when the event starts.
+		if !runner.Once {
+			atExit(slack.clear)
+		}
+	}
+	var webhook *webhookNotifier
+	if userPrefs.webhookURL != "" && !userPrefs.dryRun {
+		webhook = newWebhookNotifier(userPrefs.webhookURL)
+		if runner.Once {
+			atExit(webhook.flush)
+		}
+	}
+	var mqtt *mqttPublisher
+	if userPrefs.mqttBroker != "" && !userPrefs.dryRun {
+		var err error
+		mqtt, err = newMQTTPublisher(userPrefs.mqttBroker, userPrefs.mqttUsername, userPrefs.mqttPassword, userPrefs.mqttTopic)
+		if err != nil {
+			log.Fatalf("Invalid mqttBroker %v: %v", userPrefs.mqttBroker, err)
+		}
+		atExit(mqtt.close)
+	}
+	commands := make(chan controlCommand)
+	if userPrefs.controlSocket != "" {
+		startControlSocket(userPrefs.controlSocket, commands)
+	}
+	if userPrefs.grpcPort != 0 {
+		startGRPCServer(userPrefs.grpcAddress, userPrefs.grpcPort, board, commands, userPrefs.privacyMode)
+	}
+
+	// In once mode the colors are set directly at the end of the pass, since nothing would be left to flash them.
+	if !runner.Once {
+		for _, display := range displays {
+			go display.blinker.patternRunner()
+		}
+	}
+
+	printStartInfo(userPrefs, displays)
+
+	// publish makes the current state of the displays available to the status server, the status file, Slack, the
+	// webhook and MQTT.
+	publish := func() {
+		board.update(displays)
+		if slack != nil {
+			slack.update(displays, userPrefs.idleState)
+		}
+		if webhook != nil {
+			webhook.update(displays)
+		}
+		if mqtt != nil {
+			mqtt.update(displays, userPrefs.privacyMode)
+		}
+		if userPrefs.statusFile != "" {
+			if err := writeStatusFile(userPrefs.statusFile, board.document(userPrefs.privacyMode)); err != nil {
+				log.Printf("Unable to write status file %v: %v", userPrefs.statusFile, err)
+			}
+		}
+	}
+
+	// While snoozed, or while the screen is locked, the blink(1) is kept off.  While overridden from the control socket,
+	// it shows the override color instead of the calendar.
+	var snoozedUntil time.Time
+	var override calendarState
+	var overrideUntil time.Time
+	// dismissed maps the eventKey of each event dismissed from the control socket to its start time.  A dismissed event
+	// is passed over for the one after it until it starts.
+	dismissed := make(map[string]time.Time)
+	locked := false
+	lockChanges := make(chan bool)
+	if userPrefs.pauseWhenLocked && !runner.Once {
+		watchScreenLock(lockChanges)
+	}
+	// checkHoliday returns a description of today's holiday, or "" if it isn't one.  Holiday calendars are only fetched
+	// once a day, unless the fetch fails.
+	var holidayCheckedOn, calendarHoliday string
+	checkHoliday := func(now time.Time) string {
+		if userPrefs.holidays.isHoliday(now) {
+			return now.Format("2006-01-02")
+		}
+		today := now.Format("2006-01-02")
+		if holidayCheckedOn == today {
+			return calendarHoliday
+		}
+		calendarHoliday = ""
+		for _, calendarID := range userPrefs.holidays.calendars {
+			events, err := backend.fetchEvents(now, calendarID, userPrefs)
+			if err != nil {
+				fmt.Fprintf(output.debug, "Fetching holiday calendar %v failed: %v\n", calendarID, err)
+				return ""
+			}
+			for _, item := range usableEvents(events, calendarID, userPrefs.timezone) {
+				if isAllDayEvent(item) && item.Start.Date <= today {
+					calendarHoliday = item.Summary
+					break
+				}
+			}
+			if calendarHoliday != "" {
+				break
+			}
+		}
+		holidayCheckedOn = today
+		return calendarHoliday
+	}
+	// lastDND is the event on the do not disturb calendar that was going on at the last successful fetch of it, if any.
+	var lastDND *calendar.Event
+	// runningOver reports whether, within EndGraceMinutes of the end of one of the periods, a timed event on a calendar
+	// that one of the devices shows is still going on.  A calendar that can't be fetched doesn't count.
+	runningOver := func(now time.Time, periods []workHours) bool {
+		grace := time.Duration(userPrefs.endGraceMinutes) * time.Minute
+		if grace == 0 || !inEndGrace(now, periods, grace) {
+			return false
+		}
+		checked := make(map[string]bool)
+		for _, display := range displays {
+			for _, calendarID := range display.calendars {
+				if checked[calendarID] {
+					continue
+				}
+				checked[calendarID] = true
+				events, err := backend.fetchEvents(now, calendarID, userPrefs)
+				if err != nil {
+					fmt.Fprintf(output.debug, "Fetching calendar %v for the end grace period failed: %v\n", calendarID, err)
+					continue
+				}
+				if end := meetingEnd(now, usableEvents(events, calendarID, userPrefs.timezone), calendarID, userPrefs); !end.IsZero() {
+					fmt.Fprintf(output.debug, "Staying on past the end of work hours until %v\n", end.Format("15:04"))
+					return true
+				}
+			}
+		}
+		return false
+	}
+	decider := &stateDecider{}
+	// reconnected is set once the backend has been reconnected because the token was refused, and authWarned once the
+	// user has been told to sign in again.  Both are cleared by a poll that succeeds.
+	var reconnected, authWarned bool
+	// missingCalendars holds the calendars that weren't found, so that each is only warned about once.
+	missingCalendars := make(map[string]bool)
+	// backoff is the wait before the next poll after a failed one, or 0 if the last poll succeeded.  It is separate from
+	// the failure count on each display, which only decides when to show the failure color.
+	var backoff time.Duration
+
+	// usePrefs puts a config that has just been assigned to userPrefs into effect, and reports whether it changed which
+	// calendars are shown.
+	usePrefs := func() bool {
+		setExitState(userPrefs.exitState)
+		if err := lookUpAccount(); err != nil {
+			log.Printf("Unable to find the account's email address for onlyMyEvents: %v", err)
+		}
+		if userPrefs.showDots && !jsonLogging {
+			output.dot = output.status
+		} else {
+			output.dot = ioutil.Discard
+		}
+		dots = userPrefs.dots
+		changed := assignCalendars(displays, userPrefs)
+		printStartInfo(userPrefs, displays)
+		return changed
+	}
+
+	// sleep waits for the given duration.  A reloaded config takes effect as soon as it arrives, and if it changes which
+	// calendars are shown, the wait is cut short so that they are fetched straight away.  Commands from the control
+	// socket are handled as they arrive; snoozing, resuming or switching profiles cuts the wait short so that it takes
+	// effect immediately, and so does locking or unlocking the screen.
+	// In once mode, or once the Runner is stopped, sleep returns false straight away, and Run returns.
+	sleep := func(d time.Duration) bool {
+		if runner.Once {
+			// Leave each device showing this pass's color, rather than turning it off.  A flashing color is left
+			// showing its first color.
+			for _, display := range displays {
+				shown := display.state
+				if display.quiet {
+					shown = black
+				}
+				for _, runner := range newLEDRunners(shown) {
+					state := runner.blinkState
+					state.LED = runner.led
+					state.FadeTime = display.blinker.currentFadeTime()
+					display.blinker.setState(state)
+				}
+			}
+			runExitFuncs()
+			return false
+		}
+		if runner.isStopped() {
+			return false
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		for {
+			select {
+			case <-runner.stopped:
+				return false
+			case <-timer.C:
+				return true
+			case newPrefs := <-runner.reload:
+				userPrefs = newPrefs
+				fmt.Fprintln(output.status, "Reloaded config file.")
+				if usePrefs() {
+					return true
+				}
+			case locked = <-lockChanges:
+				fmt.Fprintf(output.debug, "Screen locked: %v\n", locked)
+				return true
+			case command := <-commands:
+				switch command.name {
+				case "snooze":
+					snoozedUntil = time.Now().Add(command.duration)
+					overrideUntil = time.Time{}
+					command.reply <- "snoozed until " + snoozedUntil.Format("15:04:05")
+					return true
+				case "override":
+					state, ok := userPrefs.stateByName(command.color)
+					if !ok {
+						command.reply <- fmt.Sprintf("error: unknown color %q", command.color)
+						continue
+					}
+					override = state
+					overrideUntil = time.Now().Add(command.duration)
+					snoozedUntil = time.Time{}
+					command.reply <- fmt.Sprintf("showing %v until %v", override.name, overrideUntil.Format("15:04:05"))
+					return true
+				case "release":
+					for _, display := range displays {
+						display.blinker.release(command.duration)
+					}
+					command.reply <- "released until " + time.Now().Add(command.duration).Format("15:04:05")
+					continue
+				case "resume":
+					snoozedUntil = time.Time{}
+					overrideUntil = time.Time{}
+					for _, display := range displays {
+						display.blinker.release(0)
+					}
+					command.reply <- "resumed"
+					return true
+				case "status":
+					command.reply <- describeStatus(displays, snoozedUntil, override, overrideUntil)
+				case "dismiss":
+					var summaries []string
+					for _, display := range displays {
+						next := display.next
+						if next == nil || !next.startTime.After(time.Now()) {
+							continue
+						}
+						if _, ok := dismissed[eventKey(next)]; !ok {
+							dismissed[eventKey(next)] = next.startTime
+							summaries = append(summaries, fmt.Sprintf("%q", next.Summary))
+						}
+					}
+					if len(summaries) == 0 {
+						command.reply <- "error: no upcoming event to dismiss"
+						continue
+					}
+					command.reply <- "dismissed " + strings.Join(summaries, ", ")
+					return true
+				case "profile":
+					newPrefs, err := runner.readUserPrefs(command.profile)
+					if err != nil {
+						command.reply <- fmt.Sprintf("error: %v", err)
+						continue
+					}
+					setProfile(command.profile)
+					userPrefs = newPrefs
+					fmt.Fprintf(output.status, "Switched to profile %v.\n", command.profile)
+					usePrefs()
+					command.reply <- "using profile " + command.profile
+					// Fetch and show the new profile's calendars straight away, whether or not they changed.
+					return true
+				}
+			}
+		}
+	}
+
+	// fetched holds this pass's fetch of each calendar, since several devices may share one.
+	type fetchResult struct {
+		next *upcomingEvent
+		err  error
+	}
+	var fetched map[string]fetchResult
+	events := &tickEvents{
+		displays:    displays,
+		holiday:     checkHoliday,
+		runningOver: runningOver,
+		dnd: func(now time.Time) *calendar.Event {
+			fetchStart := time.Now()
+			dnd, err := currentEvent(now, backend, userPrefs.dndCalendar, userPrefs)
+			metrics.recordFetch(userPrefs.dndCalendar, time.Since(fetchStart), err)
+			if err != nil {
+				// Carry on as usual rather than leave the light off on a guess, unless the last successful fetch found an
+				// event that still hasn't ended.
+				fmt.Fprintf(output.debug, "Fetching do not disturb calendar %v failed: %v\n", userPrefs.dndCalendar, err)
+				if lastDND != nil && hasEnded(now, lastDND, userPrefs.timezone) {
+					lastDND = nil
+				}
+				return lastDND
+			}
+			lastDND = dnd
+			return dnd
+		},
+		away: func(now time.Time, calendarID string) *calendar.Event {
+			event, err := outOfOfficeEvent(now, backend, calendarID, userPrefs)
+			if err != nil {
+				// As with do not disturb, carry on as usual rather than guess.
+				fmt.Fprintf(output.debug, "Checking calendar %v for out of office failed: %v\n", calendarID, err)
+				return nil
+			}
+			return event
+		},
+		fetch: func(now time.Time, device int, calendarID string) (*upcomingEvent, error) {
+			result, ok := fetched[calendarID]
+			if !ok {
+				fetchStart := time.Now()
+				result.next, result.err = fetchEvents(now, backend, calendarID, userPrefs, dismissed)
+				metrics.recordFetch(calendarID, time.Since(fetchStart), result.err)
+				fetched[calendarID] = result
+				if _, notFound := result.err.(calendarNotFoundError); notFound && !missingCalendars[calendarID] {
+					log.Printf("Calendar %v not found, so it is being skipped; check the calendar ID in the config", calendarID)
+					missingCalendars[calendarID] = true
+				} else if !notFound && missingCalendars[calendarID] {
+					fmt.Fprintf(output.status, "Calendar %v found\n", calendarID)
+					delete(missingCalendars, calendarID)
+				}
+			}
+			if limited, ok := result.err.(rateLimitError); ok {
+				logEvent(levelWarn, "Rate limited", "device", device, "calendar", calendarID, "retryAfter", limited.retryAfter)
+			} else if _, notFound := result.err.(calendarNotFoundError); !notFound && result.err != nil {
+				logEvent(levelWarn, "Fetching calendar failed", "device", device, "calendar", calendarID, "error", result.err,
+					"failures", displays[device].failures+1)
+			}
+			return result.next, result.err
+		},
+		decide: func(now time.Time, device int, next *upcomingEvent, state calendarState) calendarState {
+			return decider.decide(now, device, next, state, userPrefs)
+		},
+	}
+
+	// Each pass decides what the devices show with decideTick, and then shows it.  A device that is released shows
+	// nothing until it is reopened, and then shows whatever it would have.
+	for {
+		// Work hours and days are in the user's time zone, whatever the system's is.
+		now := time.Now().In(userPrefs.timezone)
+		for key, start := range dismissed {
+			if !start.After(now) {
+				delete(dismissed, key)
+			}
+		}
+		fetched = make(map[string]fetchResult)
+		events.snoozedUntil, events.override, events.overrideUntil = snoozedUntil, override, overrideUntil
+		events.locked, events.reconnected, events.backoff = locked, reconnected, backoff
+		pattern, nextWake := decideTick(now, userPrefs, events)
+		// Fetching may have taken a while, and once the devices are shut down, nothing more should be shown.
+		if runner.isStopped() {
+			return
+		}
+		for _, display := range displays {
+			display.blinker.setBrightness(userPrefs.brightnessAt(now))
+			display.blinker.setFadeTime(time.Duration(userPrefs.fadeMillis) * time.Millisecond)
+			display.blinker.setFlashTiming(time.Duration(userPrefs.flashIntervalMillis)*time.Millisecond,
+				time.Duration(userPrefs.flashOnMillis)*time.Millisecond, time.Duration(userPrefs.flashOffMillis)*time.Millisecond)
+			display.quiet = pattern.quiet
+		}
+		if pattern.all != nil {
+			executeAll(*pattern.all, displays)
+			explainf("all devices: %v", pattern.explanation)
+			fmt.Fprintf(output.debug, "Sleeping until %v: %v\n", nextWake.Format("15:04:05"), pattern.explanation)
+			printDot(pattern.dot)
+			publish()
+			if !sleep(time.Until(nextWake)) {
+				return
+			}
+			continue
+		}
+		// Devices showing the same event only bring up one notification between them.
+		notified := make(map[string]bool)
+		for i, decision := range pattern.devices {
+			display := displays[i]
+			if decision.failed {
+				display.failures++
+			} else if decision.show {
+				display.failures = 0
+			}
+			// Notify and play the sound once per event, and set the Slack status.
+			if next := decision.next; decision.notify {
+				key := eventKey(next)
+				if key != display.notified && !notified[key] {
+					if userPrefs.notify {
+						notifyEvent(next)
+					}
+					if userPrefs.soundOnImminent {
+						playSound(userPrefs.soundFile)
+					}
+				}
+				display.notified = key
+				notified[key] = true
+				if slack != nil && !next.declined {
+					slack.showEvent(now, next)
+				}
+			}
+			if decision.show {
+				display.show(decision.state, decision.next)
+			}
+			explainf("device %v: %v", i, decision.explanation)
+			if decision.failed || !decision.show {
+				continue
+			}
+			if next := decision.next; next != nil {
+				logEvent(levelInfo, "Polled", "device", i, "color", decision.state.name, "event", next.Summary, "calendar",
+					next.calendarID, "minutes", int(math.Ceil(next.startTime.Sub(now).Minutes())))
+			} else {
+				logEvent(levelInfo, "Polled", "device", i, "color", decision.state.name)
+			}
+		}
+		// A refused token won't start working by itself, but it is worth reconnecting once in case the token file has
+		// been replaced, such as by signing in with another copy of calblink.
+		if pattern.authRefused {
+			tokenFile := backendTokenFile(userPrefs)
+			if _, err := tokenFromFile(tokenFile); !reconnected && err == nil {
+				log.Printf("The calendar server refused the token; reconnecting")
+				backend = connect(userPrefs)
+			} else if !authWarned {
+				log.Printf("The calendar server refused the token in %v.  Remove it and run calblink again to sign in.", tokenFile)
+				authWarned = true
+			}
+			reconnected = true
+		} else if pattern.dot == dotNormal {
+			reconnected, authWarned = false, false
+		}
+		if pattern.dot == dotNormal {
+			board.polled(now)
+		}
+		publish()
+		metrics.update(displays)
+		printDot(pattern.dot)
+		backoff = 0
+		if pattern.dot == dotError {
+			backoff = nextWake.Sub(now)
+			if pattern.rateLimited {
+				log.Printf("Rate limited by the calendar server, waiting %v", backoff)
+			}
+			fmt.Fprintf(output.debug, "Backing off for %v after a failed poll\n", backoff)
+		}
+		if !sleep(time.Until(nextWake)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRunner returns a Runner on a simulated device for an iCalendar feed with one event, starting half an hour
+// from now, which the config shows as Red.  Its output goes to the returned buffer.
+func newTestRunner(t *testing.T) (*Runner, *lockedBuffer) {
+	t.Helper()
+	start := time.Now().UTC().Add(30 * time.Minute)
+	feed := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"BEGIN:VEVENT",
+		"UID:meeting",
+		"SUMMARY:Meeting",
+		"DTSTART:" + start.Format("20060102T150405Z"),
+		"DTEND:" + start.Add(30*time.Minute).Format("20060102T150405Z"),
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, feed)
+	}))
+	t.Cleanup(server.Close)
+	userPrefs := testPrefs(t, fmt.Sprintf(`{"backend": "ics", "calendar": %q,
+		"colorRules": [{"minutes": 60, "color": "Red"}, {"color": "Green"}]}`, server.URL))
+	saved := output
+	t.Cleanup(func() { output = saved })
+	out := &lockedBuffer{}
+	runner := NewRunner(userPrefs, openSimulatedDevice(""))
+	runner.Status = out
+	return runner, out
+}
+
+func TestRunnerOnce(t *testing.T) {
+	runner, out := newTestRunner(t)
+	runner.Once = true
+	runner.Run()
+	settings := simulatedSettings(out.String())
+	if len(settings) == 0 || settings[len(settings)-1] != "both LEDs #ff0000" {
+		t.Fatalf("Run left the device set to %q, want it left at both LEDs #ff0000", settings)
+	}
+}
+
+func TestRunnerStop(t *testing.T) {
+	runner, out := newTestRunner(t)
+	done := make(chan struct{})
+	go func() {
+		runner.Run()
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(out.String(), "#ff0000"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Run didn't show the event; output:\n%v", out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	runner.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after Stop")
+	}
+	// Stop turns the device off itself, and hands black to the patternRunner, which has to have shown it before the
+	// test puts the output back.
+	want := []string{"both LEDs #ff0000", "both LEDs #000000", "both LEDs #000000"}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		settings := simulatedSettings(out.String())
+		if len(settings) >= len(want) && reflect.DeepEqual(settings[len(settings)-len(want):], want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Stop left the device set to %q, want it ending %q", settings, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	blink1 "github.com/hink/go-blink1"
+)
+
+// simulatedDevice stands in for a light when there is no hardware, printing each state it is set to.
+type simulatedDevice struct {
+	number int
+	serial string
+}
+
+var (
+	simulatedDevicesMu sync.Mutex
+	simulatedDevices   int
+)
+
+// openSimulatedDevice is the simulated equivalent of openBlink1Device.  It never fails: a device with the serial number
+// is made up if need be, and devices opened without one are given SIM0, SIM1 and so on.
+func openSimulatedDevice(serial string) *simulatedDevice {
+	simulatedDevicesMu.Lock()
+	defer simulatedDevicesMu.Unlock()
+	if serial == "" {
+		serial = fmt.Sprintf("SIM%v", simulatedDevices)
+	}
+	device := &simulatedDevice{number: simulatedDevices, serial: serial}
+	simulatedDevices++
+	return device
+}
+
+func (device *simulatedDevice) SetColor(state blink1.State) error {
+	led := "both LEDs"
+	switch state.LED {
+	case blink1.LED1:
+		led = "LED 1"
+	case blink1.LED2:
+		led = "LED 2"
+	}
+	fmt.Fprintf(output.status, "%v simulated device %v: %v set to #%02x%02x%02x", time.Now().Format("15:04:05.000"),
+		device.number, led, state.Red, state.Green, state.Blue)
+	if state.FadeTime > 0 {
+		fmt.Fprintf(output.status, " fading over %v", state.FadeTime)
+	}
+	fmt.Fprintln(output.status)
+	return nil
+}
+
+func (device *simulatedDevice) Off() error {
+	return device.SetColor(blink1.OffState)
+}
+
+func (device *simulatedDevice) Close() error {
+	return nil
+}
+
+func (device *simulatedDevice) Serial() string {
+	return device.serial
+}
+
+// dryRunOut is where dry-run mode explains what it would have shown.  It is discarded unless dry-run mode is on.
+var dryRunOut io.Writer = ioutil.Discard
+
+// explainf prints a line explaining a dry-run decision.
+func explainf(format string, args ...interface{}) {
+	fmt.Fprintf(dryRunOut, "%v %v\n", time.Now().Format("15:04:05"), fmt.Sprintf(format, args...))
+}
+
+// describeEvent says when the event starts, for dry-run explanations.
+func describeEvent(now time.Time, next *upcomingEvent) string {
+	if next == nil {
+		return "no upcoming events"
+	}
+	minutes := int(next.startTime.Sub(now).Minutes())
+	if minutes < 0 {
+		return fmt.Sprintf("event %q started %v minutes ago", next.Summary, -minutes)
+	}
+	return fmt.Sprintf("event %q in %v minutes", next.Summary, minutes)
+}
+
+// dryRunDevice stands in for a light in dry-run mode.  It does nothing, so that only the explanations are printed.
+type dryRunDevice struct{}
+
+func (device dryRunDevice) SetColor(state blink1.State) error {
+	return nil
+}
+
+func (device dryRunDevice) Off() error {
+	return nil
+}
+
+func (device dryRunDevice) Close() error {
+	return nil
+}
+
+func (device dryRunDevice) Serial() string {
+	return ""
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const slackProfileURL = "https://slack.com/api/users.profile.set"
+
+// slackRetryAfter is how long to wait after being rate limited, if Slack doesn't say.
+const slackRetryAfter = time.Minute
+
+// slackStatus keeps the user's Slack status in step with the light: it is set when an event becomes imminent, and
+// cleared when the light goes off.  A status that couldn't be set is tried again on the next poll.
+type slackStatus struct {
+	mu     sync.Mutex
+	client *http.Client
+	token  string
+	// current is the status Slack has, and wanted is the status it should have.  They differ while an update is
+	// failing or rate limited.
+	current slackProfile
+	wanted  slackProfile
+	// event is the eventKey of the event the wanted status is for, or "" if it should be clear.
+	event   string
+	retryAt time.Time
+}
+
+// slackProfile is the part of a Slack profile that makes up the status.  The zero value is a clear status.
+type slackProfile struct {
+	StatusText       string `json:"status_text"`
+	StatusEmoji      string `json:"status_emoji"`
+	StatusExpiration int64  `json:"status_expiration"`
+}
+
+func newSlackStatus(token string) *slackStatus {
+	return &slackStatus{client: &http.Client{Timeout: 10 * time.Second}, token: token}
+}
+
+// showEvent sets the status for an event that has just become imminent.  Each event only sets the status once, and
+// the status expires when it starts.
+func (slack *slackStatus) showEvent(now time.Time, next *upcomingEvent) {
+	slack.mu.Lock()
+	defer slack.mu.Unlock()
+	key := eventKey(next)
+	if key == slack.event {
+		return
+	}
+	slack.event = key
+	slack.wanted = slackProfile{
+		StatusText:       fmt.Sprintf("In %v min", math.Ceil(next.startTime.Sub(now).Minutes())),
+		StatusEmoji:      ":calendar:",
+		StatusExpiration: next.startTime.Unix(),
+	}
+}
+
+// update clears the status if every display is off or showing the idle color, and then sends Slack any change that
+// hasn't been made yet.
+func (slack *slackStatus) update(displays []*deviceDisplay, idle calendarState) {
+	slack.mu.Lock()
+	defer slack.mu.Unlock()
+	lit := false
+	for _, display := range displays {
+		if display.state != black && display.state != idle {
+			lit = true
+		}
+	}
+	if !lit {
+		slack.event = ""
+		slack.wanted = slackProfile{}
+	}
+	if slack.wanted == slack.current || time.Now().Before(slack.retryAt) {
+		return
+	}
+	if err := slack.send(slack.wanted); err != nil {
+		log.Printf("Unable to set Slack status: %v", err)
+		return
+	}
+	slack.current = slack.wanted
+}
+
+// clear clears the status, if it was set, whether or not Slack has asked us to wait.  It is for use at exit.
+func (slack *slackStatus) clear() {
+	slack.mu.Lock()
+	defer slack.mu.Unlock()
+	if slack.current == (slackProfile{}) {
+		return
+	}
+	if err := slack.send(slackProfile{}); err != nil {
+		log.Printf("Unable to clear Slack status: %v", err)
+	}
+}
+
+// send sets the status.  If Slack rate limits us, no more updates are sent until it says to try again.
+func (slack *slackStatus) send(profile slackProfile) error {
+	fmt.Fprintf(output.debug, "Setting Slack status to %q %q\n", profile.StatusEmoji, profile.StatusText)
+	body, err := json.Marshal(struct {
+		Profile slackProfile `json:"profile"`
+	}{profile})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", slackProfileURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+slack.token)
+	resp, err := slack.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait := slackRetryAfter
+		if after := retryAfter(resp.Header); after > 0 {
+			wait = after
+		}
+		slack.retryAt = time.Now().Add(wait)
+		return fmt.Errorf("rate limited, trying again in %v", wait)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Slack request failed: %v", resp.Status)
+	}
+	var result struct {
+		OK    bool
+		Error string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("Unable to parse Slack response: %v", err)
+	}
+	if !result.OK {
+		return fmt.Errorf("Slack request failed: %v", result.Error)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// soundPlayer is a command that plays a sound file.  args returns its arguments for the file.
+type soundPlayer struct {
+	command string
+	args    func(path string) []string
+}
+
+// soundPlayers are the commands that can play a sound file on each platform, in order of preference.  The first one
+// that is installed is used.
+var soundPlayers = map[string][]soundPlayer{
+	"darwin": {
+		{"afplay", func(path string) []string { return []string{path} }},
+	},
+	"linux": {
+		{"paplay", func(path string) []string { return []string{path} }},
+		{"aplay", func(path string) []string { return []string{"-q", path} }},
+		{"ffplay", func(path string) []string { return []string{"-nodisp", "-autoexit", "-loglevel", "quiet", path} }},
+	},
+	"windows": {
+		{"powershell", func(path string) []string {
+			quoted := "'" + strings.Replace(path, "'", "''", -1) + "'"
+			return []string{"-NoProfile", "-Command", "(New-Object Media.SoundPlayer " + quoted + ").PlaySync()"}
+		}},
+	},
+}
+
+var (
+	// soundPlayerOnce looks for a sound player the first time a sound is played, and chosenPlayer is the one found,
+	// or nil if there isn't one.
+	soundPlayerOnce sync.Once
+	chosenPlayer    *soundPlayer
+)
+
+// playSound plays the sound file in the background.  If there is no way to play sounds here, it logs a warning the
+// first time, and does nothing.
+func playSound(path string) {
+	soundPlayerOnce.Do(func() {
+		var names []string
+		for _, player := range soundPlayers[runtime.GOOS] {
+			if _, err := exec.LookPath(player.command); err == nil {
+				chosenPlayer = &player
+				return
+			}
+			names = append(names, player.command)
+		}
+		if len(names) == 0 {
+			log.Printf("Unable to play sounds on %v; soundOnImminent is ignored", runtime.GOOS)
+		} else {
+			log.Printf("Unable to play sounds: none of %v is installed; soundOnImminent is ignored", strings.Join(names, ", "))
+		}
+	})
+	if chosenPlayer == nil {
+		return
+	}
+	fmt.Fprintf(output.debug, "Playing %v with %v\n", path, chosenPlayer.command)
+	cmd := exec.Command(chosenPlayer.command, chosenPlayer.args(path)...)
+	go func() {
+		if err := cmd.Run(); err != nil {
+			log.Printf("Unable to play %v: %v", path, err)
+		}
+	}()
+}
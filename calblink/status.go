@@ -0,0 +1,175 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// deviceStatus is the published state of a single device.
+type deviceStatus struct {
+	Calendars         []string   `json:"calendars,omitempty"`
+	Color             string     `json:"color"`
+	NextEvent         string     `json:"nextEvent,omitempty"`
+	NextEventStart    *time.Time `json:"nextEventStart,omitempty"`
+	NextEventCalendar string     `json:"nextEventCalendar,omitempty"`
+	MinutesUntilStart *int64     `json:"minutesUntilStart,omitempty"`
+}
+
+// statusDocument is the JSON document served by the status server and written to the status file.
+type statusDocument struct {
+	LastPoll *time.Time     `json:"lastPoll,omitempty"`
+	Devices  []deviceStatus `json:"devices"`
+}
+
+// statusBoard holds the most recent state of every device.  The main loop publishes to it and the status server reads
+// from it, so all access goes through the mutex.
+type statusBoard struct {
+	mu       sync.Mutex
+	lastPoll time.Time
+	devices  []deviceStatus
+	// changed is closed, and replaced, whenever the state of a device changes.
+	changed chan struct{}
+}
+
+// changes returns a channel that is closed the next time the state of a device changes.
+func (board *statusBoard) changes() <-chan struct{} {
+	board.mu.Lock()
+	defer board.mu.Unlock()
+	if board.changed == nil {
+		board.changed = make(chan struct{})
+	}
+	return board.changed
+}
+
+// update publishes the current state of each display.
+func (board *statusBoard) update(displays []*deviceDisplay) {
+	devices := make([]deviceStatus, len(displays))
+	for i, display := range displays {
+		devices[i] = deviceStatus{Calendars: display.calendars, Color: display.state.name}
+		if display.next != nil {
+			startTime := display.next.startTime
+			devices[i].NextEvent = display.next.Summary
+			devices[i].NextEventStart = &startTime
+			devices[i].NextEventCalendar = display.next.calendarID
+			// Whole minutes, rounded down as the colors are: 4.5 minutes to go is 4.
+			minutes := int64(math.Floor(time.Until(startTime).Minutes()))
+			devices[i].MinutesUntilStart = &minutes
+		}
+	}
+	board.mu.Lock()
+	defer board.mu.Unlock()
+	if reflect.DeepEqual(devices, board.devices) {
+		return
+	}
+	board.devices = devices
+	if board.changed != nil {
+		close(board.changed)
+		board.changed = nil
+	}
+}
+
+// polled records the time of the last successful poll of the calendar server.
+func (board *statusBoard) polled(t time.Time) {
+	board.mu.Lock()
+	defer board.mu.Unlock()
+	board.lastPoll = t
+}
+
+// document returns the current status.  In privacy mode only the color names are included.
+func (board *statusBoard) document(privacyMode bool) statusDocument {
+	board.mu.Lock()
+	defer board.mu.Unlock()
+	doc := statusDocument{Devices: make([]deviceStatus, len(board.devices))}
+	for i, device := range board.devices {
+		if privacyMode {
+			doc.Devices[i] = deviceStatus{Color: device.Color}
+		} else {
+			doc.Devices[i] = device
+		}
+	}
+	if !privacyMode && !board.lastPoll.IsZero() {
+		lastPoll := board.lastPoll
+		doc.LastPoll = &lastPoll
+	}
+	return doc
+}
+
+// writeStatusFile writes the status document to path.  It writes a temporary file in the same directory and renames it
+// into place, so that readers never see a partly written file.
+func writeStatusFile(path string, doc statusDocument) error {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return nil
+}
+
+// startStatusServer starts serving the status board as JSON on the given port.
+func startStatusServer(board *statusBoard, port int, privacyMode bool) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(board.document(privacyMode)); err != nil {
+			fmt.Fprintf(output.debug, "Unable to write status: %v\n", err)
+		}
+	})
+	serveHTTP("Status", port, mux)
+}
+
+// serveHTTP serves handler on the given port in the background, and arranges for the server to shut down when the
+// program exits.  Name is used in error messages.
+func serveHTTP(name string, port int, handler http.Handler) {
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: handler}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("%v server failed: %v", name, err)
+		}
+	}()
+	atExit(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+}
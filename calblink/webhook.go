@@ -0,0 +1,118 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calblink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout is how long a webhook request can take before it is abandoned.
+const webhookTimeout = 5 * time.Second
+
+// webhookQueueSize is how many transitions can wait to be sent.  Any more are dropped rather than hold up the main loop.
+const webhookQueueSize = 16
+
+// webhookNotifier POSTs each change of a device's color to a URL.  Requests are sent one at a time by a worker, so a
+// slow or unreachable server never blocks the main loop.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+	queue  chan webhookTransition
+	done   chan struct{}
+	// sent is the state last queued for each device, so that only changes are sent.  It is only used by the main loop.
+	sent map[int]calendarState
+}
+
+// webhookTransition is the body of a webhook request.
+type webhookTransition struct {
+	Device    int    `json:"device"`
+	Color     string `json:"color"`
+	Event     string `json:"event,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+func newWebhookNotifier(url string) *webhookNotifier {
+	webhook := &webhookNotifier{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan webhookTransition, webhookQueueSize),
+		done:   make(chan struct{}),
+		sent:   make(map[int]calendarState),
+	}
+	go webhook.worker()
+	return webhook
+}
+
+// update queues a request for each display whose state has changed since the last one.
+func (webhook *webhookNotifier) update(displays []*deviceDisplay) {
+	for _, display := range displays {
+		if last, ok := webhook.sent[display.number]; ok && last == display.state {
+			continue
+		}
+		webhook.sent[display.number] = display.state
+		transition := webhookTransition{
+			Device:    display.number,
+			Color:     display.state.name,
+			Timestamp: time.Now().Format(time.RFC3339),
+		}
+		if display.next != nil {
+			transition.Event = display.next.Summary
+		}
+		select {
+		case webhook.queue <- transition:
+		default:
+			fmt.Fprintf(output.debug, "Webhook queue full, dropping change to %v\n", transition.Color)
+		}
+	}
+}
+
+func (webhook *webhookNotifier) worker() {
+	for transition := range webhook.queue {
+		if err := webhook.send(transition); err != nil {
+			fmt.Fprintf(output.debug, "Webhook for change to %v failed: %v\n", transition.Color, err)
+		}
+	}
+	close(webhook.done)
+}
+
+// flush sends the requests that are still queued, for use at exit in once mode, where the program would otherwise quit
+// before the worker gets to them.  No more updates can be made after it.
+func (webhook *webhookNotifier) flush() {
+	close(webhook.queue)
+	select {
+	case <-webhook.done:
+	case <-time.After(webhookTimeout):
+	}
+}
+
+func (webhook *webhookNotifier) send(transition webhookTransition) error {
+	body, err := json.Marshal(transition)
+	if err != nil {
+		return err
+	}
+	resp, err := webhook.client.Post(webhook.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook request failed: %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command calblink shows upcoming events from your calendar on a blink(1).  See the README for how to set it up.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/google/calblink/calblink"
+	"github.com/kardianos/service"
+)
+
+// flags
+
+// defaults are the options the flags start from.
+var defaults = calblink.DefaultOptions()
+
+var debugFlag = flag.Bool("debug", false, "Show debug messages")
+var clientSecretFlag = flag.String("clientsecret", defaults.ClientSecretFile, "Path to JSON file containing client secret")
+var calNameFlag = flag.String("calendar", defaults.Calendar, "Name of calendar to base blinker on (overrides value in config file)")
+var configFileFlag = flag.String("config", defaults.ConfigFile, "Path to configuration file")
+var pollIntervalFlag = flag.Int("poll_interval", defaults.PollInterval, "Number of seconds between polls of calendar API (overrides value in config file)")
+var responseStateFlag = flag.String("response_state", defaults.ResponseState, "Which events to consider based on response: all, accepted, or notRejected")
+var deviceFailureRetriesFlag = flag.Int("device_failure_retries", defaults.DeviceFailureRetries, "Number of times to retry initializing the device before quitting the program, or -1 to retry forever")
+var simulateFlag = flag.Bool("simulate", defaults.Simulate, "Print color changes instead of using a blink(1) device")
+var onceFlag = flag.Bool("once", false, "Check the calendar and set the device once, then exit and leave it set")
+var dryRunFlag = flag.Bool("dry_run", defaults.DryRun, "Print the color that would be shown, and why, instead of using a device")
+var tokenFileFlag = flag.String("token_file", "", "Path to the file the OAuth token is cached in (overrides value in config file)")
+var identifyFlag = flag.Bool("identify", false, "Show each color on the device in turn, then exit")
+var versionFlag = flag.Bool("version", false, "Print the version and exit")
+var showDotsFlag = flag.Bool("show_dots", defaults.ShowDots, "Whether to show progress dots after every cycle of checking the calendar")
+var checkAuthFlag = flag.Bool("check_auth", false, "Check that every calendar can be read without signing in, then exit")
+var serviceFlag = flag.String("service", "", "Install, uninstall, start, stop or restart calblink as a service, with the other flags given, or show its status, then exit")
+var serviceNameFlag = flag.String("service_name", "calblink", "Name of the service for --service, and to run as under a service manager")
+var statusFlag = flag.Bool("status", false, "Print the state of the calblink already running, through its controlSocket, then exit")
+var listCalendarsFlag = flag.Bool("list_calendars", false, "Print the name and ID of every calendar the account can read, then exit")
+var profileFlag = flag.String("profile", "", "Name of the profile in the config file to start with")
+var calibrateFlag = flag.Bool("calibrate", false, "Show reference colors on every device at once, to compare them for deviceCalibration, then exit")
+var printConfigFlag = flag.Bool("print_config", false, "Print the config in effect, with secrets hidden, then exit")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	flag.PrintDefaults()
+}
+
+// flagOptions returns the calblink options from the flags.
+func flagOptions() calblink.Options {
+	options := calblink.Options{
+		ConfigFile:           *configFileFlag,
+		ClientSecretFile:     *clientSecretFlag,
+		Calendar:             *calNameFlag,
+		PollInterval:         *pollIntervalFlag,
+		ResponseState:        *responseStateFlag,
+		DeviceFailureRetries: *deviceFailureRetriesFlag,
+		ShowDots:             *showDotsFlag,
+		Simulate:             *simulateFlag,
+		DryRun:               *dryRunFlag,
+		Overrides:            make(map[string]string),
+	}
+	flag.Visit(func(myFlag *flag.Flag) {
+		options.Overrides[myFlag.Name] = myFlag.Value.String()
+	})
+	if *debugFlag {
+		options.Debug = os.Stdout
+	}
+	return options
+}
+
+// Signal handler - SIGINT or SIGKILL should turn off the blinkers before we exit.
+// SIGQUIT should turn on debug mode.
+// SIGHUP should reload the config file.  The new prefs are handed to the runner on reload; if they are invalid, the
+// old ones are kept.
+
+// interrupts carries the signals signalHandler acts on.  The service manager's requests to stop arrive here too.
+var interrupts = make(chan os.Signal, 1)
+
+func signalHandler(runner *calblink.Runner) {
+	signal.Notify(interrupts, os.Interrupt, os.Kill, syscall.SIGQUIT, syscall.SIGHUP)
+	for {
+		s := <-interrupts
+		if s == syscall.SIGQUIT {
+			runner.TurnOnDebug()
+			continue
+		}
+		if s == syscall.SIGHUP {
+			if err := runner.Reload(); err != nil {
+				log.Printf("Unable to reload config file, keeping the current config: %v", err)
+			}
+			continue
+		}
+		runner.Stop()
+		log.Fatalf("Quitting due to signal %v", s)
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	calblink.Version = version
+
+	// This needs neither a config file nor a device, so it comes before either is looked at.
+	if *versionFlag {
+		fmt.Println(versionString())
+		return
+	}
+
+	// The service manager has no "status" action, so --service=status is --status, which comes once the config is read.
+	if *serviceFlag != "" && *serviceFlag != "status" {
+		controlService(*serviceFlag, *serviceNameFlag)
+		return
+	}
+	if !service.Interactive() {
+		go runAsService(*serviceNameFlag)
+	}
+
+	userPrefs, err := calblink.ReadUserPrefs(flagOptions(), *profileFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *printConfigFlag {
+		calblink.PrintConfig(userPrefs)
+		return
+	}
+
+	// This comes before the runner opens the log file, so that the reply is printed rather than going into the running
+	// calblink's log.
+	if *statusFlag || *serviceFlag == "status" {
+		reply, err := calblink.QueryStatus(userPrefs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(reply)
+		return
+	}
+
+	runner := calblink.NewRunner(userPrefs, nil)
+	if *debugFlag {
+		runner.Debug = os.Stdout
+	}
+	runner.Once = *onceFlag
+	go signalHandler(runner)
+
+	switch {
+	case *identifyFlag:
+		runner.Identify()
+	case *calibrateFlag:
+		runner.Calibrate()
+	case *checkAuthFlag:
+		// This doesn't need a device, and mustn't stop to ask for an authorization code.
+		os.Exit(runner.CheckAuth())
+	case *listCalendarsFlag:
+		runner.ListCalendars()
+	default:
+		runner.Run()
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+// serviceStopTimeout is how long the service manager is kept waiting on Stop before it is told the service has stopped.
+const serviceStopTimeout = 10 * time.Second
+
+// serviceProgram lets the service manager start and stop calblink.  Calblink runs from main as it does anywhere else,
+// so Start has nothing to do, and Stop asks the signal handler to turn the devices off and quit.
+type serviceProgram struct{}
+
+func (serviceProgram) Start(s service.Service) error {
+	return nil
+}
+
+func (serviceProgram) Stop(s service.Service) error {
+	select {
+	case interrupts <- os.Interrupt:
+	default:
+		// A signal is already waiting, and it will shut down just the same.
+	}
+	// The signal handler exits the program once the devices are off, so this normally never returns.
+	time.Sleep(serviceStopTimeout)
+	return nil
+}
+
+// serviceConfig describes calblink to the service manager.  The service runs with the flags calblink was given when
+// it was installed, apart from --service itself, and from the directory it was installed from, so that relative
+// paths like the default conf.json and client_secret.json still work.
+func serviceConfig(name string) (*service.Config, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find the working directory: %v", err)
+	}
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "service" {
+			args = append(args, fmt.Sprintf("--%v=%v", f.Name, f.Value))
+		}
+	})
+	return &service.Config{
+		Name:             name,
+		DisplayName:      name,
+		Description:      "Shows upcoming calendar events on a blink(1).",
+		Arguments:        args,
+		WorkingDirectory: dir,
+	}, nil
+}
+
+// controlService carries out --service: installing, uninstalling, starting, stopping or restarting the service.
+func controlService(action, name string) {
+	config, err := serviceConfig(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s, err := service.New(serviceProgram{}, config)
+	if err != nil {
+		log.Fatalf("Unable to set up service %v: %v", name, err)
+	}
+	if err := service.Control(s, action); err != nil {
+		log.Fatalf("Unable to %v service %v: %v", action, name, err)
+	}
+	fmt.Printf("Service %v: %v done.\n", name, action)
+}
+
+// runAsService tells the service manager that calblink has started, and passes on its requests to stop.  It doesn't
+// return until the service is stopped, so it runs in its own goroutine while main gets on with running calblink.
+func runAsService(name string) {
+	s, err := service.New(serviceProgram{}, &service.Config{Name: name})
+	if err != nil {
+		log.Printf("Unable to set up service %v: %v", name, err)
+		return
+	}
+	if err := s.Run(); err != nil {
+		log.Printf("Service %v failed: %v", name, err)
+	}
+}